@@ -0,0 +1,263 @@
+package broker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/hub"
+	"github.com/gorilla/websocket"
+)
+
+func TestBroker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer()
+	go s.Serve(l)
+
+	c1, c2 := dial(t, path), dial(t, path)
+	// Wait for the server to have both clients, so nobody misses anything.
+	waitForClients(t, s, 2)
+	events1, events2 := subscribe(t, c1), subscribe(t, c2)
+
+	rid := db.RoomID("ROOM")
+	for _, ev := range []*hub.Event{
+		{Message: hub.Message{Type: hub.QueueChanged, RoomID: rid}},
+		{Message: hub.Message{Type: hub.UpNext, RoomID: rid}, UserID: db.UserID("USER")},
+		{Message: hub.Message{Type: hub.QueueChanged, RoomID: rid}},
+	} {
+		if err := c1.Publish(ev); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+
+	// Both servers should see everything, including what they published
+	// themselves. Events for a single user don't count towards the sequence.
+	wantSeqs := []uint64{1, 0, 2}
+	for _, events := range []<-chan *hub.Event{events1, events2} {
+		for _, want := range wantSeqs {
+			select {
+			case ev := <-events:
+				if ev.Seq != want {
+					t.Errorf("Seq = %d, want %d", ev.Seq, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for event")
+			}
+		}
+	}
+
+	if _, err := c1.Subscribe(); err == nil {
+		t.Error("second Subscribe succeeded, want an error")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer()
+	go s.Serve(l)
+
+	c := dial(t, path)
+	waitForClients(t, s, 1)
+	events := subscribe(t, c)
+
+	// Drop the client, like the server does when it can't keep up.
+	s.mu.Lock()
+	for sc := range s.clients {
+		s.removeLocked(sc)
+	}
+	s.mu.Unlock()
+
+	// The client comes back on its own, with the same subscription.
+	waitForClients(t, s, 1)
+	ev := &hub.Event{Message: hub.Message{Type: hub.QueueChanged, RoomID: db.RoomID("ROOM")}}
+	if err := c.Publish(ev); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	select {
+	case got, ok := <-events:
+		if !ok {
+			t.Fatal("events channel was closed, want it to carry on after reconnecting")
+		}
+		if got.Type != hub.QueueChanged {
+			t.Errorf("Type = %q, want %q", got.Type, hub.QueueChanged)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	// Once the client is closed, it stops for good.
+	c.Close()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("got an event after closing, want the channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the events channel to close")
+	}
+}
+
+func TestServerRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := NewServer()
+	go s.Serve(l)
+
+	c := dial(t, path)
+	waitForClients(t, s, 1)
+	h, err := hub.New(c, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	t.Cleanup(h.Close)
+
+	rm, u := &db.Room{ID: db.RoomID("ROOM")}, &db.User{ID: db.UserID("USER")}
+	ws := dialHub(t, h, rm, u)
+	for i := 0; i < 2; i++ {
+		publish(t, h, rm.ID)
+		if msg := readMessage(t, ws); msg.Type != hub.QueueChanged {
+			t.Fatalf("Type = %q, want %q", msg.Type, hub.QueueChanged)
+		}
+	}
+
+	// Start a new server in the old one's place, which counts from 1 again.
+	l.Close()
+	s.mu.Lock()
+	for sc := range s.clients {
+		s.removeLocked(sc)
+	}
+	s.mu.Unlock()
+	if l, err = net.Listen("unix", path); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	s = NewServer()
+	go s.Serve(l)
+	waitForClients(t, s, 1)
+
+	// The hub can't tell what the new numbers mean, so the client has to
+	// resync before it gets anything else.
+	publish(t, h, rm.ID)
+	if msg := readMessage(t, ws); msg.Type != hub.ResyncRequired {
+		t.Fatalf("Type = %q, want %q", msg.Type, hub.ResyncRequired)
+	}
+	msg := readMessage(t, ws)
+	if msg.Type != hub.QueueChanged || msg.Seq != 1 {
+		t.Errorf("got %q %d, want %q 1", msg.Type, msg.Seq, hub.QueueChanged)
+	}
+}
+
+// publish sends a QueueChanged event to a room, retrying until the hub's
+// client has (re)connected to the broker.
+func publish(t *testing.T, h *hub.Hub, rid db.RoomID) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		err := h.Publish(rid, hub.QueueChanged, &hub.QueueChangedEvent{UserID: db.UserID("USER")})
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+}
+
+// dialHub starts a test server that registers connections with the hub, and
+// connects to it.
+func dialHub(t *testing.T, h *hub.Hub, rm *db.Room, u *db.User) *websocket.Conn {
+	t.Helper()
+
+	registered := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		h.Register(ws, rm, u, 0)
+		close(registered)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	<-registered
+
+	return ws
+}
+
+// readMessage returns the next message that isn't about presence.
+func readMessage(t *testing.T, ws *websocket.Conn) *hub.Message {
+	t.Helper()
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg hub.Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("ReadJSON: %v", err)
+		}
+		if msg.Type != hub.PresenceJoined && msg.Type != hub.PresenceLeft {
+			return &msg
+		}
+	}
+}
+
+// waitForClients waits until the server has n clients.
+func waitForClients(t *testing.T, s *Server, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		got := len(s.clients)
+		s.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server has %d clients, want %d", got, n)
+		}
+	}
+}
+
+func dial(t *testing.T, path string) *Client {
+	t.Helper()
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func subscribe(t *testing.T, c *Client) <-chan *hub.Event {
+	t.Helper()
+
+	events, err := c.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	return events
+}
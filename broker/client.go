@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bcspragu/Radiotation/hub"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// Client is a hub.Broker backed by a connection to a Server. If the connection
+// is lost, the Client reconnects on its own. Events sent while it's
+// disconnected are lost, which Hubs notice as a gap in a room's sequence
+// numbers, and have the room's clients resync. The same goes for a Server that
+// restarted, and started its sequence numbers over.
+type Client struct {
+	path string
+
+	mu sync.Mutex
+	// conn and enc are nil while we're reconnecting.
+	conn       net.Conn
+	enc        *json.Encoder
+	subscribed bool
+	closed     bool
+
+	events chan *hub.Event
+	// Closed when the Client is, to stop reconnecting.
+	done chan struct{}
+}
+
+// Dial connects to the Server listening on the Unix socket at the given path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to broker: %v", err)
+	}
+
+	c := &Client{
+		path:   path,
+		conn:   conn,
+		enc:    json.NewEncoder(conn),
+		events: make(chan *hub.Event, 256),
+		done:   make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Client) readLoop() {
+	defer close(c.events)
+
+	for {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+
+		dec := json.NewDecoder(conn)
+		for {
+			var ev hub.Event
+			if err := dec.Decode(&ev); err != nil {
+				break
+			}
+			select {
+			case c.events <- &ev:
+			case <-c.done:
+				return
+			}
+		}
+
+		if !c.reconnect(conn) {
+			return
+		}
+	}
+}
+
+// reconnect replaces a lost connection to the Server, backing off between
+// attempts. The Server sends every event to every connection, so there's
+// nothing else to do to resubscribe. It returns false if the Client was closed
+// first.
+func (c *Client) reconnect(lost net.Conn) bool {
+	c.mu.Lock()
+	lost.Close()
+	c.conn, c.enc = nil, nil
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return false
+	}
+
+	log.Print("Lost connection to broker, reconnecting")
+	backoff := minBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return false
+		}
+
+		conn, err := net.Dial("unix", c.path)
+		if err != nil {
+			log.Printf("Failed to reconnect to broker, retrying in %s: %v", backoff, err)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.closed {
+			conn.Close()
+			return false
+		}
+		c.conn, c.enc = conn, json.NewEncoder(conn)
+		log.Print("Reconnected to broker")
+		return true
+	}
+}
+
+func (c *Client) Publish(ev *hub.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.enc == nil {
+		return errors.New("not connected to broker")
+	}
+	if err := c.enc.Encode(ev); err != nil {
+		// Make sure the read loop notices, so it can reconnect.
+		c.conn.Close()
+		return fmt.Errorf("failed to send event to broker: %v", err)
+	}
+	return nil
+}
+
+// Subscribe returns the events sent by the Server. A Client only has one
+// subscription, so it can only be called once. The subscription carries on
+// across reconnects, and the channel is only closed when the Client is.
+func (c *Client) Subscribe() (<-chan *hub.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.subscribed {
+		return nil, errors.New("already subscribed to broker")
+	}
+	c.subscribed = true
+	return c.events, nil
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
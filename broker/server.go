@@ -0,0 +1,117 @@
+// Package broker implements a hub.Broker that runs in its own process, so
+// that several servers on the same machine can serve the same rooms. Servers
+// connect to it over a Unix socket, and events are sent back and forth as
+// newline-delimited JSON.
+package broker
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/hub"
+)
+
+// Server stamps and relays events between every client connected to it.
+type Server struct {
+	mu      sync.Mutex
+	seqs    map[db.RoomID]uint64
+	clients map[*client]bool
+}
+
+// client is a connection to the Server from a single Client.
+type client struct {
+	conn net.Conn
+	// Buffered channel of outbound events.
+	send chan *hub.Event
+}
+
+// NewServer returns a Server with no clients.
+func NewServer() *Server {
+	return &Server{
+		seqs:    make(map[db.RoomID]uint64),
+		clients: make(map[*client]bool),
+	}
+}
+
+// Serve accepts connections from the listener until it's closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		c := &client{conn: conn, send: make(chan *hub.Event, 256)}
+		s.mu.Lock()
+		s.clients[c] = true
+		s.mu.Unlock()
+
+		go s.writeLoop(c)
+		go s.readLoop(c)
+	}
+}
+
+// readLoop publishes every event the client sends.
+func (s *Server) readLoop(c *client) {
+	defer s.remove(c)
+
+	dec := json.NewDecoder(c.conn)
+	for {
+		var ev hub.Event
+		if err := dec.Decode(&ev); err != nil {
+			return
+		}
+		s.publish(&ev)
+	}
+}
+
+// writeLoop sends events to the client.
+func (s *Server) writeLoop(c *client) {
+	enc := json.NewEncoder(c.conn)
+	for ev := range c.send {
+		if err := enc.Encode(ev); err != nil {
+			s.remove(c)
+			return
+		}
+	}
+}
+
+func (s *Server) publish(ev *hub.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ev.UserID == "" {
+		s.seqs[ev.RoomID]++
+		ev.Seq = s.seqs[ev.RoomID]
+	}
+
+	for c := range s.clients {
+		select {
+		case c.send <- ev:
+		default:
+			// A client that can't keep up would hold up everyone else, so we
+			// drop it. It'll reconnect, and its Hub will have the rooms that
+			// missed events resync.
+			log.Printf("Dropping broker client %s, it isn't keeping up", c.conn.RemoteAddr())
+			s.removeLocked(c)
+		}
+	}
+}
+
+func (s *Server) remove(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(c)
+}
+
+func (s *Server) removeLocked(c *client) {
+	if !s.clients[c] {
+		return
+	}
+	delete(s.clients, c)
+	close(c.send)
+	c.conn.Close()
+}
@@ -0,0 +1,44 @@
+package main // import github.com/bcspragu/Radiotation/cmd/broker
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bcspragu/Radiotation/broker"
+	"github.com/namsral/flag"
+)
+
+var (
+	socket = flag.String("socket", "/tmp/radiotation-broker.sock", "The Unix socket to listen for servers on.")
+)
+
+func main() {
+	flag.Parse()
+
+	// Clean up after a previous broker that didn't exit cleanly.
+	if err := os.Remove(*socket); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Failed to remove old socket: %v", err)
+	}
+
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *socket, err)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		// Closing the listener removes the socket file.
+		l.Close()
+		os.Exit(1)
+	}()
+
+	log.Printf("Listening on %s", *socket)
+	if err := broker.NewServer().Serve(l); err != nil {
+		log.Fatalf("Serve: %v", err)
+	}
+}
@@ -8,6 +8,9 @@ import (
 
 	"github.com/pressly/goose"
 
+	// Register the migrations that are written in Go.
+	_ "github.com/bcspragu/Radiotation/sqldb/migrations"
+
 	// Init DB drivers.
 	_ "github.com/mattn/go-sqlite3"
 )
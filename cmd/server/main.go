@@ -2,15 +2,22 @@ package main // import github.com/bcspragu/Radiotation/cmd/server
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	firebase "firebase.google.com/go"
+	"github.com/bcspragu/Radiotation/broker"
+	"github.com/bcspragu/Radiotation/hub"
+	"github.com/bcspragu/Radiotation/library"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/bcspragu/Radiotation/radio/radiotest"
 	"github.com/bcspragu/Radiotation/spotify"
 	"github.com/bcspragu/Radiotation/sqldb"
 	"github.com/bcspragu/Radiotation/srv"
@@ -19,22 +26,41 @@ import (
 )
 
 var (
-	addr          = flag.String("addr", ":8000", "HTTP service address")
-	clientID      = flag.String("client_id", "", "The Google ClientID to use")
-	fcmKey        = flag.String("fcm_key", "", "The Firebase Cloud Messaging Key to use")
-	spotifyClient = flag.String("spotify_client_id", "", "The client ID of the Spotify application")
-	spotifySecret = flag.String("spotify_secret", "", "The secret of the Spotify application")
-	projectID     = flag.String("project_id", "", "The Firebase/GCP project ID to authenticate with.")
-	creds         = flag.String("service_account_creds", "", "The location of the JSON-formatted service account credentials.")
-	dbPath        = flag.String("db_path", "", "The location to store/load the SQLite database.")
+	addr           = flag.String("addr", ":8000", "HTTP service address")
+	clientID       = flag.String("client_id", "", "The Google ClientID to use")
+	fcmKey         = flag.String("fcm_key", "", "The Firebase Cloud Messaging Key to use")
+	spotifyClient  = flag.String("spotify_client_id", "", "The client ID of the Spotify application")
+	spotifySecret  = flag.String("spotify_secret", "", "The secret of the Spotify application")
+	spotifyTimeout = flag.Duration("spotify_timeout", spotify.DefaultTimeout, "How long requests to the Spotify API can take.")
+	cacheSize      = flag.Int("cache_size", 1000, "How many Spotify tracks, and separately how many searches, to cache.")
+	projectID      = flag.String("project_id", "", "The Firebase/GCP project ID to authenticate with.")
+	creds          = flag.String("service_account_creds", "", "The location of the JSON-formatted service account credentials.")
+	dbPath         = flag.String("db_path", "", "The location to store/load the SQLite database.")
+	debugPop       = flag.Bool("debug_pop", false, "If true, allow advancing a room with an unauthenticated GET request.")
+	brokerSocket   = flag.String("broker_socket", "", "The Unix socket of a broker to share rooms with other servers through. If blank, rooms aren't shared.")
+	metricsAddr    = flag.String("metrics_addr", "", "If set, the address to serve per-room hub metrics on. It shouldn't be publicly reachable.")
+	sendBuffer     = flag.Int("send_buffer", 256, "How many messages can be waiting to go out to a single client before it's disconnected.")
+	replaySize     = flag.Int("replay_size", 256, "How many recent messages to keep in each room for clients that reconnect.")
+	idleTimeout    = flag.Duration("room_idle_timeout", 10*time.Minute, "How long a room with nobody connected keeps its recent messages and metrics.")
+	libraryDir     = flag.String("library_dir", "", "If set, a directory of MP3, FLAC and Ogg files to play. Spotify is searched too, if --spotify_client_id is set.")
+	dev            = flag.Bool("dev", false, "If true, serve tracks from --dev_fixture instead of Spotify, for development without credentials.")
+	devFixture     = flag.String("dev_fixture", "radio/radiotest/testdata/tracks.yaml", "The JSON or YAML file of tracks to serve in --dev mode.")
+	devLatency     = flag.Duration("dev_latency", 0, "How long searches and track lookups take in --dev mode, to simulate a slow connection.")
+	origins        = flag.String("allowed_origins", "", "A comma-separated list of origins, like https://example.com, that browsers can open WebSockets from.")
 )
 
 func main() {
 	rand.Seed(time.Now().Unix())
 	flag.Parse()
 
-	if *clientID == "" || *spotifyClient == "" || *spotifySecret == "" {
-		log.Fatalf("Missing a required flag, all of  --client_id, --spotify_client_id, and --spotify_secret are required.")
+	if *clientID == "" {
+		log.Fatalf("Missing required flag --client_id.")
+	}
+	if *dev && *libraryDir != "" {
+		log.Fatalf("Only one of --dev and --library_dir can be set.")
+	}
+	if !*dev && *libraryDir == "" && (*spotifyClient == "" || *spotifySecret == "") {
+		log.Fatalf("Missing a required flag, both --spotify_client_id and --spotify_secret are required unless --dev or --library_dir is set.")
 	}
 
 	db, err := sqldb.New(*dbPath, sqldb.CryptoRandSource{})
@@ -55,27 +81,122 @@ func main() {
 		log.Fatalf("Failed to initialize Firebase Auth: %v", err)
 	}
 
-	s, err := srv.New(db, &srv.Config{
+	var b hub.Broker
+	if *brokerSocket != "" {
+		if b, err = broker.Dial(*brokerSocket); err != nil {
+			log.Fatalf("Failed to connect to broker: %v", err)
+		}
+	}
+
+	cfg := &srv.Config{
 		ClientID:   *clientID,
 		FCMKey:     *fcmKey,
 		AuthClient: auth,
+		DebugPop:   *debugPop,
 
-		SongServer: spotify.NewSongServer("spotify.com", *spotifyClient, *spotifySecret),
-	})
+		AllowedOrigins: allowedOrigins(*origins),
+		Broker:         b,
+		HubOptions: &hub.Options{
+			SendBuffer:  *sendBuffer,
+			ReplaySize:  *replaySize,
+			IdleTimeout: *idleTimeout,
+		},
+	}
+	var (
+		providers []radio.Provider
+		// Only Spotify is cached, since the other song servers are already local.
+		cache *radio.Cache
+		sp    spotify.SongServer
+	)
+	if *dev {
+		ss, err := radiotest.Load(*devFixture)
+		if err != nil {
+			log.Fatalf("Failed to load dev fixture: %v", err)
+		}
+		ss.SetLatency(*devLatency)
+		providers = append(providers, radio.Provider{Name: radiotest.Provider, SongServer: ss})
+	} else {
+		if *libraryDir != "" {
+			lib, err := library.New(*libraryDir, nil)
+			if err != nil {
+				log.Fatalf("Failed to load music library: %v", err)
+			}
+			cfg.Library = lib
+			providers = append(providers, radio.Provider{Name: library.Provider, SongServer: lib})
+		}
+		// With a library, Spotify is only used if there are credentials for it.
+		if *libraryDir == "" || *spotifyClient != "" {
+			sp = spotify.NewSongServer("spotify.com", *spotifyClient, *spotifySecret, &http.Client{Timeout: *spotifyTimeout})
+			cache = radio.NewCache(sp, &radio.CacheOptions{Size: *cacheSize})
+			providers = append(providers, radio.Provider{Name: spotify.Provider, SongServer: cache})
+		}
+	}
+	// Even with one provider, a Multi can look up the tracks that were stored
+	// while the server had more.
+	cfg.SongServer = radio.NewMulti(providers...)
+
+	s, err := srv.New(db, cfg)
 	if err != nil {
 		log.Fatalf("Failed to start DB: %v", err)
 	}
 
+	if *metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/", s.MetricsHandler())
+			mux.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+				var stats radio.CacheStats
+				if cache != nil {
+					stats = cache.Stats()
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(stats)
+			})
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	httpSrv := &http.Server{Addr: *addr, Handler: s}
+
+	done := make(chan struct{})
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
+		defer close(done)
 		<-c
-		db.Close()
-		os.Exit(1)
+
+		// Disconnect clients first, the HTTP server won't wait for WebSockets,
+		// and it'll wait forever for event streams.
+		s.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpSrv.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down cleanly: %v", err)
+		}
 	}()
 
-	err = http.ListenAndServe(*addr, s)
-	if err != nil {
+	if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+	<-done
+
+	if sp != nil {
+		sp.Close()
+	}
+	if b != nil {
+		b.Close()
+	}
+	db.Close()
+}
+
+func allowedOrigins(list string) []string {
+	var origins []string
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
 }
@@ -0,0 +1,27 @@
+package db
+
+import "time"
+
+// ChatMessage is a chat message or emoji reaction that a member sent while a
+// track was playing. It's stored with the track's history entry.
+type ChatMessage struct {
+	// ID is unique among the messages for a single history entry.
+	ID     string `json:"id"`
+	UserID UserID `json:"userID"`
+	// Text is the message itself, or the emoji for a reaction.
+	Text string `json:"text"`
+	// Reaction is true if the message is an emoji reaction, instead of chat.
+	Reaction bool      `json:"reaction"`
+	SentAt   time.Time `json:"sentAt"`
+}
+
+// Reactions returns the number of reactions to the entry.
+func (te *TrackEntry) Reactions() int {
+	n := 0
+	for _, m := range te.Messages {
+		if m.Reaction {
+			n++
+		}
+	}
+	return n
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"errors"
 	"math/rand"
+	"time"
 
 	"github.com/bcspragu/Radiotation/radio"
 )
@@ -12,7 +13,12 @@ var (
 	ErrUserNotFound            = errors.New("radiotation: user not found")
 	ErrRoomNotFound            = errors.New("radiotation: room not found")
 	ErrQueueNotFound           = errors.New("radiotation: queue not found")
+	ErrQueueTrackNotFound      = errors.New("radiotation: queue track not found")
 	ErrNoTracksInQueue         = errors.New("radiotation: no tracks in queue")
+	ErrRecapNotFound           = errors.New("radiotation: recap not found")
+	ErrPlaybackNotFound        = errors.New("radiotation: playback state not found")
+	ErrPlaybackChanged         = errors.New("radiotation: a different track is playing")
+	ErrMessageNotFound         = errors.New("radiotation: chat message not found")
 )
 
 type QueueID struct {
@@ -27,16 +33,42 @@ type TrackEntry struct {
 	// VetoedBy is only set if Vetoed is true.
 	Vetoed   bool
 	VetoedBy UserID
+
+	// UpvotedBy is the list of users that voted for the track, in the order
+	// they voted.
+	UpvotedBy []UserID
+
+	// PlayerID is the ID of the player device that advanced the room to this
+	// track.
+	PlayerID string
+	// PlayedAt is when the track started playing.
+	PlayedAt time.Time
+
+	// Replay is true if the track was replayed from earlier in the history,
+	// instead of being taken from a queue. ReplayOf is only set if Replay is
+	// true, and is the history index of the original entry.
+	Replay   bool
+	ReplayOf int
+
+	// Messages are the chat messages and reactions sent while the track was
+	// playing, in the order they were sent.
+	Messages []*ChatMessage
 }
 
 type RoomDB interface {
 	Room(RoomID) (*Room, error)
 	NextTrack(RoomID) (*User, *radio.Track, error)
+	// PeekTrack returns the user and track that the next call to NextTrack
+	// would return, without advancing the room.
+	PeekTrack(RoomID) (*User, *radio.Track, error)
 
 	SearchRooms(string) ([]*Room, error)
 
 	AddRoom(*Room) (RoomID, error)
 	AddUserToRoom(RoomID, UserID) error
+	// EndRoom marks a room as ended. Its history and queues are kept around,
+	// but no more tracks will be played in it.
+	EndRoom(RoomID) error
 }
 
 type UserDB interface {
@@ -67,14 +99,49 @@ type QueueTrack struct {
 
 type QueueDB interface {
 	Tracks(QueueID, *QueueOptions) ([]*QueueTrack, error)
+	// UserTracks returns every track a user has added to a queue, played or
+	// not, across all the rooms they've joined.
+	UserTracks(UserID) ([]*radio.Track, error)
 	AddTrack(QueueID, *radio.Track, string) error
 	RemoveTrack(QueueID, string) error
+	// MoveTrack moves the QueueTrack with the first ID to after the QueueTrack
+	// with the second ID, or to the front of the queue if the second ID is
+	// blank.
+	MoveTrack(QueueID, string, string) error
 }
 
 type HistoryDB interface {
 	History(RoomID) ([]*TrackEntry, error)
 	AddToHistory(RoomID, *TrackEntry) (int, error)
 	MarkVetoed(RoomID, UserID) error
+	// AddVote records a user's vote for the track that's currently playing,
+	// and returns the number of votes it has. Voting for the same track twice
+	// only counts once.
+	AddVote(RoomID, UserID) (int, error)
+	// AddMessage attaches a chat message or reaction to the track that's
+	// currently playing, and returns the track's history index. The message
+	// is given an ID.
+	AddMessage(RoomID, *ChatMessage) (int, error)
+	// DeleteMessage removes the message with the given ID from the track at
+	// the given history index.
+	DeleteMessage(rid RoomID, idx int, msgID string) error
+}
+
+// RecapDB stores the recap generated for a room when it ends. The recap is
+// stored as an opaque, already encoded blob.
+type RecapDB interface {
+	Recap(RoomID) ([]byte, error)
+	AddRecap(RoomID, []byte) error
+}
+
+// PlaybackDB stores where playback of each room's current track is.
+type PlaybackDB interface {
+	Playback(RoomID) (*PlaybackState, error)
+	SetPlayback(RoomID, *PlaybackState) error
+	// UpdatePlayback is like SetPlayback, but only if the track at the
+	// state's HistoryIndex is still the one playing. If it isn't, it returns
+	// ErrPlaybackChanged.
+	UpdatePlayback(RoomID, *PlaybackState) error
 }
 
 type DB interface {
@@ -82,6 +149,8 @@ type DB interface {
 	UserDB
 	QueueDB
 	HistoryDB
+	RecapDB
+	PlaybackDB
 }
 
 var trackLetters = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -95,6 +164,20 @@ func RandomTrackID(src rand.Source) string {
 	return string(b)
 }
 
+// RandomMessageID returns an ID for a chat message that isn't used by any of
+// the existing messages.
+func RandomMessageID(src rand.Source, msgs []*ChatMessage) string {
+	used := make(map[string]bool)
+	for _, m := range msgs {
+		used[m.ID] = true
+	}
+	for {
+		if id := RandomID(src); !used[id] {
+			return id
+		}
+	}
+}
+
 var letters = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func RandomID(src rand.Source) string {
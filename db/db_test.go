@@ -1,6 +1,8 @@
 package db_test
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -8,12 +10,14 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bcspragu/Radiotation/db"
 	"github.com/bcspragu/Radiotation/memdb"
 	"github.com/bcspragu/Radiotation/radio"
 	"github.com/bcspragu/Radiotation/rng"
 	"github.com/bcspragu/Radiotation/sqldb"
+	_ "github.com/bcspragu/Radiotation/sqldb/migrations"
 	"github.com/google/go-cmp/cmp"
 	"github.com/pressly/goose"
 
@@ -49,7 +53,7 @@ func testAddRoom(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
 	sdb, closeFn := newDB(t)
 	defer closeFn()
 
-	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin, OwnerID: db.UserID("owner"), Providers: []string{"library", "spotify"}})
 	if err != nil {
 		t.Errorf("AddRoom(): %v", err)
 	}
@@ -70,6 +74,14 @@ func testAddRoom(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
 	if r.RotatorType != db.RoundRobin {
 		t.Errorf("RotatorType = %q, want \"Random\"", r.RotatorType)
 	}
+
+	if r.OwnerID != db.UserID("owner") {
+		t.Errorf("OwnerID = %q, want \"owner\"", r.OwnerID)
+	}
+
+	if diff := cmp.Diff([]string{"library", "spotify"}, r.Providers); diff != "" {
+		t.Errorf("Providers (-want +got):\n%s", diff)
+	}
 }
 
 func TestSearchRooms(t *testing.T) {
@@ -791,6 +803,217 @@ func testRemoveTrack(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
 	trackCount(t, ts, 0)
 }
 
+func TestMoveTrack(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testMoveTrack(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testMoveTrack(t, newMemDB) })
+}
+
+func TestOtherUsersQueueTrack(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testOtherUsersQueueTrack(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testOtherUsersQueueTrack(t, newMemDB) })
+}
+
+func testOtherUsersQueueTrack(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	// Each user gets two tracks in their queue.
+	queues := make(map[db.UserID][]*db.QueueTrack)
+	for _, uID := range []db.UserID{"alice", "mallory"} {
+		if err := sdb.AddUser(&db.User{ID: uID, First: string(uID)}); err != nil {
+			t.Fatalf("AddUser(): %v", err)
+		}
+		if err := sdb.AddUserToRoom(rID, uID); err != nil {
+			t.Fatalf("AddUserToRoom(): %v", err)
+		}
+		qID := db.QueueID{RoomID: rID, UserID: uID}
+		afterID := ""
+		for i := 0; i < 2; i++ {
+			track := &radio.Track{
+				ID:      fmt.Sprintf("%s%d", uID, i),
+				Name:    fmt.Sprintf("Test Track %d", i),
+				Artists: []radio.Artist{{Name: "Test Artist"}},
+			}
+			if err := sdb.AddTrack(qID, track, afterID); err != nil {
+				t.Fatalf("AddTrack(): %v", err)
+			}
+			ts, err := sdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+			if err != nil {
+				t.Fatalf("Tracks(): %v", err)
+			}
+			afterID = ts[len(ts)-1].ID
+		}
+		ts, err := sdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+		if err != nil {
+			t.Fatalf("Tracks(): %v", err)
+		}
+		queues[uID] = ts
+	}
+
+	// Mallory tries to splice Alice's tracks into her own queue, and to link
+	// her own tracks after Alice's.
+	mallory := db.QueueID{RoomID: rID, UserID: "mallory"}
+	alices, mallorys := queues["alice"], queues["mallory"]
+	if err := sdb.MoveTrack(mallory, alices[1].ID, ""); err != db.ErrQueueTrackNotFound {
+		t.Errorf("MoveTrack() of another user's track = %v, want %v", err, db.ErrQueueTrackNotFound)
+	}
+	if err := sdb.MoveTrack(mallory, mallorys[1].ID, alices[0].ID); err != db.ErrQueueTrackNotFound {
+		t.Errorf("MoveTrack() after another user's track = %v, want %v", err, db.ErrQueueTrackNotFound)
+	}
+	if err := sdb.RemoveTrack(mallory, alices[0].ID); err != db.ErrQueueTrackNotFound {
+		t.Errorf("RemoveTrack() of another user's track = %v, want %v", err, db.ErrQueueTrackNotFound)
+	}
+	if err := sdb.AddTrack(mallory, &radio.Track{ID: "mallory2", Name: "Sneaky"}, alices[0].ID); err != db.ErrQueueTrackNotFound {
+		t.Errorf("AddTrack() after another user's track = %v, want %v", err, db.ErrQueueTrackNotFound)
+	}
+
+	// Both queues are untouched.
+	for uID, want := range queues {
+		ts, err := sdb.Tracks(db.QueueID{RoomID: rID, UserID: uID}, &db.QueueOptions{Type: db.AllTracks})
+		if err != nil {
+			t.Fatalf("Tracks(): %v", err)
+		}
+		trackCount(t, ts, len(want))
+		for i := range want {
+			if ts[i].ID != want[i].ID {
+				t.Errorf("%s's queue[%d] = %q, want %q", uID, i, ts[i].ID, want[i].ID)
+			}
+		}
+	}
+}
+
+func testMoveTrack(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	user := &db.User{
+		ID:    db.UserID("testid"),
+		First: "Test",
+		Last:  "Name",
+	}
+	if err := sdb.AddUser(user); err != nil {
+		t.Fatalf("AddUser(): %v", err)
+	}
+
+	if err := sdb.AddUserToRoom(rID, user.ID); err != nil {
+		t.Fatalf("AddUserToRoom(): %v", err)
+	}
+
+	qID := db.QueueID{RoomID: rID, UserID: user.ID}
+
+	var tracks []*radio.Track
+	for i := 0; i < 4; i++ {
+		tracks = append(tracks, &radio.Track{
+			ID:      fmt.Sprintf("testID%d", i),
+			Name:    fmt.Sprintf("Test Track %d", i),
+			Artists: []radio.Artist{radio.Artist{Name: fmt.Sprintf("Test Artist %d", i)}},
+		})
+	}
+
+	// Add the tracks in order.
+	afterID := ""
+	for _, track := range tracks {
+		if err := sdb.AddTrack(qID, track, afterID); err != nil {
+			t.Fatalf("AddTrack(): %v", err)
+		}
+		ts, err := sdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+		if err != nil {
+			t.Fatalf("Tracks(): %v", err)
+		}
+		afterID = ts[len(ts)-1].ID
+	}
+
+	ts, err := sdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+	if err != nil {
+		t.Fatalf("Tracks(): %v", err)
+	}
+
+	// Move the last track to the front: 3, 0, 1, 2
+	if err := sdb.MoveTrack(qID, ts[3].ID, ""); err != nil {
+		t.Fatalf("MoveTrack(): %v", err)
+	}
+
+	ts, err = sdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+	if err != nil {
+		t.Fatalf("Tracks(): %v", err)
+	}
+
+	trackCount(t, ts, 4)
+	trackEquals(t, ts[0].Track, tracks[3])
+	trackEquals(t, ts[1].Track, tracks[0])
+	trackEquals(t, ts[2].Track, tracks[1])
+	trackEquals(t, ts[3].Track, tracks[2])
+
+	// Move the first track to after the third: 0, 1, 3, 2
+	if err := sdb.MoveTrack(qID, ts[0].ID, ts[2].ID); err != nil {
+		t.Fatalf("MoveTrack(): %v", err)
+	}
+
+	ts, err = sdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+	if err != nil {
+		t.Fatalf("Tracks(): %v", err)
+	}
+
+	trackCount(t, ts, 4)
+	trackEquals(t, ts[0].Track, tracks[0])
+	trackEquals(t, ts[1].Track, tracks[1])
+	trackEquals(t, ts[2].Track, tracks[3])
+	trackEquals(t, ts[3].Track, tracks[2])
+
+	// Play the first track, then the track that was moved up front should be
+	// the next one played.
+	if _, track, err := sdb.NextTrack(rID); err != nil {
+		t.Fatalf("NextTrack(): %v", err)
+	} else {
+		trackEquals(t, track, tracks[0])
+	}
+
+	// Tracks can't be moved in front of played tracks, and played tracks can't
+	// be moved.
+	if err := sdb.MoveTrack(qID, ts[3].ID, ""); err == nil {
+		t.Error("MoveTrack() in front of a played track succeeded")
+	}
+	if err := sdb.MoveTrack(qID, ts[0].ID, ts[3].ID); err == nil {
+		t.Error("MoveTrack() of a played track succeeded")
+	}
+
+	// Move the last track to right after the played one: 0, 2, 1, 3
+	if err := sdb.MoveTrack(qID, ts[3].ID, ts[0].ID); err != nil {
+		t.Fatalf("MoveTrack(): %v", err)
+	}
+
+	if _, track, err := sdb.NextTrack(rID); err != nil {
+		t.Fatalf("NextTrack(): %v", err)
+	} else {
+		trackEquals(t, track, tracks[2])
+	}
+
+	ts, err = sdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+	if err != nil {
+		t.Fatalf("Tracks(): %v", err)
+	}
+
+	trackCount(t, ts, 4)
+	trackEquals(t, ts[0].Track, tracks[0])
+	trackEquals(t, ts[1].Track, tracks[2])
+	trackEquals(t, ts[2].Track, tracks[1])
+	trackEquals(t, ts[3].Track, tracks[3])
+	trackPlayed(t, ts[0])
+	trackPlayed(t, ts[1])
+	trackNotPlayed(t, ts[2])
+	trackNotPlayed(t, ts[3])
+}
+
 func TestHistory(t *testing.T) {
 	t.Run("SQLite", func(t *testing.T) { testHistory(t, newSQLDB) })
 	t.Run("MemDB", func(t *testing.T) { testHistory(t, newMemDB) })
@@ -874,6 +1097,279 @@ func testHistory(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
 	trackEntryEquals(t, tes[2], tracks[2])
 }
 
+func TestUserTracks(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testUserTracks(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testUserTracks(t, newMemDB) })
+}
+
+func testUserTracks(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	uID, otherID := db.UserID("testid"), db.UserID("otherid")
+	for _, u := range []*db.User{{ID: uID, First: "Test", Last: "Name"}, {ID: otherID, First: "Other", Last: "Name"}} {
+		if err := sdb.AddUser(u); err != nil {
+			t.Fatalf("AddUser(): %v", err)
+		}
+	}
+
+	ts, err := sdb.UserTracks(uID)
+	if err != nil {
+		t.Fatalf("UserTracks(): %v", err)
+	}
+	if len(ts) != 0 {
+		t.Fatalf("Got %d tracks, want 0", len(ts))
+	}
+
+	var want []string
+	for i := 0; i < 2; i++ {
+		rID, err := sdb.AddRoom(&db.Room{DisplayName: fmt.Sprintf("Test Room %d", i), RotatorType: db.RoundRobin})
+		if err != nil {
+			t.Fatalf("AddRoom(): %v", err)
+		}
+
+		for _, id := range []db.UserID{uID, otherID} {
+			if err := sdb.AddUserToRoom(rID, id); err != nil {
+				t.Fatalf("AddUserToRoom(): %v", err)
+			}
+		}
+
+		for j := 0; j < 2; j++ {
+			track := &radio.Track{ID: fmt.Sprintf("room%dtrack%d", i, j)}
+			if err := sdb.AddTrack(db.QueueID{RoomID: rID, UserID: uID}, track, ""); err != nil {
+				t.Fatalf("AddTrack(): %v", err)
+			}
+			want = append(want, track.ID)
+		}
+
+		// Tracks from other users shouldn't show up.
+		other := &radio.Track{ID: fmt.Sprintf("room%dother", i)}
+		if err := sdb.AddTrack(db.QueueID{RoomID: rID, UserID: otherID}, other, ""); err != nil {
+			t.Fatalf("AddTrack(): %v", err)
+		}
+
+		// Played tracks should show up too.
+		if _, _, err := sdb.NextTrack(rID); err != nil {
+			t.Fatalf("NextTrack(): %v", err)
+		}
+	}
+
+	ts, err = sdb.UserTracks(uID)
+	if err != nil {
+		t.Fatalf("UserTracks(): %v", err)
+	}
+
+	var got []string
+	for _, t := range ts {
+		got = append(got, t.ID)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("UserTracks() (-want +got)\n%s", diff)
+	}
+}
+
+func TestAddVote(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testAddVote(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testAddVote(t, newMemDB) })
+}
+
+func testAddVote(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	if _, err := sdb.AddVote(rID, db.UserID("user1")); err == nil {
+		t.Error("AddVote() with no history succeeded")
+	}
+
+	for i := 0; i < 2; i++ {
+		te := &db.TrackEntry{UserID: db.UserID("user1"), Track: &radio.Track{ID: fmt.Sprintf("testID%d", i)}}
+		if _, err := sdb.AddToHistory(rID, te); err != nil {
+			t.Fatalf("AddToHistory(): %v", err)
+		}
+	}
+
+	votes := []struct {
+		uID  db.UserID
+		want int
+	}{
+		{db.UserID("user1"), 1},
+		{db.UserID("user2"), 2},
+		// Voting twice doesn't count.
+		{db.UserID("user1"), 2},
+	}
+	for _, v := range votes {
+		n, err := sdb.AddVote(rID, v.uID)
+		if err != nil {
+			t.Fatalf("AddVote(): %v", err)
+		}
+		if n != v.want {
+			t.Errorf("AddVote(%q) = %d, want %d", v.uID, n, v.want)
+		}
+	}
+
+	tes, err := sdb.History(rID)
+	if err != nil {
+		t.Fatalf("History(): %v", err)
+	}
+
+	if len(tes[0].UpvotedBy) != 0 {
+		t.Errorf("first track has votes %v, want none", tes[0].UpvotedBy)
+	}
+	if diff := cmp.Diff([]db.UserID{"user1", "user2"}, tes[1].UpvotedBy); diff != "" {
+		t.Errorf("UpvotedBy (-want +got)\n%s", diff)
+	}
+}
+
+func TestChatMessages(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testChatMessages(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testChatMessages(t, newMemDB) })
+}
+
+func testChatMessages(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	sent := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := sdb.AddMessage(rID, &db.ChatMessage{UserID: db.UserID("user1"), Text: "hi", SentAt: sent}); err == nil {
+		t.Error("AddMessage() with no history succeeded")
+	}
+
+	for i := 0; i < 2; i++ {
+		te := &db.TrackEntry{UserID: db.UserID("user1"), Track: &radio.Track{ID: fmt.Sprintf("testID%d", i)}}
+		if _, err := sdb.AddToHistory(rID, te); err != nil {
+			t.Fatalf("AddToHistory(): %v", err)
+		}
+	}
+
+	msgs := []*db.ChatMessage{
+		{UserID: db.UserID("user1"), Text: "great song", SentAt: sent},
+		{UserID: db.UserID("user2"), Text: "🔥", Reaction: true, SentAt: sent.Add(time.Second)},
+		{UserID: db.UserID("user2"), Text: "agreed", SentAt: sent.Add(2 * time.Second)},
+	}
+	for _, msg := range msgs {
+		idx, err := sdb.AddMessage(rID, msg)
+		if err != nil {
+			t.Fatalf("AddMessage(): %v", err)
+		}
+		if idx != 1 {
+			t.Errorf("AddMessage() = %d, want 1", idx)
+		}
+		if msg.ID == "" {
+			t.Error("AddMessage() didn't assign an ID")
+		}
+	}
+
+	if err := sdb.DeleteMessage(rID, 1, msgs[0].ID); err != nil {
+		t.Fatalf("DeleteMessage(): %v", err)
+	}
+	if err := sdb.DeleteMessage(rID, 1, msgs[0].ID); err != db.ErrMessageNotFound {
+		t.Errorf("DeleteMessage() twice = %v, want %v", err, db.ErrMessageNotFound)
+	}
+	if err := sdb.DeleteMessage(rID, 0, msgs[1].ID); err != db.ErrMessageNotFound {
+		t.Errorf("DeleteMessage() from the wrong entry = %v, want %v", err, db.ErrMessageNotFound)
+	}
+
+	tes, err := sdb.History(rID)
+	if err != nil {
+		t.Fatalf("History(): %v", err)
+	}
+
+	if len(tes[0].Messages) != 0 {
+		t.Errorf("first track has messages %v, want none", tes[0].Messages)
+	}
+	if diff := cmp.Diff(msgs[1:], tes[1].Messages); diff != "" {
+		t.Errorf("Messages (-want +got)\n%s", diff)
+	}
+	if n := tes[1].Reactions(); n != 1 {
+		t.Errorf("Reactions() = %d, want 1", n)
+	}
+}
+
+func TestEndRoom(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testEndRoom(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testEndRoom(t, newMemDB) })
+}
+
+func testEndRoom(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	r, err := sdb.Room(rID)
+	if err != nil {
+		t.Fatalf("Room(): %v", err)
+	}
+	if r.Ended {
+		t.Error("new room has already ended")
+	}
+
+	if err := sdb.EndRoom(rID); err != nil {
+		t.Fatalf("EndRoom(): %v", err)
+	}
+
+	r, err = sdb.Room(rID)
+	if err != nil {
+		t.Fatalf("Room(): %v", err)
+	}
+	if !r.Ended {
+		t.Error("room hasn't ended after EndRoom()")
+	}
+
+	if err := sdb.EndRoom(db.RoomID("NOTA")); err != db.ErrRoomNotFound {
+		t.Errorf("EndRoom(\"NOTA\"): %v, want %v", err, db.ErrRoomNotFound)
+	}
+}
+
+func TestRecap(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testRecap(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testRecap(t, newMemDB) })
+}
+
+func testRecap(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	if _, err := sdb.Recap(rID); err != db.ErrRecapNotFound {
+		t.Errorf("Recap(): %v, want %v", err, db.ErrRecapNotFound)
+	}
+
+	want := []byte(`{"roomName":"Test Room"}`)
+	if err := sdb.AddRecap(rID, want); err != nil {
+		t.Fatalf("AddRecap(): %v", err)
+	}
+
+	got, err := sdb.Recap(rID)
+	if err != nil {
+		t.Fatalf("Recap(): %v", err)
+	}
+
+	if diff := cmp.Diff(string(want), string(got)); diff != "" {
+		t.Errorf("Recap() (-want +got)\n%s", diff)
+	}
+}
+
 type closeFn func()
 
 func trackEntryCount(t *testing.T, ts []*db.TrackEntry, want int) {
@@ -932,6 +1428,179 @@ func userEquals(t *testing.T, gotUser, wantUser *db.User) {
 	}
 }
 
+// legacyTrack and the types it uses are how tracks looked before they had a
+// provider, or any of the metadata that came with it. Gob matches fields by
+// name, so encoding these gives us the blobs an older server would have
+// written.
+type legacyTrack struct {
+	Artists    []legacyArtist
+	Name       string
+	ID         string
+	Album      legacyAlbum
+	DurationMS int
+}
+
+type legacyAlbum struct {
+	Name   string
+	Images []legacyImage
+}
+
+type legacyArtist struct {
+	Name string
+}
+
+type legacyImage struct {
+	Width  int
+	Height int
+	URL    string
+}
+
+type legacyTrackEntry struct {
+	UserID    db.UserID
+	Track     *legacyTrack
+	Vetoed    bool
+	VetoedBy  db.UserID
+	UpvotedBy []db.UserID
+	PlayerID  string
+	PlayedAt  time.Time
+	Replay    bool
+	ReplayOf  int
+	Messages  []*db.ChatMessage
+}
+
+func TestTrackProviderMigration(t *testing.T) {
+	sdb, closeFn := newSQLDBAt(t, 4)
+	defer closeFn()
+
+	// The Rooms table has changed since, so the room goes in the way an older
+	// server would have added it.
+	rID := db.RoomID("ROOM")
+	var rot db.Rotator = db.NewRotator(db.RoundRobin)
+	if _, err := sdb.DB.Exec(`INSERT INTO Rooms (id, display_name, normalized_name, rotator, rotator_type) VALUES (?, ?, ?, ?, ?)`,
+		string(rID), "Test Room", "test room", encodeGob(t, &rot), db.RoundRobin); err != nil {
+		t.Fatalf("failed to store legacy room: %v", err)
+	}
+	if _, err := sdb.DB.Exec(`INSERT INTO History (room_id, track_entries) VALUES (?, ?)`, string(rID), encodeGob(t, []*db.TrackEntry{})); err != nil {
+		t.Fatalf("failed to store legacy history: %v", err)
+	}
+	uID := db.UserID("test")
+	if err := sdb.AddUserToRoom(rID, uID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+
+	// Tracks from before they had a provider.
+	tracks := []*legacyTrack{
+		{
+			ID:         "4iV5W9uYEdYUVa79Axb7Rh",
+			Name:       "Spotify",
+			Artists:    []legacyArtist{{Name: "Artist"}},
+			Album:      legacyAlbum{Name: "Album", Images: []legacyImage{{Width: 64, Height: 64, URL: "https://example.com/64.jpg"}}},
+			DurationMS: 180000,
+		},
+		{ID: "0123456789abcdef0123456789abcdef", Name: "Library", DurationMS: 240000},
+		{ID: "dev-dreams", Name: "Unknown"},
+	}
+	playedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var entries []*legacyTrackEntry
+	for i, lt := range tracks {
+		// Get the rows in place through the DB, then swap in what an older
+		// server would have stored.
+		tr := &radio.Track{ID: lt.ID, Name: lt.Name}
+		if err := sdb.AddTrack(db.QueueID{RoomID: rID, UserID: uID}, tr, ""); err != nil {
+			t.Fatalf("AddTrack: %v", err)
+		}
+		if _, err := sdb.AddToHistory(rID, &db.TrackEntry{UserID: uID, Track: tr}); err != nil {
+			t.Fatalf("AddToHistory: %v", err)
+		}
+		if _, err := sdb.DB.Exec(`UPDATE Tracks SET track = ? WHERE id = ?`, encodeGob(t, lt), lt.ID); err != nil {
+			t.Fatalf("failed to store legacy track: %v", err)
+		}
+		entries = append(entries, &legacyTrackEntry{
+			UserID:    uID,
+			Track:     lt,
+			UpvotedBy: []db.UserID{"alice", "bob"},
+			PlayerID:  "player",
+			PlayedAt:  playedAt.Add(time.Duration(i) * time.Minute),
+			Messages: []*db.ChatMessage{
+				{ID: "1", UserID: "alice", Text: "nice", SentAt: playedAt},
+				{ID: "2", UserID: "bob", Text: "🔥", Reaction: true, SentAt: playedAt.Add(time.Second)},
+			},
+		})
+	}
+	// The second entry replays the first, and the last one was vetoed.
+	entries[1].Replay, entries[1].ReplayOf = true, 0
+	entries[2].Vetoed, entries[2].VetoedBy = true, "alice"
+	if _, err := sdb.DB.Exec(`UPDATE History SET track_entries = ? WHERE room_id = ?`, encodeGob(t, entries), rID); err != nil {
+		t.Fatalf("failed to store legacy history: %v", err)
+	}
+
+	if err := goose.Up(sdb.DB, migrationsDir); err != nil {
+		t.Fatalf("failed to apply migrations to db: %v", err)
+	}
+
+	// Everything comes back as it was stored, with the provider filled in
+	// where we can tell what it is.
+	providers := []string{"spotify", "library", ""}
+	var (
+		wantTracks  []*radio.Track
+		wantEntries []*db.TrackEntry
+	)
+	for i, lt := range tracks {
+		tr := &radio.Track{ID: lt.ID, Name: lt.Name, DurationMS: lt.DurationMS, Provider: providers[i]}
+		for _, a := range lt.Artists {
+			tr.Artists = append(tr.Artists, radio.Artist{Name: a.Name})
+		}
+		tr.Album.Name = lt.Album.Name
+		for _, img := range lt.Album.Images {
+			tr.Album.Images = append(tr.Album.Images, radio.Image{Width: img.Width, Height: img.Height, URL: img.URL})
+		}
+		wantTracks = append(wantTracks, tr)
+
+		le := entries[i]
+		wantEntries = append(wantEntries, &db.TrackEntry{
+			UserID:    le.UserID,
+			Track:     tr,
+			Vetoed:    le.Vetoed,
+			VetoedBy:  le.VetoedBy,
+			UpvotedBy: le.UpvotedBy,
+			PlayerID:  le.PlayerID,
+			PlayedAt:  le.PlayedAt,
+			Replay:    le.Replay,
+			ReplayOf:  le.ReplayOf,
+			Messages:  le.Messages,
+		})
+	}
+
+	queued, err := sdb.UserTracks(uID)
+	if err != nil {
+		t.Fatalf("UserTracks: %v", err)
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].ID < queued[j].ID })
+	sort.Slice(wantTracks, func(i, j int) bool { return wantTracks[i].ID < wantTracks[j].ID })
+	if diff := cmp.Diff(wantTracks, queued); diff != "" {
+		t.Errorf("queued tracks (-want +got)\n%s", diff)
+	}
+
+	history, err := sdb.History(rID)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if diff := cmp.Diff(wantEntries, history); diff != "" {
+		t.Errorf("history (-want +got)\n%s", diff)
+	}
+}
+
+// encodeGob encodes v the way sqldb stores blobs.
+func encodeGob(t *testing.T, v interface{}) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatalf("failed to encode %T: %v", v, err)
+	}
+	return buf.Bytes()
+}
+
 func newMemDB(t *testing.T) (db.DB, closeFn) {
 	db, err := memdb.New(rng.NewSource(0))
 	if err != nil {
@@ -942,6 +1611,13 @@ func newMemDB(t *testing.T) (db.DB, closeFn) {
 }
 
 func newSQLDB(t *testing.T) (db.DB, closeFn) {
+	sdb, closeFn := newSQLDBAt(t, 0)
+	return sdb, closeFn
+}
+
+// newSQLDBAt returns a SQLite database with the migrations applied up to the
+// given version, or all of them if it's zero.
+func newSQLDBAt(t *testing.T, version int64) (*sqldb.DB, closeFn) {
 	prefix := strings.Replace(t.Name(), "/", "", -1)
 	name, err := ioutil.TempDir("", prefix)
 	if err != nil {
@@ -955,7 +1631,12 @@ func newSQLDB(t *testing.T) (db.DB, closeFn) {
 
 	goose.SetLogger(&testLogger{t: t, log: false})
 	goose.SetDialect("sqlite3")
-	if err := goose.Up(sdb.DB, "../sqldb/migrations"); err != nil {
+	if version == 0 {
+		err = goose.Up(sdb.DB, migrationsDir)
+	} else {
+		err = goose.UpTo(sdb.DB, migrationsDir, version)
+	}
+	if err != nil {
 		t.Fatalf("failed to apply migrations to db: %v", err)
 	}
 
@@ -970,6 +1651,8 @@ func newSQLDB(t *testing.T) (db.DB, closeFn) {
 	}
 }
 
+const migrationsDir = "../sqldb/migrations"
+
 type testLogger struct {
 	t   *testing.T
 	log bool
@@ -1004,3 +1687,140 @@ func (t *testLogger) Printf(format string, v ...interface{}) {
 		t.t.Logf(format, v...)
 	}
 }
+
+func TestPeekTrack(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testPeekTrack(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testPeekTrack(t, newMemDB) })
+}
+
+func testPeekTrack(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	users := []*db.User{
+		&db.User{ID: db.UserID("testid1"), First: "Test", Last: "Name1"},
+		&db.User{ID: db.UserID("testid2"), First: "Test", Last: "Name2"},
+	}
+	for i, u := range users {
+		if err := sdb.AddUser(u); err != nil {
+			t.Fatalf("AddUser(): %v", err)
+		}
+		if err := sdb.AddUserToRoom(rID, u.ID); err != nil {
+			t.Fatalf("AddUserToRoom(): %v", err)
+		}
+		track := &radio.Track{ID: fmt.Sprintf("testID%d", i)}
+		if err := sdb.AddTrack(db.QueueID{RoomID: rID, UserID: u.ID}, track, ""); err != nil {
+			t.Fatalf("AddTrack(): %v", err)
+		}
+	}
+
+	for i := 0; i < len(users); i++ {
+		// Peeking twice should return the same thing both times, and match what
+		// we get when we actually advance the room.
+		peekUser, peekTrack, err := sdb.PeekTrack(rID)
+		if err != nil {
+			t.Fatalf("PeekTrack(): %v", err)
+		}
+		againUser, againTrack, err := sdb.PeekTrack(rID)
+		if err != nil {
+			t.Fatalf("PeekTrack(): %v", err)
+		}
+		userEquals(t, againUser, peekUser)
+		trackEquals(t, againTrack, peekTrack)
+
+		gotUser, gotTrack, err := sdb.NextTrack(rID)
+		if err != nil {
+			t.Fatalf("NextTrack(): %v", err)
+		}
+		userEquals(t, gotUser, peekUser)
+		trackEquals(t, gotTrack, peekTrack)
+	}
+
+	if _, _, err := sdb.PeekTrack(rID); err != db.ErrNoTracksInQueue {
+		t.Errorf("PeekTrack() got %v, want %v", err, db.ErrNoTracksInQueue)
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	t.Run("SQLite", func(t *testing.T) { testPlayback(t, newSQLDB) })
+	t.Run("MemDB", func(t *testing.T) { testPlayback(t, newMemDB) })
+}
+
+func testPlayback(t *testing.T, newDB func(*testing.T) (db.DB, closeFn)) {
+	sdb, closeFn := newDB(t)
+	defer closeFn()
+
+	rID, err := sdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom(): %v", err)
+	}
+
+	if _, err := sdb.Playback(rID); err != db.ErrPlaybackNotFound {
+		t.Errorf("Playback() = %v, want %v", err, db.ErrPlaybackNotFound)
+	}
+
+	updated := time.Date(2019, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	for _, want := range []*db.PlaybackState{
+		{HistoryIndex: 0, PositionMS: 0, UpdatedAt: updated},
+		{HistoryIndex: 0, Paused: true, PositionMS: 42000, UpdatedAt: updated.Add(42 * time.Second)},
+	} {
+		if err := sdb.SetPlayback(rID, want); err != nil {
+			t.Fatalf("SetPlayback(): %v", err)
+		}
+
+		got, err := sdb.Playback(rID)
+		if err != nil {
+			t.Fatalf("Playback(): %v", err)
+		}
+		if !got.UpdatedAt.Equal(want.UpdatedAt) {
+			t.Errorf("UpdatedAt = %v, want %v", got.UpdatedAt, want.UpdatedAt)
+		}
+		got.UpdatedAt = want.UpdatedAt
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Playback() (-want +got):\n%s", diff)
+		}
+	}
+
+	// Updates only apply to the track that's playing.
+	paused := &db.PlaybackState{HistoryIndex: 0, Paused: true, PositionMS: 50000, UpdatedAt: updated.Add(50 * time.Second)}
+	if err := sdb.UpdatePlayback(rID, paused); err != nil {
+		t.Fatalf("UpdatePlayback(): %v", err)
+	}
+	next := &db.PlaybackState{HistoryIndex: 1, UpdatedAt: updated.Add(time.Minute)}
+	if err := sdb.SetPlayback(rID, next); err != nil {
+		t.Fatalf("SetPlayback(): %v", err)
+	}
+	if err := sdb.UpdatePlayback(rID, paused); err != db.ErrPlaybackChanged {
+		t.Errorf("UpdatePlayback() of an old track = %v, want %v", err, db.ErrPlaybackChanged)
+	}
+	got, err := sdb.Playback(rID)
+	if err != nil {
+		t.Fatalf("Playback(): %v", err)
+	}
+	if got.HistoryIndex != 1 || got.Paused || got.PositionMS != 0 {
+		t.Errorf("Playback() = %+v, want entry 1 playing from the start", got)
+	}
+}
+
+func TestPlaybackPosition(t *testing.T) {
+	updated := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := updated.Add(1500 * time.Millisecond)
+
+	playing := &db.PlaybackState{PositionMS: 1000, UpdatedAt: updated}
+	if got := playing.PositionAt(later); got != 2500 {
+		t.Errorf("PositionAt() while playing = %d, want 2500", got)
+	}
+	if got, want := playing.StartedAt(), updated.Add(-time.Second); !got.Equal(want) {
+		t.Errorf("StartedAt() = %v, want %v", got, want)
+	}
+
+	paused := &db.PlaybackState{Paused: true, PositionMS: 1000, UpdatedAt: updated}
+	if got := paused.PositionAt(later); got != 1000 {
+		t.Errorf("PositionAt() while paused = %d, want 1000", got)
+	}
+}
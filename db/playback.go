@@ -0,0 +1,32 @@
+package db
+
+import "time"
+
+// PlaybackState is where playback of a room's current track is, for rooms
+// where everyone listens on their own device and needs to stay in sync.
+type PlaybackState struct {
+	// HistoryIndex is the index of the history entry that's playing.
+	HistoryIndex int  `json:"historyIndex"`
+	Paused       bool `json:"paused"`
+	// PositionMS is how far into the track playback was at UpdatedAt, in
+	// milliseconds.
+	PositionMS int64 `json:"positionMS"`
+	// UpdatedAt is when the state last changed, according to the server's
+	// clock.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PositionAt returns how far into the track playback is at the given time,
+// in milliseconds.
+func (p *PlaybackState) PositionAt(t time.Time) int64 {
+	if p.Paused {
+		return p.PositionMS
+	}
+	return p.PositionMS + t.Sub(p.UpdatedAt).Milliseconds()
+}
+
+// StartedAt returns when the track would have started, if it had played
+// without pausing or seeking. It's only meaningful while the track is playing.
+func (p *PlaybackState) StartedAt() time.Time {
+	return p.UpdatedAt.Add(-time.Duration(p.PositionMS) * time.Millisecond)
+}
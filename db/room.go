@@ -21,6 +21,16 @@ type (
 		ID          RoomID      `json:"id"`
 		DisplayName string      `json:"displayName"`
 		RotatorType RotatorType `json:"-"`
+		// OwnerID is the user that created the room. It's empty for rooms
+		// created before rooms had owners.
+		OwnerID UserID `json:"ownerID"`
+		// Ended is true once the room has been ended, and tracks can no longer
+		// be played in it.
+		Ended bool `json:"ended"`
+		// Providers are the names of the providers, like "spotify" or
+		// "library", that the room searches and adds tracks from. Empty means
+		// every provider the server has.
+		Providers []string `json:"providers"`
 	}
 )
 
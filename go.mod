@@ -15,4 +15,5 @@ require (
 	github.com/pressly/goose v2.3.0+incompatible
 	google.golang.org/api v0.1.0
 	gopkg.in/square/go-jose.v2 v2.1.7 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
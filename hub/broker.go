@@ -0,0 +1,89 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/bcspragu/Radiotation/db"
+)
+
+// An Event is a message on its way through a Broker.
+type Event struct {
+	Message
+	// UserID is set for events meant for a single user in the room. Those
+	// aren't part of the room's sequence, so the Broker doesn't stamp them.
+	UserID db.UserID `json:"userID,omitempty"`
+}
+
+// A Broker passes events between every Hub that's serving a room, which lets
+// us run more than one server.
+type Broker interface {
+	// Publish sends an event to every subscriber, in the order it was
+	// published. Room-wide events are stamped with the room's next sequence
+	// number first.
+	Publish(*Event) error
+	// Subscribe returns a channel that receives every event published to the
+	// Broker. The channel is closed when the Broker is.
+	Subscribe() (<-chan *Event, error)
+	Close() error
+}
+
+// MemoryBroker is a Broker for a single server, which passes events around in
+// memory.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	seqs   map[db.RoomID]uint64
+	subs   []chan *Event
+	closed bool
+}
+
+// NewMemoryBroker returns an empty MemoryBroker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{seqs: make(map[db.RoomID]uint64)}
+}
+
+func (b *MemoryBroker) Publish(ev *Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("broker is closed")
+	}
+
+	if ev.UserID == "" {
+		b.seqs[ev.RoomID]++
+		ev.Seq = b.seqs[ev.RoomID]
+	}
+
+	// We hold the lock while we send, so every subscriber sees events in the
+	// same order.
+	for _, sub := range b.subs {
+		sub <- ev
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe() (<-chan *Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, errors.New("broker is closed")
+	}
+
+	sub := make(chan *Event, 256)
+	b.subs = append(b.subs, sub)
+	return sub, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+
+	b.closed = true
+	for _, sub := range b.subs {
+		close(sub)
+	}
+	return nil
+}
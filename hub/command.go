@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"encoding/json"
+
+	"github.com/bcspragu/Radiotation/db"
+)
+
+// CommandType identifies what a client is asking for in a Command, and what
+// its payload holds.
+type CommandType string
+
+const (
+	// AddTrack adds a track to the sender's queue. The payload is an
+	// AddTrackCommand.
+	AddTrack CommandType = "queue.add"
+	// RemoveTrack removes a track from the sender's queue. The payload is a
+	// RemoveTrackCommand.
+	RemoveTrack CommandType = "queue.remove"
+	// MoveTrack moves a track within the sender's queue. The payload is a
+	// MoveTrackCommand.
+	MoveTrack CommandType = "queue.move"
+	// Vote votes for the track that's currently playing. There's no payload.
+	Vote CommandType = "vote"
+	// VetoTrack vetoes the track that's currently playing. There's no payload.
+	VetoTrack CommandType = "veto"
+	// SendChat sends a chat message about the track that's currently playing.
+	// The payload is a SendChatCommand.
+	SendChat CommandType = "chat.send"
+	// React reacts to the track that's currently playing with an emoji. The
+	// payload is a ReactCommand.
+	React CommandType = "chat.react"
+	// DeleteChat deletes a chat message or reaction. The payload is a
+	// DeleteChatCommand.
+	DeleteChat CommandType = "chat.delete"
+)
+
+const (
+	// MaxChatBytes is the longest chat message that can be sent, in bytes.
+	// It's small enough that a SendChat command fits within maxMessageSize,
+	// even if every byte of the message needs escaping, with room left over
+	// for the rest of the command.
+	MaxChatBytes = (maxMessageSize - commandOverhead) / 2
+	// MaxReactionBytes is the longest emoji that can be sent as a reaction, in
+	// bytes. It allows for emoji made up of several code points, like flags
+	// and families.
+	MaxReactionBytes = 32
+
+	// commandOverhead is how much of a command is taken up by everything but
+	// the payload's text, including a generous allowance for the client's
+	// command ID.
+	commandOverhead = 112
+)
+
+// Ack is sent only to the client that sent a command, once the command has
+// been handled. The payload is an AckEvent. Acks aren't part of the room's
+// sequence of events, so their Seq is always zero.
+const Ack EventType = "ack"
+
+// Command is a request sent by a client over its WebSocket connection.
+type Command struct {
+	// ID is chosen by the client, and is sent back in the acknowledgement.
+	ID      string          `json:"id"`
+	Type    CommandType     `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type AddTrackCommand struct {
+	TrackID string `json:"trackID"`
+	// Next is true if the track should be played next, instead of being
+	// added at the end of the queue.
+	Next bool `json:"next"`
+}
+
+type RemoveTrackCommand struct {
+	QueueTrackID string `json:"queueTrackID"`
+}
+
+type MoveTrackCommand struct {
+	QueueTrackID string `json:"queueTrackID"`
+	// AfterID is the QueueTrack to move the track after, or blank to move it
+	// to the front of the queue.
+	AfterID string `json:"afterID"`
+}
+
+type SendChatCommand struct {
+	Text string `json:"text"`
+}
+
+type ReactCommand struct {
+	Emoji string `json:"emoji"`
+}
+
+type DeleteChatCommand struct {
+	HistoryIndex int    `json:"historyIndex"`
+	MessageID    string `json:"messageID"`
+}
+
+type AckEvent struct {
+	ID    string `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// Result is whatever the command returns, if anything.
+	Result interface{} `json:"result,omitempty"`
+}
+
+// A CommandHandler runs a command sent by a user connected to a room, and
+// returns the result to acknowledge the command with.
+type CommandHandler func(rm *db.Room, u *db.User, cmd *Command) (interface{}, error)
@@ -1,6 +1,9 @@
 package hub
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
 	"time"
 
 	"github.com/bcspragu/Radiotation/db"
@@ -27,29 +30,79 @@ type connection struct {
 	h  *Hub
 	// What room this connection is associated with.
 	rm *db.Room
-	// The websocket connection.
+	// Who this connection belongs to.
+	u *db.User
+	// The sequence number of the last message the client saw before
+	// connecting, if it's reconnecting.
+	since uint64
+	// The websocket connection, or nil for a Subscription.
 	ws *websocket.Conn
 
 	// Buffered channel of outbound messages.
-	send chan []byte
+	send chan *Frame
+
+	// Why the hub closed the connection. They're set before send is closed.
+	closeCode   int
+	closeReason string
 }
 
 // readPump pumps messages from the websocket connection to the hub.
 func (c *connection) readPump() {
 	defer func() {
-		c.h.unregister <- c
+		c.h.unregisterConn(c)
 		c.ws.Close()
 	}()
 	c.ws.SetReadLimit(maxMessageSize)
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		//_, message, err := c.ws.ReadMessage()
-		_, _, err := c.ws.ReadMessage()
+		_, message, err := c.ws.ReadMessage()
 		if err != nil {
 			break
 		}
-		// TODO(bcspragu): Make sure we don't have any legitimate uses for incoming WS frames
+
+		var cmd Command
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			c.ack(&cmd, nil, errors.New("malformed command"))
+			continue
+		}
+		c.handle(&cmd)
+	}
+}
+
+// handle runs a command from the client, and acknowledges it.
+func (c *connection) handle(cmd *Command) {
+	if c.h.handler == nil {
+		c.ack(cmd, nil, errors.New("commands aren't supported"))
+		return
+	}
+
+	res, err := c.h.handler(c.rm, c.u, cmd)
+	c.ack(cmd, res, err)
+}
+
+// ack sends the result of a command back to the client that sent it.
+func (c *connection) ack(cmd *Command, res interface{}, cmdErr error) {
+	ack := &AckEvent{ID: cmd.ID, OK: cmdErr == nil, Result: res}
+	if cmdErr != nil {
+		ack.Error = cmdErr.Error()
+	}
+
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		log.Printf("Failed to encode ack for command %q: %v", cmd.ID, err)
+		return
+	}
+
+	f, err := newFrame(&Message{Version: ProtocolVersion, Type: Ack, RoomID: c.rm.ID, Payload: payload})
+	if err != nil {
+		log.Printf("Failed to encode ack for command %q: %v", cmd.ID, err)
+		return
+	}
+
+	select {
+	case c.h.reply <- &replyMsg{c: c, frame: f}:
+	case <-c.h.quit:
 	}
 }
 
@@ -68,12 +121,12 @@ func (c *connection) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
+		case f, ok := <-c.send:
 			if !ok {
-				c.write(websocket.CloseMessage, []byte{})
+				c.write(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
 				return
 			}
-			if err := c.write(websocket.TextMessage, message); err != nil {
+			if err := c.write(websocket.TextMessage, f.Data); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -0,0 +1,140 @@
+package hub
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+)
+
+// ProtocolVersion is the version of the Message envelope. It should be bumped
+// whenever the envelope, or the payload of an existing event, changes in a way
+// that old clients can't handle.
+const ProtocolVersion = 1
+
+// EventType identifies what a Message is about, and what its payload holds.
+type EventType string
+
+const (
+	// TrackChanged is sent when a new track starts playing. The payload is a
+	// TrackChangedEvent.
+	TrackChanged EventType = "track.changed"
+	// QueueChanged is sent when a user's queue is modified. The payload is a
+	// QueueChangedEvent.
+	QueueChanged EventType = "queue.changed"
+	// UserJoined is sent when a user joins a room. The payload is a
+	// UserEvent.
+	UserJoined EventType = "user.joined"
+	// UserLeft is sent when a user stops being a member of a room. Members
+	// can't leave on their own, so for now that's only when the room ends,
+	// and everyone leaves at once, before the RoomSettingsChanged event that
+	// says it ended. The payload is a UserEvent.
+	UserLeft EventType = "user.left"
+	// Veto is sent when a track gets vetoed. The payload is a VetoEvent.
+	Veto EventType = "veto"
+	// VoteTally is sent when the votes for the current track change. The
+	// payload is a VoteTallyEvent.
+	VoteTally EventType = "vote.tally"
+	// RoomSettingsChanged is sent when the room itself changes, like when it
+	// ends. The payload is a RoomSettingsChangedEvent.
+	RoomSettingsChanged EventType = "room.settings"
+	// PresenceJoined is sent when a user opens their first connection to a
+	// room through a server. Presence is tracked by each server on its own,
+	// and presence events are only sent to clients on the same server, outside
+	// of the room's sequence. The payload is a PresenceEvent.
+	PresenceJoined EventType = "presence.joined"
+	// PresenceLeft is sent when a user closes their last connection to a room
+	// through a server. The payload is a PresenceEvent.
+	PresenceLeft EventType = "presence.left"
+	// ResyncRequired is sent when a client has missed more messages than we can
+	// replay, either because it reconnected too late or because the server
+	// missed them too, and should reload the room. The payload is a
+	// ResyncRequiredEvent.
+	ResyncRequired EventType = "resync.required"
+	// PlaybackChanged is sent when a track starts, pauses, resumes or seeks.
+	// The payload is a PlaybackChangedEvent.
+	PlaybackChanged EventType = "playback.changed"
+	// UpNext is sent only to the user whose track is going to play next. The
+	// payload is an UpNextEvent.
+	UpNext EventType = "track.upnext"
+	// ChatMessageSent is sent when a member sends a chat message or reaction.
+	// The payload is a ChatMessageEvent.
+	ChatMessageSent EventType = "chat.message"
+	// ChatMessageDeleted is sent when a chat message or reaction is deleted.
+	// The payload is a ChatMessageDeletedEvent.
+	ChatMessageDeleted EventType = "chat.deleted"
+)
+
+// Message is the envelope for everything sent to clients.
+type Message struct {
+	Version int       `json:"v"`
+	Type    EventType `json:"type"`
+	RoomID  db.RoomID `json:"roomID"`
+	// Seq increases by one with each message sent to a room, starting at 1.
+	// Messages sent to a single user or connection, like acks, aren't
+	// sequenced, and have a Seq of 0.
+	Seq uint64 `json:"seq"`
+	// ServerTime is when the message was sent, according to the server's
+	// clock. Clients use it to estimate how far off their own clock is.
+	ServerTime time.Time       `json:"serverTime"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+type TrackChangedEvent struct {
+	Track        *radio.Track `json:"track"`
+	UserID       db.UserID    `json:"userID"`
+	HistoryIndex int          `json:"historyIndex"`
+	Replay       bool         `json:"replay"`
+}
+
+type ResyncRequiredEvent struct {
+	// Seq is the sequence number of the last message sent to the room.
+	Seq uint64 `json:"seq"`
+}
+
+type PlaybackChangedEvent struct {
+	Playback *db.PlaybackState `json:"playback"`
+}
+
+type UpNextEvent struct {
+	Track *radio.Track `json:"track"`
+}
+
+type QueueChangedEvent struct {
+	UserID db.UserID `json:"userID"`
+}
+
+type UserEvent struct {
+	User *db.User `json:"user"`
+}
+
+type PresenceEvent struct {
+	User *db.User `json:"user"`
+}
+
+type VetoEvent struct {
+	Track  *radio.Track `json:"track"`
+	Vetoer *db.User     `json:"vetoer"`
+	Vetoee *db.User     `json:"vetoee"`
+}
+
+type VoteTallyEvent struct {
+	HistoryIndex int `json:"historyIndex"`
+	Votes        int `json:"votes"`
+}
+
+type ChatMessageEvent struct {
+	// HistoryIndex is the track that the message was sent during.
+	HistoryIndex int             `json:"historyIndex"`
+	Message      *db.ChatMessage `json:"message"`
+}
+
+type ChatMessageDeletedEvent struct {
+	HistoryIndex int    `json:"historyIndex"`
+	MessageID    string `json:"messageID"`
+}
+
+type RoomSettingsChangedEvent struct {
+	Room *db.Room `json:"room"`
+}
@@ -1,96 +1,610 @@
 package hub
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"math/rand"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/bcspragu/Radiotation/db"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	defaultSendBuffer  = 256
+	defaultReplaySize  = 256
+	defaultIdleTimeout = 10 * time.Minute
+)
+
+// Options configure a Hub. Zero values use the defaults.
+type Options struct {
+	// SendBuffer is how many messages can be waiting to go out to a single
+	// client. Clients that fall further behind than that are dropped. The
+	// default is 256.
+	SendBuffer int
+	// ReplaySize is how many of the most recent messages in each room are kept
+	// around for clients that reconnect. The default is 256.
+	ReplaySize int
+	// IdleTimeout is how long a room with nobody connected goes without any
+	// messages before its recent messages and metrics are thrown away. Rooms
+	// that have ended are thrown away as soon as nobody is connected. The
+	// default is 10 minutes.
+	IdleTimeout time.Duration
+}
+
 // Hub maintains the set of active connections and broadcasts messages to the
-// connections.
+// connections. Messages go through a Broker first, so that every Hub serving a
+// room sees them, and in the same order.
 type Hub struct {
-	// Registered connections.
-	connections map[db.RoomID][]*connection
+	// Registered connections, by room and then by user.
+	connections map[db.RoomID]map[db.UserID][]*connection
+
+	// The sequence number of the last message sent to each room.
+	seqs map[db.RoomID]uint64
+
+	// The most recent messages sent to each room.
+	recent map[db.RoomID]*ring
+
+	// Counters for each room.
+	metrics map[db.RoomID]*RoomMetrics
+
+	// When each room last had a message or a connection leave, and which
+	// rooms have ended, for throwing away the above once they aren't needed.
+	lastActive map[db.RoomID]time.Time
+	ended      map[db.RoomID]bool
+
+	sendBuffer  int
+	replaySize  int
+	idleTimeout time.Duration
 
-	// Inbound messages from the connections.
-	broadcast chan *broadcastMsg
+	broker Broker
+
+	// Events from the broker.
+	events <-chan *Event
 
 	// Register requests from the connections.
 	register chan *connection
 
 	// Unregister requests from connections.
 	unregister chan *connection
+
+	// Replies to individual connections.
+	reply chan *replyMsg
+
+	// Requests for who is connected to a room.
+	presence chan *presenceReq
+
+	// Requests for the hub's metrics.
+	metricsReqs chan chan map[db.RoomID]RoomMetrics
+
+	// Runs the commands that clients send.
+	handler CommandHandler
+
+	// Closed to stop the hub, and once it has stopped.
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// New creates a new Hub and starts it in a background Go routine.
-func New() *Hub {
+// New creates a new Hub that sends messages through the given Broker, and
+// starts it in a background Go routine. Commands sent by clients are passed to
+// the given handler. The options can be nil.
+func New(b Broker, handler CommandHandler, opts *Options) (*Hub, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	events, err := b.Subscribe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to broker: %v", err)
+	}
+
 	h := &Hub{
-		broadcast:   make(chan *broadcastMsg),
+		broker:      b,
+		events:      events,
 		register:    make(chan *connection),
 		unregister:  make(chan *connection),
-		connections: make(map[db.RoomID][]*connection),
+		reply:       make(chan *replyMsg),
+		presence:    make(chan *presenceReq),
+		metricsReqs: make(chan chan map[db.RoomID]RoomMetrics),
+		handler:     handler,
+		connections: make(map[db.RoomID]map[db.UserID][]*connection),
+		seqs:        make(map[db.RoomID]uint64),
+		recent:      make(map[db.RoomID]*ring),
+		metrics:     make(map[db.RoomID]*RoomMetrics),
+		lastActive:  make(map[db.RoomID]time.Time),
+		ended:       make(map[db.RoomID]bool),
+		sendBuffer:  opts.SendBuffer,
+		replaySize:  opts.ReplaySize,
+		idleTimeout: opts.IdleTimeout,
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if h.sendBuffer <= 0 {
+		h.sendBuffer = defaultSendBuffer
+	}
+	if h.replaySize <= 0 {
+		h.replaySize = defaultReplaySize
+	}
+	if h.idleTimeout <= 0 {
+		h.idleTimeout = defaultIdleTimeout
 	}
+
 	go h.run()
-	return h
+	return h, nil
+}
+
+// Close disconnects every client and stops the Hub. It doesn't close the
+// Broker, which might be shared, but the Hub keeps throwing away what it gets
+// from the Broker until it is closed, so it doesn't hold up anyone else.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.quit) })
+	<-h.done
 }
 
 func (h *Hub) run() {
+	prune := time.NewTicker(h.idleTimeout)
+	defer prune.Stop()
+
 	for {
 		select {
+		case now := <-prune.C:
+			h.pruneIdle(now)
+		case <-h.quit:
+			for _, uconns := range h.connections {
+				for _, conns := range uconns {
+					// deleteConn modifies the slice, so we range over a copy.
+					for _, c := range append([]*connection(nil), conns...) {
+						h.deleteConn(c, websocket.CloseGoingAway, "server is shutting down")
+					}
+				}
+			}
+			close(h.done)
+			h.drain()
+			return
 		case c := <-h.register:
-			conns := h.connections[c.rm.ID]
-			h.connections[c.rm.ID] = append(conns, c)
+			uconns, ok := h.connections[c.rm.ID]
+			if !ok {
+				uconns = make(map[db.UserID][]*connection)
+				h.connections[c.rm.ID] = uconns
+			}
+			uconns[c.u.ID] = append(uconns[c.u.ID], c)
+			h.roomMetrics(c.rm.ID)
+			if c.since > 0 {
+				h.replay(c)
+			}
+			// Other tabs the user has open don't count as them joining again.
+			if len(uconns[c.u.ID]) == 1 {
+				h.sendPresence(c.rm.ID, PresenceJoined, c.u)
+			}
 		case c := <-h.unregister:
-			h.deleteConn(c)
-		case m := <-h.broadcast:
-			for _, c := range h.connections[m.roomID] {
-				select {
-				case c.send <- m.msg:
-				default:
-					h.deleteConn(c)
+			h.deleteConn(c, websocket.CloseNormalClosure, "")
+		case m := <-h.reply:
+			// Make sure the connection hasn't gone away while we were handling
+			// its command.
+			if !h.registered(m.c) {
+				continue
+			}
+			h.sendAll([]*connection{m.c}, m.frame)
+		case ev, ok := <-h.events:
+			if !ok {
+				log.Print("Broker closed, no more messages will be sent")
+				// Receiving from a nil channel blocks forever, which is what we
+				// want now.
+				h.events = nil
+				continue
+			}
+			if ev.UserID != "" {
+				h.sendUser(ev)
+				continue
+			}
+			h.sendRoom(&ev.Message)
+		case req := <-h.presence:
+			var users []*db.User
+			for _, uconns := range h.connections[req.roomID] {
+				users = append(users, uconns[0].u)
+			}
+			sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+			req.resp <- users
+		case resp := <-h.metricsReqs:
+			ms := make(map[db.RoomID]RoomMetrics)
+			for rid, m := range h.metrics {
+				rm := *m
+				for _, conns := range h.connections[rid] {
+					rm.Connections += len(conns)
 				}
+				ms[rid] = rm
 			}
+			resp <- ms
+		}
+	}
+}
+
+// drain throws away events from the broker until it's closed. The broker
+// won't take more events than our subscription can hold, so if we stopped
+// reading from it, anything anyone else publishes later could block forever.
+func (h *Hub) drain() {
+	if h.events == nil {
+		return
+	}
+	for range h.events {
+	}
+}
+
+// pruneIdle forgets rooms that nobody is connected to, and that haven't been
+// active for the idle timeout.
+func (h *Hub) pruneIdle(now time.Time) {
+	for rid, t := range h.lastActive {
+		if _, ok := h.connections[rid]; ok || now.Sub(t) < h.idleTimeout {
+			continue
+		}
+		h.forget(rid)
+	}
+}
+
+// forget throws away everything the hub keeps about a room. Clients that
+// reconnect to it later are told to resync.
+func (h *Hub) forget(rid db.RoomID) {
+	delete(h.seqs, rid)
+	delete(h.recent, rid)
+	delete(h.metrics, rid)
+	delete(h.lastActive, rid)
+	delete(h.ended, rid)
+}
+
+// roomMetrics returns the counters for a room, creating them if needed.
+func (h *Hub) roomMetrics(rid db.RoomID) *RoomMetrics {
+	m, ok := h.metrics[rid]
+	if !ok {
+		m = &RoomMetrics{}
+		h.metrics[rid] = m
+	}
+	return m
+}
+
+// sendPresence tells everyone connected to a room through this hub that a
+// user joined or left. Presence is only tracked by each hub on its own, so
+// presence events don't go through the broker, and aren't sequenced.
+func (h *Hub) sendPresence(rid db.RoomID, typ EventType, u *db.User) {
+	ev, err := newEvent(rid, typ, &PresenceEvent{User: u})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	f, err := newFrame(&ev.Message)
+	if err != nil {
+		log.Printf("Failed to encode %q message for room %s: %v", typ, rid, err)
+		return
+	}
+	h.sendAll(h.roomConns(rid), f)
+}
+
+// sendRoom sends a message that's been sequenced by the broker to every
+// connection in a room.
+func (h *Hub) sendRoom(m *Message) {
+	// A gap in the sequence means we missed messages, usually because we lost
+	// our connection to the broker for a bit. A sequence that goes backwards
+	// means the broker restarted and started counting again, so the messages
+	// we have don't line up with the new numbers. Either way, the replay ring
+	// can't help, so we start it over, and everyone in the room has to resync.
+	if last, ok := h.seqs[m.RoomID]; ok && (m.Seq > last+1 || m.Seq <= last) {
+		if m.Seq > last+1 {
+			log.Printf("Missed messages %d to %d for room %s, resyncing", last+1, m.Seq-1, m.RoomID)
+		} else {
+			log.Printf("Sequence for room %s went back from %d to %d, resyncing", m.RoomID, last, m.Seq)
+		}
+		delete(h.recent, m.RoomID)
+		delete(h.seqs, m.RoomID)
+		if f, err := resyncFrame(m.RoomID, m.Seq-1); err != nil {
+			log.Print(err)
+		} else {
+			h.sendAll(h.roomConns(m.RoomID), f)
 		}
 	}
+
+	h.seqs[m.RoomID] = m.Seq
+	f, err := newFrame(m)
+	if err != nil {
+		log.Printf("Failed to encode %q message for room %s: %v", m.Type, m.RoomID, err)
+		return
+	}
+
+	r, ok := h.recent[m.RoomID]
+	if !ok {
+		r = newRing(h.replaySize)
+		h.recent[m.RoomID] = r
+	}
+	r.add(f)
+
+	h.sendAll(h.roomConns(m.RoomID), f)
+
+	h.lastActive[m.RoomID] = time.Now()
+	if m.Type == RoomSettingsChanged {
+		var ev RoomSettingsChangedEvent
+		if err := json.Unmarshal(m.Payload, &ev); err == nil && ev.Room != nil && ev.Room.Ended {
+			h.ended[m.RoomID] = true
+		}
+	}
+	if _, ok := h.connections[m.RoomID]; !ok && h.ended[m.RoomID] {
+		h.forget(m.RoomID)
+	}
 }
 
-func (h *Hub) deleteConn(c *connection) {
+// roomConns returns every connection to a room.
+func (h *Hub) roomConns(rid db.RoomID) []*connection {
+	var conns []*connection
+	for _, uconns := range h.connections[rid] {
+		conns = append(conns, uconns...)
+	}
+	return conns
+}
+
+// sendUser sends an event to every connection one user has open to a room.
+func (h *Hub) sendUser(ev *Event) {
+	f, err := newFrame(&ev.Message)
+	if err != nil {
+		log.Printf("Failed to encode %q message for user %s in room %s: %v", ev.Type, ev.UserID, ev.RoomID, err)
+		return
+	}
+	h.sendAll(h.connections[ev.RoomID][ev.UserID], f)
+}
+
+// replay sends a newly registered connection the messages it missed since the
+// sequence number it last saw, or tells it to resync if we don't have them all
+// anymore.
+func (h *Hub) replay(c *connection) {
+	cur := h.seqs[c.rm.ID]
+
+	var (
+		frames []*Frame
+		ok     bool
+	)
+	// If the client has seen messages we haven't sent, we've probably
+	// restarted since then.
+	if c.since <= cur {
+		frames, ok = nil, true
+		if r, exists := h.recent[c.rm.ID]; exists {
+			frames, ok = r.since(c.since)
+		}
+	}
+
+	if ok {
+		h.sendAll([]*connection{c}, frames...)
+		return
+	}
+
+	f, err := resyncFrame(c.rm.ID, cur)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	h.sendAll([]*connection{c}, f)
+}
+
+// resyncFrame returns a ResyncRequired message for a room, where seq is the
+// last message sent to it.
+func resyncFrame(rid db.RoomID, seq uint64) (*Frame, error) {
+	dat, err := json.Marshal(&ResyncRequiredEvent{Seq: seq})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %q payload for room %s: %v", ResyncRequired, rid, err)
+	}
+	f, err := newFrame(&Message{Version: ProtocolVersion, Type: ResyncRequired, RoomID: rid, Payload: dat})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %q message for room %s: %v", ResyncRequired, rid, err)
+	}
+	return f, nil
+}
+
+// sendAll queues frames for each of the given connections, dropping any
+// connections that can't keep up.
+func (h *Hub) sendAll(conns []*connection, frames ...*Frame) {
+	var slow []*connection
+	for _, c := range conns {
+		m := h.roomMetrics(c.rm.ID)
+		for _, f := range frames {
+			if !trySend(c, f) {
+				slow = append(slow, c)
+				break
+			}
+			m.MessagesSent++
+			m.BytesSent += uint64(len(f.Data))
+		}
+	}
+
+	// Deleting a connection can send more messages, so we wait until we're
+	// done with the connections we were given.
+	for _, c := range slow {
+		if !h.registered(c) {
+			continue
+		}
+		h.roomMetrics(c.rm.ID).Drops++
+		// The client can pick up where it left off when it reconnects.
+		reason := fmt.Sprintf("too far behind, reconnect with since=%d", h.seqs[c.rm.ID])
+		h.deleteConn(c, websocket.CloseTryAgainLater, reason)
+	}
+}
+
+func trySend(c *connection, f *Frame) bool {
+	select {
+	case c.send <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+// A Frame is a message that's been encoded, ready to send to clients.
+type Frame struct {
+	// Seq is the sequence number of the message, or 0 if it isn't sequenced.
+	Seq  uint64
+	Data []byte
+}
+
+func newFrame(m *Message) (*Frame, error) {
+	if m.ServerTime.IsZero() {
+		m.ServerTime = time.Now()
+	}
+	dat, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{Seq: m.Seq, Data: dat}, nil
+}
+
+func (h *Hub) registered(c *connection) bool {
+	for _, uconn := range h.connections[c.rm.ID][c.u.ID] {
+		if uconn.id == c.id {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteConn removes a connection from the hub. The client is sent the given
+// close code and reason, if it's still listening.
+func (h *Hub) deleteConn(c *connection, code int, reason string) {
+	if !h.registered(c) {
+		// We've already removed this connection.
+		return
+	}
+	c.closeCode, c.closeReason = code, reason
 	close(c.send)
-	rconns := h.connections[c.rm.ID]
-	for i, rconn := range rconns {
-		if rconn.id == c.id {
+	uconns := h.connections[c.rm.ID][c.u.ID]
+	for i, uconn := range uconns {
+		if uconn.id == c.id {
 			// Remove the connection.
-			copy(rconns[i:], rconns[i+1:])
-			rconns[len(rconns)-1] = nil
-			h.connections[c.rm.ID] = rconns[:len(rconns)-1]
-			return
+			copy(uconns[i:], uconns[i+1:])
+			uconns[len(uconns)-1] = nil
+			uconns = uconns[:len(uconns)-1]
+			break
 		}
 	}
+
+	if len(uconns) > 0 {
+		h.connections[c.rm.ID][c.u.ID] = uconns
+		return
+	}
+	delete(h.connections[c.rm.ID], c.u.ID)
+	if len(h.connections[c.rm.ID]) == 0 {
+		delete(h.connections, c.rm.ID)
+		h.lastActive[c.rm.ID] = time.Now()
+		if h.ended[c.rm.ID] {
+			h.forget(c.rm.ID)
+		}
+	}
+	select {
+	case <-h.quit:
+		// Everyone is leaving, so there's nobody to tell.
+	default:
+		// That was the user's last connection, so they've left.
+		h.sendPresence(c.rm.ID, PresenceLeft, c.u)
+	}
 }
 
-type broadcastMsg struct {
+type presenceReq struct {
 	roomID db.RoomID
-	msg    []byte
+	resp   chan []*db.User
+}
+
+// Presence returns the users that currently have a connection open to a room
+// through this Hub, ordered by ID. Presence isn't shared through the Broker,
+// so users connected to the room through other servers aren't included.
+func (h *Hub) Presence(rid db.RoomID) []*db.User {
+	req := &presenceReq{roomID: rid, resp: make(chan []*db.User)}
+	select {
+	case h.presence <- req:
+		return <-req.resp
+	case <-h.quit:
+		return nil
+	}
 }
 
-// BroadcastRoom sends a message to everyone in a room.
-func (h *Hub) BroadcastRoom(msg []byte, rm *db.Room) {
-	h.broadcast <- &broadcastMsg{
-		roomID: rm.ID,
-		msg:    msg,
+// Metrics returns the counters for every room the Hub has served recently.
+func (h *Hub) Metrics() map[db.RoomID]RoomMetrics {
+	resp := make(chan map[db.RoomID]RoomMetrics)
+	select {
+	case h.metricsReqs <- resp:
+		return <-resp
+	case <-h.quit:
+		return nil
 	}
 }
 
-// Register associates a connection with the hub and a given room.
-func (h *Hub) Register(ws *websocket.Conn, rm *db.Room) {
-	conn := &connection{id: newID(rm), h: h, rm: rm, send: make(chan []byte, 256), ws: ws}
-	h.register <- conn
+func newEvent(rid db.RoomID, typ EventType, payload interface{}) (*Event, error) {
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %q payload: %v", typ, err)
+	}
+
+	return &Event{Message: Message{
+		Version:    ProtocolVersion,
+		Type:       typ,
+		RoomID:     rid,
+		ServerTime: time.Now(),
+		Payload:    dat,
+	}}, nil
+}
+
+// Publish sends an event to everyone in a room. The payload is encoded as
+// JSON, and should be the payload type documented for the event type.
+func (h *Hub) Publish(rid db.RoomID, typ EventType, payload interface{}) error {
+	ev, err := newEvent(rid, typ, payload)
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(ev)
+}
+
+// SendUser sends an event to every connection a user has open to a room. The
+// event isn't seen by anyone else in the room, so it isn't sequenced.
+func (h *Hub) SendUser(rid db.RoomID, uid db.UserID, typ EventType, payload interface{}) error {
+	ev, err := newEvent(rid, typ, payload)
+	if err != nil {
+		return err
+	}
+	ev.UserID = uid
+	return h.broker.Publish(ev)
+}
+
+type replyMsg struct {
+	c     *connection
+	frame *Frame
+}
+
+// Register associates a connection with the hub and a given room, on behalf of
+// the given user. The user must not be nil. If since is non-zero, it's the
+// sequence number of the last message the client saw, and the connection is
+// sent everything it missed, or a ResyncRequired event if that isn't possible.
+func (h *Hub) Register(ws *websocket.Conn, rm *db.Room, u *db.User, since uint64) {
+	conn := h.newConnection(rm, u, since)
+	conn.ws = ws
+	select {
+	case h.register <- conn:
+	case <-h.quit:
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"), time.Now().Add(writeWait))
+		ws.Close()
+		return
+	}
 	go conn.writePump()
 	go conn.readPump()
 }
 
+func (h *Hub) newConnection(rm *db.Room, u *db.User, since uint64) *connection {
+	return &connection{id: newID(rm), h: h, rm: rm, u: u, since: since, send: make(chan *Frame, h.sendBuffer)}
+}
+
+// unregisterConn removes a connection from the hub, unless the hub has
+// already stopped.
+func (h *Hub) unregisterConn(c *connection) {
+	select {
+	case h.unregister <- c:
+	case <-h.quit:
+	}
+}
+
 func newID(rm *db.Room) string {
 	return fmt.Sprintf("%s-%d", rm.ID, rand.Int63())
 }
@@ -0,0 +1,685 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+)
+
+func TestPublish(t *testing.T) {
+	h := newHub(t, nil, nil)
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	ws := dial(t, h, rm, &db.User{ID: db.UserID("USER")})
+
+	for i := 0; i < 2; i++ {
+		err := h.Publish(rm.ID, TrackChanged, &TrackChangedEvent{
+			Track:        &radio.Track{ID: "track"},
+			HistoryIndex: i,
+		})
+		if err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+
+	var lastSeq uint64
+	for i := 0; i < 2; i++ {
+		msg := readMessage(t, ws)
+		if msg.Version != ProtocolVersion {
+			t.Errorf("Version = %d, want %d", msg.Version, ProtocolVersion)
+		}
+		if msg.Type != TrackChanged {
+			t.Errorf("Type = %q, want %q", msg.Type, TrackChanged)
+		}
+		if msg.RoomID != rm.ID {
+			t.Errorf("RoomID = %q, want %q", msg.RoomID, rm.ID)
+		}
+		if msg.Seq <= lastSeq {
+			t.Errorf("Seq = %d, want more than %d", msg.Seq, lastSeq)
+		}
+		lastSeq = msg.Seq
+
+		var ev TrackChangedEvent
+		if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+			t.Fatalf("failed to decode payload: %v", err)
+		}
+		if ev.HistoryIndex != i {
+			t.Errorf("HistoryIndex = %d, want %d", ev.HistoryIndex, i)
+		}
+	}
+}
+
+func TestSendUser(t *testing.T) {
+	h := newHub(t, nil, nil)
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u1, u2 := &db.User{ID: db.UserID("USER1")}, &db.User{ID: db.UserID("USER2")}
+	// The first user has two tabs open.
+	ws1a, ws1b, ws2 := dial(t, h, rm, u1), dial(t, h, rm, u1), dial(t, h, rm, u2)
+
+	if err := h.SendUser(rm.ID, u1.ID, UpNext, &UpNextEvent{Track: &radio.Track{ID: "track"}}); err != nil {
+		t.Fatalf("SendUser: %v", err)
+	}
+	// Publish something to the whole room afterwards, so we can tell that the
+	// second user never got the first message.
+	if err := h.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: u1.ID}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	for _, ws := range []*websocket.Conn{ws1a, ws1b} {
+		msg := readMessage(t, ws)
+		if msg.Type != UpNext {
+			t.Errorf("Type = %q, want %q", msg.Type, UpNext)
+		}
+		if msg.Seq != 0 {
+			t.Errorf("Seq = %d, want 0", msg.Seq)
+		}
+	}
+
+	if msg := readMessage(t, ws2); msg.Type != QueueChanged {
+		t.Errorf("Type = %q, want %q", msg.Type, QueueChanged)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	h := newHub(t, nil, nil)
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u1, u2 := &db.User{ID: db.UserID("USER1")}, &db.User{ID: db.UserID("USER2")}
+
+	ws1a := dial(t, h, rm, u1)
+	dial(t, h, rm, u1)
+	ws2 := dial(t, h, rm, u2)
+
+	// The first user's second tab shouldn't count as them joining again.
+	for _, want := range []db.UserID{u1.ID, u2.ID} {
+		msg := readAnyMessage(t, ws1a)
+		if msg.Type != PresenceJoined {
+			t.Fatalf("Type = %q, want %q", msg.Type, PresenceJoined)
+		}
+		if got := presenceUser(t, msg); got != want {
+			t.Errorf("joined user = %q, want %q", got, want)
+		}
+	}
+
+	if diff := cmp.Diff([]*db.User{u1, u2}, h.Presence(rm.ID)); diff != "" {
+		t.Errorf("unexpected presence (-want +got):\n%s", diff)
+	}
+
+	ws2.Close()
+	msg := readAnyMessage(t, ws1a)
+	if msg.Type != PresenceLeft {
+		t.Fatalf("Type = %q, want %q", msg.Type, PresenceLeft)
+	}
+	if got := presenceUser(t, msg); got != u2.ID {
+		t.Errorf("left user = %q, want %q", got, u2.ID)
+	}
+
+	if diff := cmp.Diff([]*db.User{u1}, h.Presence(rm.ID)); diff != "" {
+		t.Errorf("unexpected presence (-want +got):\n%s", diff)
+	}
+}
+
+func TestPresenceLocal(t *testing.T) {
+	b := NewMemoryBroker()
+	h1, err := New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	h2, err := New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		h1.Close()
+		h2.Close()
+		b.Close()
+	})
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u1, u2 := &db.User{ID: db.UserID("USER1")}, &db.User{ID: db.UserID("USER2")}
+
+	ws1 := dial(t, h1, rm, u1)
+	if msg := readAnyMessage(t, ws1); msg.Type != PresenceJoined || presenceUser(t, msg) != u1.ID {
+		t.Fatalf("got %q, want %q for %q", msg.Type, PresenceJoined, u1.ID)
+	}
+	dial(t, h2, rm, u2)
+
+	// Room events still go to both hubs, but the other hub's users joining
+	// don't.
+	if err := h2.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: u2.ID}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	msg := readAnyMessage(t, ws1)
+	if msg.Type != QueueChanged {
+		t.Errorf("Type = %q, want %q", msg.Type, QueueChanged)
+	}
+	if msg.Seq != 1 {
+		t.Errorf("Seq = %d, want 1, presence events shouldn't be sequenced", msg.Seq)
+	}
+	if diff := cmp.Diff([]*db.User{u1}, h1.Presence(rm.ID)); diff != "" {
+		t.Errorf("unexpected presence (-want +got):\n%s", diff)
+	}
+}
+
+func presenceUser(t *testing.T, msg *Message) db.UserID {
+	t.Helper()
+
+	var ev PresenceEvent
+	if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	return ev.User.ID
+}
+
+func TestReplay(t *testing.T) {
+	const replaySize = 16
+	h := newHub(t, nil, &Options{ReplaySize: replaySize})
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u := &db.User{ID: db.UserID("USER")}
+
+	// Fill up the buffer, and then some.
+	for i := 0; i < replaySize+10; i++ {
+		if err := h.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: u.ID}); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	last := uint64(replaySize + 10)
+	flush(t, h)
+
+	t.Run("CaughtUp", func(t *testing.T) {
+		ws := dialSince(t, h, rm, u, last-3)
+		for want := last - 2; want <= last; want++ {
+			if msg := readMessage(t, ws); msg.Seq != want {
+				t.Errorf("Seq = %d, want %d", msg.Seq, want)
+			}
+		}
+	})
+
+	t.Run("TooFarBehind", func(t *testing.T) {
+		ws := dialSince(t, h, rm, u, 5)
+		msg := readMessage(t, ws)
+		if msg.Type != ResyncRequired {
+			t.Fatalf("Type = %q, want %q", msg.Type, ResyncRequired)
+		}
+
+		var ev ResyncRequiredEvent
+		if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+			t.Fatalf("failed to decode payload: %v", err)
+		}
+		// The previous subtest joining and leaving the room adds to the
+		// sequence.
+		if ev.Seq < last {
+			t.Errorf("Seq = %d, want at least %d", ev.Seq, last)
+		}
+	})
+
+	t.Run("FromTheFuture", func(t *testing.T) {
+		ws := dialSince(t, h, rm, u, last+1000)
+		if msg := readMessage(t, ws); msg.Type != ResyncRequired {
+			t.Errorf("Type = %q, want %q", msg.Type, ResyncRequired)
+		}
+	})
+}
+
+func TestMissedMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	h, err := New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		h.Close()
+		b.Close()
+	})
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u := &db.User{ID: db.UserID("USER")}
+	ws := dial(t, h, rm, u)
+
+	if err := h.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: u.ID}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	seen := readMessage(t, ws).Seq
+
+	// Skip a few sequence numbers, like we would if we lost our connection to
+	// the broker while other servers were publishing.
+	b.mu.Lock()
+	b.seqs[rm.ID] += 3
+	b.mu.Unlock()
+	if err := h.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: u.ID}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	next := seen + 4
+
+	msg := readMessage(t, ws)
+	if msg.Type != ResyncRequired {
+		t.Fatalf("Type = %q, want %q", msg.Type, ResyncRequired)
+	}
+	var ev ResyncRequiredEvent
+	if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	if ev.Seq != next-1 {
+		t.Errorf("Seq = %d, want %d", ev.Seq, next-1)
+	}
+	if msg := readMessage(t, ws); msg.Type != QueueChanged || msg.Seq != next {
+		t.Errorf("got %q %d, want %q %d", msg.Type, msg.Seq, QueueChanged, next)
+	}
+
+	// The missed messages can't be replayed to clients that reconnect either.
+	ws2 := dialSince(t, h, rm, u, seen)
+	if msg := readMessage(t, ws2); msg.Type != ResyncRequired {
+		t.Errorf("Type = %q, want %q", msg.Type, ResyncRequired)
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := newRing(3)
+	if msgs, ok := r.since(0); !ok || len(msgs) != 0 {
+		t.Errorf("since(0) on empty ring = %v, %t, want nothing", msgs, ok)
+	}
+
+	for seq := uint64(1); seq <= 5; seq++ {
+		r.add(&Frame{Seq: seq, Data: []byte{byte('0' + seq)}})
+	}
+
+	tests := []struct {
+		since  uint64
+		want   string
+		wantOK bool
+	}{
+		{since: 1, wantOK: false},
+		{since: 2, want: "345", wantOK: true},
+		{since: 4, want: "5", wantOK: true},
+		{since: 5, want: "", wantOK: true},
+	}
+	for _, test := range tests {
+		frames, ok := r.since(test.since)
+		var got string
+		for _, f := range frames {
+			got += string(f.Data)
+		}
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("since(%d) = %q, %t, want %q, %t", test.since, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h := newHub(t, nil, nil)
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	sub := h.Subscribe(rm, &db.User{ID: db.UserID("USER")}, 0)
+	defer sub.Close()
+
+	if err := h.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: db.UserID("USER")}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	// Skip over us joining the room.
+	for {
+		var f *Frame
+		select {
+		case f = <-sub.Frames():
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for frame")
+		}
+
+		var msg Message
+		if err := json.Unmarshal(f.Data, &msg); err != nil {
+			t.Fatalf("failed to decode frame: %v", err)
+		}
+		if msg.Type == PresenceJoined {
+			continue
+		}
+		if msg.Type != QueueChanged {
+			t.Errorf("Type = %q, want %q", msg.Type, QueueChanged)
+		}
+		if f.Seq != msg.Seq || f.Seq == 0 {
+			t.Errorf("frame Seq = %d, message Seq = %d, want the same non-zero value", f.Seq, msg.Seq)
+		}
+		break
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	h := newHub(t, nil, &Options{SendBuffer: 2})
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u := &db.User{ID: db.UserID("USER")}
+
+	// Nobody reads from this subscription, so it'll fall behind.
+	sub := h.Subscribe(rm, u, 0)
+	defer sub.Close()
+	for i := 0; i < 5; i++ {
+		if err := h.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: u.ID}); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	flush(t, h)
+
+	var frames int
+	for range sub.Frames() {
+		frames++
+	}
+	if frames != 2 {
+		t.Errorf("got %d frames before being dropped, want 2", frames)
+	}
+	if c := sub.c; c.closeCode != websocket.CloseTryAgainLater || c.closeReason == "" {
+		t.Errorf("closed with %d %q, want %d and a reason", c.closeCode, c.closeReason, websocket.CloseTryAgainLater)
+	}
+
+	m := h.Metrics()[rm.ID]
+	if m.Drops != 1 {
+		t.Errorf("Drops = %d, want 1", m.Drops)
+	}
+	if m.MessagesSent != 2 || m.BytesSent == 0 {
+		t.Errorf("MessagesSent, BytesSent = %d, %d, want 2 and more than 0", m.MessagesSent, m.BytesSent)
+	}
+	if m.Connections != 0 {
+		t.Errorf("Connections = %d, want 0", m.Connections)
+	}
+}
+
+func TestPruneRooms(t *testing.T) {
+	h := newHub(t, nil, &Options{IdleTimeout: 10 * time.Millisecond})
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u := &db.User{ID: db.UserID("USER")}
+
+	ws := dial(t, h, rm, u)
+	if err := h.Publish(rm.ID, QueueChanged, &QueueChangedEvent{UserID: u.ID}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	seen := readMessage(t, ws).Seq
+	ws.Close()
+	waitForPrune(t, h, rm.ID)
+
+	// The messages it had are gone, so clients coming back have to resync.
+	ws = dialSince(t, h, rm, u, seen)
+	if msg := readMessage(t, ws); msg.Type != ResyncRequired {
+		t.Errorf("Type = %q, want %q", msg.Type, ResyncRequired)
+	}
+}
+
+func TestPruneEndedRoom(t *testing.T) {
+	// Long enough that only the room ending explains it being pruned.
+	h := newHub(t, nil, &Options{IdleTimeout: time.Hour})
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u := &db.User{ID: db.UserID("USER")}
+
+	ws := dial(t, h, rm, u)
+	if err := h.Publish(rm.ID, RoomSettingsChanged, &RoomSettingsChangedEvent{Room: &db.Room{ID: rm.ID, Ended: true}}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	readMessage(t, ws)
+	if _, ok := h.Metrics()[rm.ID]; !ok {
+		t.Fatal("room was pruned while someone was still connected")
+	}
+	ws.Close()
+	waitForPrune(t, h, rm.ID)
+}
+
+// waitForPrune waits until the hub has forgotten about a room.
+func waitForPrune(t *testing.T, h *Hub, rid db.RoomID) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := h.Metrics()[rid]; !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("room %s still has metrics, want it pruned", rid)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	h := newHub(t, nil, nil)
+	ws := dial(t, h, &db.Room{ID: db.RoomID("ROOM")}, &db.User{ID: db.UserID("USER")})
+
+	h.Close()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("ReadMessage: %v, want close error %d", err, websocket.CloseGoingAway)
+		}
+		break
+	}
+
+	// Using the hub after it's closed shouldn't block.
+	if got := h.Presence(db.RoomID("ROOM")); got != nil {
+		t.Errorf("Presence = %v, want nil", got)
+	}
+	sub := h.Subscribe(&db.Room{ID: db.RoomID("ROOM")}, &db.User{ID: db.UserID("USER")}, 0)
+	if _, ok := <-sub.Frames(); ok {
+		t.Error("got a frame from a closed hub")
+	}
+	sub.Close()
+}
+
+func TestCloseManyConnections(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	// Nobody reads from the subscriptions, so they need room for everyone
+	// joining.
+	h, err := New(b, nil, &Options{SendBuffer: 1024})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// More users than fit in the broker's buffer, so that it would fill up if
+	// everyone leaving when we shut down went through it.
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	for i := 0; i < 300; i++ {
+		h.Subscribe(rm, &db.User{ID: db.UserID(fmt.Sprintf("USER%d", i))}, 0)
+	}
+	flush(t, h)
+
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the hub to close")
+	}
+
+	// The broker should still be usable by everyone else.
+	if err := b.Publish(&Event{Message: Message{Type: QueueChanged, RoomID: rm.ID}}); err != nil {
+		t.Errorf("Publish: %v", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	var got *Command
+	h := newHub(t, func(rm *db.Room, u *db.User, cmd *Command) (interface{}, error) {
+		got = cmd
+		if cmd.Type == VetoTrack {
+			return nil, errors.New("no vetoes allowed")
+		}
+		return "done", nil
+	}, nil)
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+
+	t.Run("Success", func(t *testing.T) {
+		ws := dial(t, h, rm, &db.User{ID: db.UserID("USER")})
+		sendCommand(t, ws, &Command{
+			ID:      "1",
+			Type:    AddTrack,
+			Payload: json.RawMessage(`{"trackID":"track","next":true}`),
+		})
+
+		ack := readAck(t, ws)
+		if !ack.OK || ack.ID != "1" || ack.Result != "done" {
+			t.Errorf("ack = %+v, want successful ack for command 1", ack)
+		}
+
+		var req AddTrackCommand
+		if err := json.Unmarshal(got.Payload, &req); err != nil {
+			t.Fatalf("failed to decode payload: %v", err)
+		}
+		if req.TrackID != "track" || !req.Next {
+			t.Errorf("payload = %+v, want track to be added next", req)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		ws := dial(t, h, rm, &db.User{ID: db.UserID("USER")})
+		sendCommand(t, ws, &Command{ID: "2", Type: VetoTrack})
+
+		ack := readAck(t, ws)
+		if ack.OK || ack.ID != "2" || ack.Error != "no vetoes allowed" {
+			t.Errorf("ack = %+v, want failed ack for command 2", ack)
+		}
+	})
+
+	t.Run("LongestChat", func(t *testing.T) {
+		// The longest chat message, made of characters that all need escaping,
+		// with an ID the length of a UUID, still fits within the read limit.
+		id := strings.Repeat("3", 36)
+		text := strings.Repeat(`"`, MaxChatBytes)
+		payload, err := json.Marshal(&SendChatCommand{Text: text})
+		if err != nil {
+			t.Fatalf("failed to encode payload: %v", err)
+		}
+
+		ws := dial(t, h, rm, &db.User{ID: db.UserID("USER")})
+		sendCommand(t, ws, &Command{ID: id, Type: SendChat, Payload: payload})
+
+		ack := readAck(t, ws)
+		if !ack.OK || ack.ID != id {
+			t.Fatalf("ack = %+v, want successful ack for command %s", ack, id)
+		}
+
+		var req SendChatCommand
+		if err := json.Unmarshal(got.Payload, &req); err != nil {
+			t.Fatalf("failed to decode payload: %v", err)
+		}
+		if req.Text != text {
+			t.Errorf("Text = %q, want %q", req.Text, text)
+		}
+	})
+}
+
+// flush waits until the hub has handled everything that's been published so
+// far.
+func flush(t *testing.T, h *Hub) {
+	t.Helper()
+
+	// Events come out of the broker in the order they went in, so once a
+	// marker event makes it to a connection in another room, everything before
+	// it has been handled.
+	rm, u := &db.Room{ID: db.RoomID("FLUSH")}, &db.User{ID: db.UserID("FLUSH")}
+	ws := dial(t, h, rm, u)
+	if err := h.SendUser(rm.ID, u.ID, UpNext, &UpNextEvent{}); err != nil {
+		t.Fatalf("SendUser: %v", err)
+	}
+	readMessage(t, ws)
+	ws.Close()
+}
+
+func newHub(t *testing.T, handler CommandHandler, opts *Options) *Hub {
+	t.Helper()
+
+	b := NewMemoryBroker()
+	h, err := New(b, handler, opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() {
+		h.Close()
+		b.Close()
+	})
+	return h
+}
+
+// dial starts a test server that registers connections with the hub, and
+// connects to it.
+func dial(t *testing.T, h *Hub, rm *db.Room, u *db.User) *websocket.Conn {
+	t.Helper()
+	return dialSince(t, h, rm, u, 0)
+}
+
+// dialSince is like dial, but for clients that are reconnecting after seeing
+// the message with the given sequence number.
+func dialSince(t *testing.T, h *Hub, rm *db.Room, u *db.User, since uint64) *websocket.Conn {
+	t.Helper()
+
+	registered := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade: %v", err)
+			return
+		}
+		h.Register(ws, rm, u, since)
+		close(registered)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	<-registered
+
+	return ws
+}
+
+func sendCommand(t *testing.T, ws *websocket.Conn, cmd *Command) {
+	t.Helper()
+
+	if err := ws.WriteJSON(cmd); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+}
+
+func readAck(t *testing.T, ws *websocket.Conn) *AckEvent {
+	t.Helper()
+
+	msg := readMessage(t, ws)
+	if msg.Type != Ack {
+		t.Fatalf("Type = %q, want %q", msg.Type, Ack)
+	}
+
+	var ack AckEvent
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	return &ack
+}
+
+// readMessage returns the next message that isn't about presence.
+func readMessage(t *testing.T, ws *websocket.Conn) *Message {
+	t.Helper()
+
+	for {
+		msg := readAnyMessage(t, ws)
+		if msg.Type != PresenceJoined && msg.Type != PresenceLeft {
+			return msg
+		}
+	}
+}
+
+func readAnyMessage(t *testing.T, ws *websocket.Conn) *Message {
+	t.Helper()
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	return &msg
+}
@@ -0,0 +1,13 @@
+package hub
+
+// RoomMetrics are a Hub's counters for a single room.
+type RoomMetrics struct {
+	// Connections is how many clients are connected right now.
+	Connections int `json:"connections"`
+	// Drops is how many clients have been disconnected for falling too far
+	// behind.
+	Drops uint64 `json:"drops"`
+	// MessagesSent and BytesSent count every message queued up for a client.
+	MessagesSent uint64 `json:"messagesSent"`
+	BytesSent    uint64 `json:"bytesSent"`
+}
@@ -0,0 +1,41 @@
+package hub
+
+// ring holds the most recent sequenced frames sent to a room, so clients that
+// reconnect can catch up on what they missed.
+type ring struct {
+	frames []*Frame
+	// next is where the next frame goes, once the ring is full.
+	next int
+}
+
+func newRing(size int) *ring {
+	return &ring{frames: make([]*Frame, 0, size)}
+}
+
+func (r *ring) add(f *Frame) {
+	if len(r.frames) < cap(r.frames) {
+		r.frames = append(r.frames, f)
+		return
+	}
+	r.frames[r.next] = f
+	r.next = (r.next + 1) % len(r.frames)
+}
+
+// since returns the frames after the given sequence number, oldest first. If
+// some of those frames have already been dropped, ok is false.
+func (r *ring) since(seq uint64) (frames []*Frame, ok bool) {
+	if len(r.frames) == 0 {
+		return nil, true
+	}
+	if oldest := r.frames[r.next].Seq; seq+1 < oldest {
+		return nil, false
+	}
+
+	for i := 0; i < len(r.frames); i++ {
+		f := r.frames[(r.next+i)%len(r.frames)]
+		if f.Seq > seq {
+			frames = append(frames, f)
+		}
+	}
+	return frames, true
+}
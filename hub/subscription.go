@@ -0,0 +1,34 @@
+package hub
+
+import "github.com/bcspragu/Radiotation/db"
+
+// A Subscription receives the same messages as a WebSocket connection to a
+// room, for clients that can't use WebSockets. Subscriptions can't send
+// commands.
+type Subscription struct {
+	c *connection
+}
+
+// Subscribe is like Register, but returns a Subscription that the caller reads
+// from, instead of taking a WebSocket connection.
+func (h *Hub) Subscribe(rm *db.Room, u *db.User, since uint64) *Subscription {
+	c := h.newConnection(rm, u, since)
+	select {
+	case h.register <- c:
+	case <-h.quit:
+		// The hub has stopped, so the subscription is over before it started.
+		close(c.send)
+	}
+	return &Subscription{c: c}
+}
+
+// Frames returns the channel that messages for the subscriber are sent on. The
+// channel is closed if the subscriber falls too far behind, or the hub stops.
+func (s *Subscription) Frames() <-chan *Frame {
+	return s.c.send
+}
+
+// Close removes the Subscription from the hub.
+func (s *Subscription) Close() {
+	s.c.h.unregisterConn(s.c)
+}
@@ -0,0 +1,84 @@
+package library
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	flacStreamInfo    = 0
+	flacVorbisComment = 4
+	flacPicture       = 6
+)
+
+// readFLAC reads the tags of a FLAC file from its metadata blocks.
+func readFLAC(r io.ReadSeeker, t *tags) error {
+	// Some taggers put an ID3v2 tag in front of FLAC files, even though
+	// they're not supposed to.
+	if _, err := readID3v2(r, t); err != nil {
+		return err
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != "fLaC" {
+		return errors.New("not a FLAC file")
+	}
+
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return err
+		}
+		last, typ := hdr[0]&0x80 != 0, hdr[0]&0x7F
+		size := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+
+		switch typ {
+		case flacStreamInfo, flacVorbisComment, flacPicture:
+			b := make([]byte, size)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return err
+			}
+			if err := parseFLACBlock(typ, b, t); err != nil {
+				return err
+			}
+		default:
+			if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+func parseFLACBlock(typ byte, b []byte, t *tags) error {
+	switch typ {
+	case flacStreamInfo:
+		if len(b) < 18 {
+			return errShort
+		}
+		// The sample rate is 20 bits, followed by 3 bits of channels, 5 bits
+		// of bits per sample, and then 36 bits of the total number of samples.
+		rate := uint64(b[10])<<12 | uint64(b[11])<<4 | uint64(b[12])>>4
+		samples := uint64(b[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(b[14:18]))
+		if rate > 0 {
+			t.duration = time.Duration(samples*1000/rate) * time.Millisecond
+		}
+	case flacVorbisComment:
+		return parseVorbisComment(b, t)
+	case flacPicture:
+		p, err := parseFLACPicture(b)
+		if err != nil {
+			return err
+		}
+		t.addPicture(p)
+	}
+	return nil
+}
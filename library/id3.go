@@ -0,0 +1,314 @@
+package library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// readID3v2 reads the ID3v2 tag at the start of r, if there is one, and
+// returns how many bytes it takes up. It leaves r at the end of the tag.
+func readID3v2(r io.ReadSeeker, t *tags) (int64, error) {
+	hdr := make([]byte, 10)
+	if _, err := io.ReadFull(r, hdr); err != nil || string(hdr[:3]) != "ID3" {
+		_, serr := r.Seek(0, io.SeekStart)
+		return 0, serr
+	}
+
+	major, flags := hdr[3], hdr[5]
+	size := int64(syncsafe(hdr[6:10]))
+	total := 10 + size
+	if major == 4 && flags&0x10 != 0 {
+		// There's a footer, which is a copy of the header.
+		total += 10
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(total, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if major < 2 || major > 4 {
+		// We don't know how to read it, but we can still skip it.
+		return total, nil
+	}
+
+	// Before v2.4, unsynchronisation applied to the whole tag at once.
+	if major < 4 && flags&0x80 != 0 {
+		body = unsync(body)
+	}
+
+	c := &cursor{b: body}
+	if flags&0x40 != 0 {
+		// Skip the extended header. In v2.3 its size doesn't include the size
+		// field itself, in v2.4 it does.
+		if major == 3 {
+			c.next(int(c.u32be()))
+		} else if major == 4 {
+			c.next(int(syncsafe(c.next(4))) - 4)
+		}
+	}
+
+	for len(c.b) > 0 && !c.short {
+		id, data, ok := nextID3Frame(c, major)
+		if !ok {
+			break
+		}
+		parseID3Frame(id, data, major, t)
+	}
+	return total, nil
+}
+
+// nextID3Frame reads the next frame of an ID3v2 tag, undoing any of the
+// frame-level encoding that we know how to. It returns false once it reaches
+// the padding at the end of the tag.
+func nextID3Frame(c *cursor, major byte) (string, []byte, bool) {
+	if major == 2 {
+		hdr := c.next(6)
+		if hdr == nil || hdr[0] == 0 {
+			return "", nil, false
+		}
+		size := int(hdr[3])<<16 | int(hdr[4])<<8 | int(hdr[5])
+		return string(hdr[:3]), c.next(size), !c.short
+	}
+
+	hdr := c.next(10)
+	if hdr == nil || hdr[0] == 0 {
+		return "", nil, false
+	}
+	id, fmtFlags := string(hdr[:4]), hdr[9]
+	size := binary.BigEndian.Uint32(hdr[4:8])
+	if major == 4 {
+		size = syncsafe(hdr[4:8])
+	}
+	data := c.next(int(size))
+	if c.short {
+		return "", nil, false
+	}
+
+	if major == 3 {
+		if fmtFlags&0xC0 != 0 {
+			// Compressed or encrypted, so skip it.
+			return id, nil, true
+		}
+		if fmtFlags&0x20 != 0 && len(data) > 0 {
+			data = data[1:] // Group ID
+		}
+		return id, data, true
+	}
+
+	if fmtFlags&0x0C != 0 {
+		return id, nil, true
+	}
+	if fmtFlags&0x40 != 0 && len(data) > 0 {
+		data = data[1:]
+	}
+	if fmtFlags&0x01 != 0 && len(data) >= 4 {
+		data = data[4:] // Data length indicator
+	}
+	if fmtFlags&0x02 != 0 {
+		data = unsync(data)
+	}
+	return id, data, true
+}
+
+func parseID3Frame(id string, data []byte, major byte, t *tags) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch id {
+	case "TIT2", "TT2":
+		if vals := decodeID3Text(data[0], data[1:]); len(vals) > 0 {
+			t.title = vals[0]
+		}
+	case "TPE1", "TP1":
+		t.artists = decodeID3Text(data[0], data[1:])
+	case "TALB", "TAL":
+		if vals := decodeID3Text(data[0], data[1:]); len(vals) > 0 {
+			t.album = vals[0]
+		}
+	case "TSRC", "TRC":
+		if vals := decodeID3Text(data[0], data[1:]); len(vals) > 0 {
+			t.isrc = strings.TrimSpace(vals[0])
+		}
+	case "TDRC", "TYER", "TYE":
+		if vals := decodeID3Text(data[0], data[1:]); len(vals) > 0 {
+			t.date = releaseDate(vals[0])
+		}
+	case "TLEN", "TLE":
+		if vals := decodeID3Text(data[0], data[1:]); len(vals) > 0 {
+			if ms, err := strconv.Atoi(strings.TrimSpace(vals[0])); err == nil && ms > 0 {
+				t.duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	case "APIC", "PIC":
+		t.addPicture(parseID3Picture(data, major))
+	}
+}
+
+func parseID3Picture(data []byte, major byte) *picture {
+	enc, c := data[0], &cursor{b: data[1:]}
+
+	var mime string
+	if major == 2 {
+		mime = string(c.next(3))
+	} else {
+		mime = string(c.next(bytes.IndexByte(c.b, 0)))
+		c.next(1)
+	}
+	kind := c.next(1)
+	if c.short || mime == "-->" {
+		// Pictures that are only a link to somewhere else aren't any use to us.
+		return nil
+	}
+
+	// Skip the description, which is terminated by a null in its own encoding.
+	if enc == 1 || enc == 2 {
+		for {
+			b := c.next(2)
+			if b == nil || (b[0] == 0 && b[1] == 0) {
+				break
+			}
+		}
+	} else if i := bytes.IndexByte(c.b, 0); i >= 0 {
+		c.next(i + 1)
+	} else {
+		return nil
+	}
+	if c.short {
+		return nil
+	}
+	return &picture{mime: imageMIME(mime, c.b), kind: uint32(kind[0]), data: c.b}
+}
+
+// decodeID3Text decodes the text of an ID3v2 text frame. There can be
+// several values, separated by nulls.
+func decodeID3Text(enc byte, b []byte) []string {
+	var vals []string
+	switch enc {
+	case 0:
+		// ISO-8859-1, where every byte is the code point.
+		for _, v := range bytes.Split(b, []byte{0}) {
+			rs := make([]rune, len(v))
+			for i, c := range v {
+				rs[i] = rune(c)
+			}
+			vals = append(vals, string(rs))
+		}
+	case 1, 2:
+		for _, v := range splitUTF16(b) {
+			vals = append(vals, decodeUTF16(v, enc == 2))
+		}
+	default:
+		for _, v := range bytes.Split(b, []byte{0}) {
+			vals = append(vals, string(v))
+		}
+	}
+
+	// Drop the empty value after a trailing null.
+	for len(vals) > 0 && vals[len(vals)-1] == "" {
+		vals = vals[:len(vals)-1]
+	}
+	return vals
+}
+
+// splitUTF16 splits UTF-16 text on null characters.
+func splitUTF16(b []byte) [][]byte {
+	var (
+		vals  [][]byte
+		start int
+	)
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			vals = append(vals, b[start:i])
+			start = i + 2
+		}
+	}
+	return append(vals, b[start:len(b)&^1])
+}
+
+// decodeUTF16 decodes UTF-16 text, using its byte order mark if it has one.
+// Text without one is assumed to be little endian, unless bigEndian is set,
+// since that's what most taggers write.
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xFF && b[1] == 0xFE:
+			b, bigEndian = b[2:], false
+		case b[0] == 0xFE && b[1] == 0xFF:
+			b, bigEndian = b[2:], true
+		}
+	}
+
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		} else {
+			units[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// readID3v1 reads the ID3v1 tag at the end of a file, if there is one, and
+// only fills in what the tags don't already have. It returns how many bytes
+// the tag takes up.
+func readID3v1(r io.ReadSeeker, size int64, t *tags) int64 {
+	if size < 128 {
+		return 0
+	}
+	b := make([]byte, 128)
+	if _, err := r.Seek(size-128, io.SeekStart); err != nil {
+		return 0
+	}
+	if _, err := io.ReadFull(r, b); err != nil || string(b[:3]) != "TAG" {
+		return 0
+	}
+
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		vals := decodeID3Text(0, b)
+		if len(vals) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(vals[0])
+	}
+	if t.title == "" {
+		t.title = field(b[3:33])
+	}
+	if len(t.artists) == 0 {
+		if a := field(b[33:63]); a != "" {
+			t.artists = []string{a}
+		}
+	}
+	if t.album == "" {
+		t.album = field(b[63:93])
+	}
+	return 128
+}
+
+// syncsafe decodes a 28-bit integer stored in the low seven bits of four
+// bytes.
+func syncsafe(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// unsync undoes ID3v2 unsynchronisation, which inserts a zero byte after
+// every 0xFF.
+func unsync(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
@@ -0,0 +1,402 @@
+// Package library serves tracks from a directory of local music files, for
+// when there's no connection to reach Spotify.
+package library
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	// Register the formats album art comes in, so we can read its size.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bcspragu/Radiotation/radio"
+)
+
+// Provider is the name of the Library in the tracks it returns.
+const Provider = "library"
+
+// maxTopTracks is the most tracks returned for an artist, which matches what
+// Spotify returns.
+const maxTopTracks = 10
+
+var (
+	ErrNotFound       = fmt.Errorf("library: track %w", radio.ErrNotFound)
+	ErrArtistNotFound = fmt.Errorf("library: artist %w", radio.ErrNotFound)
+	ErrNoArt          = errors.New("library: track has no album art")
+)
+
+// Options configure a Library.
+type Options struct {
+	// ArtURL is put in front of a track's ID to make the URL of its album art.
+	// It defaults to "/api/art/".
+	ArtURL string
+}
+
+// Library is a radio.SongServer for a directory of MP3, FLAC and Ogg files.
+// The directory is scanned once, when the Library is created.
+type Library struct {
+	dir     string
+	artURL  string
+	tracks  map[string]*entry
+	ordered []*entry
+
+	artists        map[string]*artistEntry
+	orderedArtists []*artistEntry
+}
+
+// artistEntry is an artist, and their tracks in the library's order.
+type artistEntry struct {
+	artist radio.Artist
+	// name is lowercased, for searches.
+	name   string
+	tracks []*entry
+}
+
+type entry struct {
+	track radio.Track
+	// path is relative to the library's directory.
+	path string
+
+	// The lowercased fields that searches are matched against.
+	name, artists, album string
+}
+
+// New scans dir and everything under it for music files, and indexes their
+// tags. Files that can't be read are logged and skipped.
+func New(dir string, opts *Options) (*Library, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.ArtURL == "" {
+		opts.ArtURL = "/api/art/"
+	}
+
+	l := &Library{
+		dir:     dir,
+		artURL:  opts.ArtURL,
+		tracks:  make(map[string]*entry),
+		artists: make(map[string]*artistEntry),
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !supported(path) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		e, err := l.load(rel)
+		if err != nil {
+			log.Printf("Skipping %s: %v", path, err)
+			return nil
+		}
+		l.tracks[e.track.ID] = e
+		l.ordered = append(l.ordered, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan library: %v", err)
+	}
+
+	sort.Slice(l.ordered, func(i, j int) bool {
+		a, b := l.ordered[i], l.ordered[j]
+		if a.artists != b.artists {
+			return a.artists < b.artists
+		}
+		if a.album != b.album {
+			return a.album < b.album
+		}
+		return a.path < b.path
+	})
+
+	for _, e := range l.ordered {
+		for _, a := range e.track.Artists {
+			ae, ok := l.artists[a.ID]
+			if !ok {
+				ae = &artistEntry{artist: a, name: strings.ToLower(a.Name)}
+				l.artists[a.ID] = ae
+				l.orderedArtists = append(l.orderedArtists, ae)
+			}
+			ae.tracks = append(ae.tracks, e)
+		}
+	}
+	sort.Slice(l.orderedArtists, func(i, j int) bool {
+		return l.orderedArtists[i].name < l.orderedArtists[j].name
+	})
+
+	return l, nil
+}
+
+// supported returns true if the file looks like a kind of music file we can
+// read.
+func supported(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3", ".flac", ".ogg", ".oga", ".opus":
+		return true
+	}
+	return false
+}
+
+// trackID returns the ID for the file at the given path, relative to the
+// library's directory. It only depends on the path, so IDs stay the same
+// between scans, and if the whole library moves.
+func trackID(rel string) string {
+	sum := sha256.Sum256([]byte(filepath.ToSlash(rel)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// artistID returns the ID for an artist. Tags don't always agree on the case
+// of a name, so it doesn't matter.
+func artistID(name string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(name)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (l *Library) load(rel string) (*entry, error) {
+	t, err := readFile(filepath.Join(l.dir, rel))
+	if err != nil {
+		return nil, err
+	}
+
+	if t.title == "" {
+		base := filepath.Base(rel)
+		t.title = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	id := trackID(rel)
+	tr := radio.Track{
+		ID:          id,
+		Name:        t.title,
+		Album:       radio.Album{Name: t.album, ReleaseDate: t.date},
+		DurationMS:  int(t.duration.Milliseconds()),
+		ExternalIDs: radio.ExternalIDs{ISRC: t.isrc},
+		Provider:    Provider,
+	}
+	for _, a := range t.artists {
+		tr.Artists = append(tr.Artists, radio.Artist{ID: artistID(a), Name: a})
+	}
+	if t.pic != nil {
+		img := radio.Image{URL: l.artURL + id}
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(t.pic.data)); err == nil {
+			img.Width, img.Height = cfg.Width, cfg.Height
+		}
+		tr.Album.Images = []radio.Image{img}
+	}
+
+	return &entry{
+		track:   tr,
+		path:    rel,
+		name:    strings.ToLower(t.title),
+		artists: strings.ToLower(strings.Join(t.artists, " ")),
+		album:   strings.ToLower(t.album),
+	}, nil
+}
+
+// readFile reads the tags from the music file at path.
+func readFile(path string) (*tags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tags{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		err = readMP3(f, fi.Size(), t)
+	case ".flac":
+		err = readFLAC(f, t)
+	case ".ogg", ".oga", ".opus":
+		err = readOgg(f, fi.Size(), t)
+	default:
+		err = errors.New("unsupported file type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Search returns the tracks or the artists where every word of the query
+// appears. For tracks, that's in the name, artists or album, and matches on
+// the name come first, then matches on the artists, then on the album. There
+// are no albums or playlists.
+func (l *Library) Search(ctx context.Context, query string, opts *radio.SearchOptions) (*radio.SearchResults, error) {
+	o := opts.WithDefaults()
+	res := &radio.SearchResults{}
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return res, nil
+	}
+
+	switch o.Type {
+	case radio.SearchTracks:
+		ts := l.searchTracks(terms)
+		start, end := o.Page(len(ts))
+		res.Tracks, res.Total = ts[start:end], len(ts)
+	case radio.SearchArtists:
+		var as []radio.Artist
+		for _, ae := range l.orderedArtists {
+			if containsAll(ae.name, terms) {
+				as = append(as, ae.artist)
+			}
+		}
+		start, end := o.Page(len(as))
+		res.Artists, res.Total = as[start:end], len(as)
+	}
+	return res, nil
+}
+
+// searchTracks returns every track that matches the search terms, best match
+// first.
+func (l *Library) searchTracks(terms []string) []radio.Track {
+	type match struct {
+		e     *entry
+		score int
+	}
+	var matches []match
+	for _, e := range l.ordered {
+		if score, ok := e.score(terms); ok {
+			matches = append(matches, match{e: e, score: score})
+		}
+	}
+
+	// The entries are already in order, so ties keep it.
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	ts := make([]radio.Track, len(matches))
+	for i, m := range matches {
+		ts[i] = m.e.track
+	}
+	return ts
+}
+
+// containsAll returns true if every one of the terms is in s.
+func containsAll(s string, terms []string) bool {
+	for _, term := range terms {
+		if !strings.Contains(s, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// score returns how well the entry matches the search terms, and false if
+// any of the terms don't match at all.
+func (e *entry) score(terms []string) (int, bool) {
+	score := 0
+	for _, term := range terms {
+		switch {
+		case strings.Contains(e.name, term):
+			score += 3
+		case strings.Contains(e.artists, term):
+			score += 2
+		case strings.Contains(e.album, term):
+			score++
+		default:
+			return 0, false
+		}
+	}
+	return score, true
+}
+
+// Track returns the track with the given ID.
+func (l *Library) Track(ctx context.Context, id string) (radio.Track, error) {
+	e, ok := l.tracks[id]
+	if !ok {
+		return radio.Track{}, ErrNotFound
+	}
+	return e.track, nil
+}
+
+// ArtistTopTracks returns the artist's first tracks in the library, since
+// there's nothing to say which are the most popular. The market is ignored.
+func (l *Library) ArtistTopTracks(ctx context.Context, artistID, market string) ([]radio.Track, error) {
+	ae, ok := l.artists[artistID]
+	if !ok {
+		return nil, ErrArtistNotFound
+	}
+
+	n := len(ae.tracks)
+	if n > maxTopTracks {
+		n = maxTopTracks
+	}
+	ts := make([]radio.Track, n)
+	for i := range ts {
+		ts[i] = ae.tracks[i].track
+	}
+	return ts, nil
+}
+
+// Open opens the file for the track with the given ID, and returns it along
+// with its MIME type. The caller should close it.
+func (l *Library) Open(id string) (*os.File, string, error) {
+	e, ok := l.tracks[id]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+
+	f, err := os.Open(filepath.Join(l.dir, e.path))
+	if err != nil {
+		return nil, "", err
+	}
+	return f, audioMIME(e.path), nil
+}
+
+// audioMIME returns the MIME type of a music file, which the standard
+// library doesn't know about for all of the files we support.
+func audioMIME(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return "audio/mpeg"
+	case ".flac":
+		return "audio/flac"
+	case ".opus":
+		return "audio/ogg; codecs=opus"
+	default:
+		return "audio/ogg"
+	}
+}
+
+// Art returns the album art embedded in the track with the given ID, and its
+// MIME type. It's read from the file each time, instead of being kept in
+// memory for every track.
+func (l *Library) Art(id string) (string, []byte, error) {
+	e, ok := l.tracks[id]
+	if !ok {
+		return "", nil, ErrNotFound
+	}
+
+	t, err := readFile(filepath.Join(l.dir, e.path))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read %s: %v", e.path, err)
+	}
+	if t.pic == nil {
+		return "", nil, ErrNoArt
+	}
+	return t.pic.mime, t.pic.data, nil
+}
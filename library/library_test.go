@@ -0,0 +1,479 @@
+package library
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLibrary(t *testing.T) {
+	art := pngImage(t, 3, 2)
+	files := map[string][]byte{
+		// ID3v2.3 with UTF-16 text, album art and a Xing header: 1000 frames
+		// of 1152 samples at 44.1kHz.
+		"Russ/Do It Myself.mp3": concat(
+			id3v2(3,
+				id3Frame(3, "TIT2", id3Text(1, "Do It Myself")),
+				id3Frame(3, "TPE1", id3Text(1, "Russ")),
+				id3Frame(3, "TALB", id3Text(0, "There's Really a Wolf")),
+				id3Frame(3, "APIC", concat([]byte{0}, []byte("image/png\x00"), []byte{frontCover}, []byte("cover\x00"), art)),
+			),
+			mpegFrame(1000),
+		),
+		// ID3v2.4 with several artists, a length frame, an ISRC and a
+		// recording time.
+		"Various/Collab.mp3": concat(
+			id3v2(4,
+				id3Frame(4, "TIT2", id3Text(3, "Collab")),
+				id3Frame(4, "TPE1", id3Text(3, "Alice\x00Bob")),
+				id3Frame(4, "TLEN", id3Text(3, "90000")),
+				id3Frame(4, "TSRC", id3Text(3, "USRC17607839")),
+				id3Frame(4, "TDRC", id3Text(3, "2019-06-21T12:00")),
+			),
+			mpegFrame(0),
+		),
+		// Only an ID3v1 tag, on a constant bitrate file.
+		"old.mp3": concat(mpegFrame(0), make([]byte, 16000-36), id3v1("Old Song", "Old Band", "Old Album")),
+		"Steely Dan/Can't Buy a Thrill/Do It Again.flac": flacFile(art),
+		"Elevation Worship/There Is a Cloud.ogg":         oggFile("TITLE=There Is a Cloud", "ARTIST=Elevation Worship", "ALBUM=Here as in Heaven", "DATE=2016", "ISRC=USQX91600001"),
+		// Untagged, so the name comes from the file.
+		"untagged.ogg": oggFile(),
+		"notes.txt":    []byte("not music"),
+		"broken.flac":  []byte("fLaC"),
+	}
+
+	dir := writeFiles(t, files)
+	l, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	artImage := []radio.Image{{Width: 3, Height: 2}}
+	tests := []struct {
+		path string
+		want radio.Track
+	}{
+		{
+			path: "Russ/Do It Myself.mp3",
+			want: radio.Track{
+				Name:       "Do It Myself",
+				Artists:    []radio.Artist{{Name: "Russ"}},
+				Album:      radio.Album{Name: "There's Really a Wolf", Images: artImage},
+				DurationMS: 26122,
+			},
+		},
+		{
+			path: "Various/Collab.mp3",
+			want: radio.Track{
+				Name:        "Collab",
+				Artists:     []radio.Artist{{Name: "Alice"}, {Name: "Bob"}},
+				Album:       radio.Album{ReleaseDate: "2019-06-21"},
+				DurationMS:  90000,
+				ExternalIDs: radio.ExternalIDs{ISRC: "USRC17607839"},
+			},
+		},
+		{
+			path: "old.mp3",
+			want: radio.Track{
+				Name:       "Old Song",
+				Artists:    []radio.Artist{{Name: "Old Band"}},
+				Album:      radio.Album{Name: "Old Album"},
+				DurationMS: 1000,
+			},
+		},
+		{
+			path: "Steely Dan/Can't Buy a Thrill/Do It Again.flac",
+			want: radio.Track{
+				Name:       "Do It Again",
+				Artists:    []radio.Artist{{Name: "Steely Dan"}},
+				Album:      radio.Album{Name: "Can't Buy a Thrill", Images: artImage},
+				DurationMS: 180000,
+			},
+		},
+		{
+			path: "Elevation Worship/There Is a Cloud.ogg",
+			want: radio.Track{
+				Name:        "There Is a Cloud",
+				Artists:     []radio.Artist{{Name: "Elevation Worship"}},
+				Album:       radio.Album{Name: "Here as in Heaven", ReleaseDate: "2016"},
+				DurationMS:  60000,
+				ExternalIDs: radio.ExternalIDs{ISRC: "USQX91600001"},
+			},
+		},
+		{
+			path: "untagged.ogg",
+			want: radio.Track{Name: "untagged", DurationMS: 60000},
+		},
+	}
+
+	for _, tc := range tests {
+		id := trackID(tc.path)
+		tc.want.ID = id
+		tc.want.Provider = Provider
+		for i, a := range tc.want.Artists {
+			tc.want.Artists[i].ID = artistID(a.Name)
+		}
+		for i := range tc.want.Album.Images {
+			tc.want.Album.Images[i].URL = "/api/art/" + id
+		}
+
+		got, err := l.Track(context.Background(), id)
+		if err != nil {
+			t.Errorf("Track(%q): %v", tc.path, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Track(%q) (-want +got)\n%s", tc.path, diff)
+		}
+	}
+
+	if n := len(l.tracks); n != len(tests) {
+		t.Errorf("library has %d tracks, want %d", n, len(tests))
+	}
+	if _, err := l.Track(context.Background(), "nope"); err != ErrNotFound {
+		t.Errorf("Track(nope) = %v, want %v", err, ErrNotFound)
+	}
+
+	t.Run("Search", func(t *testing.T) {
+		searches := []struct {
+			query     string
+			opts      *radio.SearchOptions
+			want      []string
+			wantTotal int
+		}{
+			{"", nil, nil, 0},
+			{"nothing matches", nil, nil, 0},
+			// Name matches come before artist matches.
+			{"do it", nil, []string{"Do It Myself", "Do It Again"}, 2},
+			{"DAN", nil, []string{"Do It Again"}, 1},
+			{"old", nil, []string{"Old Song"}, 1},
+			{"wolf russ", nil, []string{"Do It Myself"}, 1},
+			{"alice", nil, []string{"Collab"}, 1},
+			// Pages.
+			{"do it", &radio.SearchOptions{Limit: 1}, []string{"Do It Myself"}, 2},
+			{"do it", &radio.SearchOptions{Limit: 1, Offset: 1}, []string{"Do It Again"}, 2},
+			{"do it", &radio.SearchOptions{Offset: 2}, nil, 2},
+			// Artists.
+			{"o", &radio.SearchOptions{Type: radio.SearchArtists}, []string{"Bob", "Elevation Worship", "Old Band"}, 3},
+			{"dan", &radio.SearchOptions{Type: radio.SearchArtists}, []string{"Steely Dan"}, 1},
+			// There aren't any playlists.
+			{"do it", &radio.SearchOptions{Type: radio.SearchPlaylists}, nil, 0},
+		}
+		for _, s := range searches {
+			res, err := l.Search(context.Background(), s.query, s.opts)
+			if err != nil {
+				t.Fatalf("Search(%q): %v", s.query, err)
+			}
+			var got []string
+			for _, tr := range res.Tracks {
+				got = append(got, tr.Name)
+			}
+			for _, a := range res.Artists {
+				got = append(got, a.Name)
+			}
+			if diff := cmp.Diff(s.want, got); diff != "" {
+				t.Errorf("Search(%q, %+v) (-want +got)\n%s", s.query, s.opts, diff)
+			}
+			if res.Total != s.wantTotal {
+				t.Errorf("Search(%q, %+v) has %d results in total, want %d", s.query, s.opts, res.Total, s.wantTotal)
+			}
+		}
+	})
+
+	t.Run("ArtistTopTracks", func(t *testing.T) {
+		ts, err := l.ArtistTopTracks(context.Background(), artistID("steely dan"), "")
+		if err != nil {
+			t.Fatalf("ArtistTopTracks: %v", err)
+		}
+		if len(ts) != 1 || ts[0].Name != "Do It Again" {
+			t.Errorf("ArtistTopTracks = %v, want Do It Again", ts)
+		}
+
+		if _, err := l.ArtistTopTracks(context.Background(), "nope", ""); err != ErrArtistNotFound {
+			t.Errorf("ArtistTopTracks(nope) = %v, want %v", err, ErrArtistNotFound)
+		}
+	})
+
+	t.Run("Art", func(t *testing.T) {
+		for _, path := range []string{"Russ/Do It Myself.mp3", "Steely Dan/Can't Buy a Thrill/Do It Again.flac"} {
+			mime, data, err := l.Art(trackID(path))
+			if err != nil {
+				t.Fatalf("Art(%q): %v", path, err)
+			}
+			if mime != "image/png" || !bytes.Equal(data, art) {
+				t.Errorf("Art(%q) = %q with %d bytes, want the PNG", path, mime, len(data))
+			}
+		}
+
+		if _, _, err := l.Art(trackID("old.mp3")); err != ErrNoArt {
+			t.Errorf("Art(old.mp3) = %v, want %v", err, ErrNoArt)
+		}
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		path := "Steely Dan/Can't Buy a Thrill/Do It Again.flac"
+		f, mime, err := l.Open(trackID(path))
+		if err != nil {
+			t.Fatalf("Open(%q): %v", path, err)
+		}
+		defer f.Close()
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if mime != "audio/flac" || !bytes.Equal(data, files[path]) {
+			t.Errorf("Open(%q) = %q with %d bytes, want the whole FLAC file", path, mime, len(data))
+		}
+
+		if _, _, err := l.Open("nope"); err != ErrNotFound {
+			t.Errorf("Open(nope) = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("StableIDs", func(t *testing.T) {
+		// The same files somewhere else get the same IDs.
+		other, err := New(writeFiles(t, files), nil)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		for id := range l.tracks {
+			if _, err := other.Track(context.Background(), id); err != nil {
+				t.Errorf("Track(%q) in the other library: %v", id, err)
+			}
+		}
+	})
+}
+
+func writeFiles(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return dir
+}
+
+func pngImage(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+func u32be(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func u32le(n int) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+func id3v2(major byte, frames ...[]byte) []byte {
+	body := concat(frames...)
+	// Add some padding, like taggers do.
+	body = append(body, make([]byte, 32)...)
+	return concat([]byte{'I', 'D', '3', major, 0, 0}, syncsafeBytes(len(body)), body)
+}
+
+func id3Frame(major byte, id string, data []byte) []byte {
+	size := u32be(len(data))
+	if major == 4 {
+		size = syncsafeBytes(len(data))
+	}
+	return concat([]byte(id), size, []byte{0, 0}, data)
+}
+
+func id3Text(enc byte, s string) []byte {
+	if enc != 1 {
+		return concat([]byte{enc}, []byte(s))
+	}
+	b := []byte{enc, 0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+func id3v1(title, artist, album string) []byte {
+	b := make([]byte, 128)
+	copy(b, "TAG")
+	copy(b[3:33], title)
+	copy(b[33:63], artist)
+	copy(b[63:93], album)
+	return b
+}
+
+// mpegFrame returns an MPEG-1 Layer III frame at 128kbps and 44.1kHz, with a
+// Xing header if frames isn't zero.
+func mpegFrame(frames int) []byte {
+	b := concat([]byte{0xFF, 0xFB, 0x90, 0x64}, make([]byte, 32))
+	if frames > 0 {
+		b = concat(b, []byte("Xing"), u32be(1), u32be(frames))
+	}
+	return b
+}
+
+func flacFile(art []byte) []byte {
+	// 44.1kHz, stereo, 16 bits per sample, with three minutes of samples.
+	info := make([]byte, 34)
+	rate, samples := 44100, 44100*180
+	info[10] = byte(rate >> 12)
+	info[11] = byte(rate >> 4)
+	info[12] = byte(rate<<4) | 1<<1
+	info[13] = 15<<4 | byte(samples>>32)
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+
+	block := func(typ byte, last bool, data []byte) []byte {
+		if last {
+			typ |= 0x80
+		}
+		n := len(data)
+		return concat([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)}, data)
+	}
+
+	return concat(
+		[]byte("fLaC"),
+		block(flacStreamInfo, false, info),
+		block(1, false, make([]byte, 64)), // Padding
+		block(flacVorbisComment, false, vorbisComment("TITLE=Do It Again", "artist=Steely Dan", "ALBUM=Can't Buy a Thrill")),
+		block(flacPicture, true, flacPictureBlock(art)),
+		[]byte("audio frames"),
+	)
+}
+
+func flacPictureBlock(art []byte) []byte {
+	return concat(
+		u32be(frontCover),
+		u32be(len("image/png")), []byte("image/png"),
+		u32be(0),
+		u32be(3), u32be(2), u32be(8), u32be(0),
+		u32be(len(art)), art,
+	)
+}
+
+func vorbisComment(fields ...string) []byte {
+	b := concat(u32le(len("test")), []byte("test"), u32le(len(fields)))
+	for _, f := range fields {
+		b = concat(b, u32le(len(f)), []byte(f))
+	}
+	return b
+}
+
+// oggFile returns an Ogg Vorbis file with a minute of audio, and the given
+// comments.
+func oggFile(comments ...string) []byte {
+	id := concat([]byte("\x01vorbis"), u32le(0), []byte{2}, u32le(44100), make([]byte, 13))
+	comment := concat([]byte("\x03vorbis"), vorbisComment(comments...), []byte{1})
+	// A comment big enough to span pages, which has to be put back together.
+	comment = concat(comment, make([]byte, 70000))
+
+	return concat(
+		oggPage(0, id),
+		oggPage(0, comment),
+		oggPage(44100*30, make([]byte, 100)),
+		oggPage(44100*60, make([]byte, 100)),
+	)
+}
+
+// oggPage returns an Ogg page holding the whole packet. Packets that are too
+// big for one page are split over several, like a real encoder would.
+func oggPage(granule int64, packet []byte) []byte {
+	var out []byte
+	for {
+		var lacing []byte
+		n := len(packet)
+		for len(lacing) < 255 && n >= 255 {
+			lacing = append(lacing, 255)
+			n -= 255
+		}
+		done := len(lacing) < 255
+		if done {
+			lacing = append(lacing, byte(n))
+		}
+
+		size := 0
+		for _, l := range lacing {
+			size += int(l)
+		}
+
+		g := make([]byte, 8)
+		binary.LittleEndian.PutUint64(g, uint64(granule))
+		if !done {
+			binary.LittleEndian.PutUint64(g, ^uint64(0))
+		}
+		hdr := concat([]byte("OggS"), []byte{0, 0}, g, make([]byte, 12), []byte{byte(len(lacing))})
+		out = concat(out, hdr, lacing, packet[:size])
+		packet = packet[size:]
+		if done {
+			return out
+		}
+	}
+}
+
+func TestDecodeID3Text(t *testing.T) {
+	tests := []struct {
+		enc  byte
+		data []byte
+		want []string
+	}{
+		{0, []byte("caf\xe9\x00"), []string{"café"}},
+		{3, []byte("café\x00"), []string{"café"}},
+		// UTF-16 with a byte order mark on each value.
+		{1, concat(id3Text(1, "Alice")[1:], []byte{0, 0}, id3Text(1, "Bob")[1:]), []string{"Alice", "Bob"}},
+		// UTF-16BE, without a byte order mark.
+		{2, []byte{0, 'h', 0, 'i'}, []string{"hi"}},
+	}
+
+	for _, tc := range tests {
+		if diff := cmp.Diff(tc.want, decodeID3Text(tc.enc, tc.data)); diff != "" {
+			t.Errorf("decodeID3Text(%d, %q) (-want +got)\n%s", tc.enc, tc.data, diff)
+		}
+	}
+}
+
+func TestOggPicture(t *testing.T) {
+	art := pngImage(t, 1, 1)
+	b64 := base64.StdEncoding.EncodeToString(flacPictureBlock(art))
+
+	var tg tags
+	if err := parseVorbisComment(vorbisComment("METADATA_BLOCK_PICTURE="+b64), &tg); err != nil {
+		t.Fatalf("parseVorbisComment: %v", err)
+	}
+	if tg.pic == nil || tg.pic.mime != "image/png" || !bytes.Equal(tg.pic.data, art) {
+		t.Errorf("pic = %+v, want the PNG", tg.pic)
+	}
+}
@@ -0,0 +1,131 @@
+package library
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+var (
+	// Layer III bitrates in kbps, by bitrate index.
+	mpeg1Bitrates = [15]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	mpeg2Bitrates = [15]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+
+	mpeg1SampleRates = [3]int{44100, 48000, 32000}
+)
+
+// readMP3 reads the tags of an MP3 file of the given size.
+func readMP3(r io.ReadSeeker, size int64, t *tags) error {
+	start, err := readID3v2(r, t)
+	if err != nil {
+		return err
+	}
+	end := size - readID3v1(r, size, t)
+
+	if t.duration == 0 {
+		t.duration = mp3Duration(r, start, end)
+	}
+	return nil
+}
+
+// mp3Duration works out how long the MPEG audio between start and end is,
+// from the header of its first frame. That's exact if the encoder wrote a
+// Xing or VBRI header with the number of frames, and a good estimate for
+// constant bitrate files otherwise. It returns zero if it can't find a frame.
+func mp3Duration(r io.ReadSeeker, start, end int64) time.Duration {
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return 0
+	}
+	buf := make([]byte, 64<<10)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		h, ok := parseMPEGHeader(buf[i:])
+		if !ok {
+			continue
+		}
+
+		if frames := vbrFrames(buf[i:], h); frames > 0 {
+			return time.Duration(frames) * time.Duration(h.samplesPerFrame) * time.Second / time.Duration(h.sampleRate)
+		}
+		audio := end - start - int64(i)
+		if audio <= 0 {
+			return 0
+		}
+		return time.Duration(audio*8) * time.Second / time.Duration(h.bitrate*1000)
+	}
+	return 0
+}
+
+type mpegHeader struct {
+	mpeg1           bool
+	mono            bool
+	bitrate         int // kbps
+	sampleRate      int
+	samplesPerFrame int
+}
+
+// parseMPEGHeader parses the four byte header of an MPEG Layer III frame.
+func parseMPEGHeader(b []byte) (*mpegHeader, bool) {
+	version := (b[1] >> 3) & 3
+	layer := (b[1] >> 1) & 3
+	bitrateIdx := b[2] >> 4
+	srIdx := (b[2] >> 2) & 3
+	if version == 1 || layer != 1 || bitrateIdx == 0 || bitrateIdx == 15 || srIdx == 3 {
+		return nil, false
+	}
+
+	h := &mpegHeader{
+		mpeg1:      version == 3,
+		mono:       b[3]>>6 == 3,
+		sampleRate: mpeg1SampleRates[srIdx],
+	}
+	if h.mpeg1 {
+		h.bitrate = mpeg1Bitrates[bitrateIdx]
+		h.samplesPerFrame = 1152
+	} else {
+		h.bitrate = mpeg2Bitrates[bitrateIdx]
+		h.samplesPerFrame = 576
+		h.sampleRate /= 2
+		if version == 0 {
+			// MPEG 2.5
+			h.sampleRate /= 2
+		}
+	}
+	return h, true
+}
+
+// vbrFrames returns the number of frames in the file, from the Xing or VBRI
+// header in the first frame, or zero if it doesn't have one.
+func vbrFrames(frame []byte, h *mpegHeader) uint32 {
+	// The Xing header comes right after the side information, which is a
+	// different size depending on the version and channels.
+	side := 32
+	switch {
+	case h.mpeg1 && h.mono:
+		side = 17
+	case !h.mpeg1 && !h.mono:
+		side = 17
+	case !h.mpeg1 && h.mono:
+		side = 9
+	}
+
+	c := &cursor{b: frame}
+	c.next(4 + side)
+	if id := string(c.next(4)); id == "Xing" || id == "Info" {
+		if flags := c.u32be(); flags&1 != 0 && !c.short {
+			return c.u32be()
+		}
+		return 0
+	}
+
+	// VBRI headers are always 32 bytes after the frame header.
+	if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+		return binary.BigEndian.Uint32(frame[36+14:])
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package library
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	oggHeaderSize = 27
+	// maxOggPacket is the largest header packet we'll read, which is mostly
+	// there for album art.
+	maxOggPacket = 16 << 20
+	// oggTailSize is how much of the end of the file we look through to find
+	// the last page.
+	oggTailSize = 64 << 10
+)
+
+// readOgg reads the tags of an Ogg Vorbis or Opus file of the given size. Only
+// the first logical stream is read, which is all music files have.
+func readOgg(r io.ReadSeeker, size int64, t *tags) error {
+	packets, err := oggHeaderPackets(bufio.NewReader(r), 2)
+	if err != nil {
+		return err
+	}
+	id, comment := packets[0], packets[1]
+
+	var rate, preSkip int64
+	switch {
+	case bytes.HasPrefix(id, []byte("\x01vorbis")) && len(id) >= 16:
+		if !bytes.HasPrefix(comment, []byte("\x03vorbis")) {
+			return errors.New("missing Vorbis comment header")
+		}
+		rate = int64(binary.LittleEndian.Uint32(id[12:16]))
+		comment = comment[7:]
+	case bytes.HasPrefix(id, []byte("OpusHead")) && len(id) >= 12:
+		if !bytes.HasPrefix(comment, []byte("OpusTags")) {
+			return errors.New("missing Opus tags header")
+		}
+		// Opus granule positions are always at 48kHz, whatever the input was.
+		rate, preSkip = 48000, int64(binary.LittleEndian.Uint16(id[10:12]))
+		comment = comment[8:]
+	default:
+		return errors.New("not an Ogg Vorbis or Opus file")
+	}
+
+	if err := parseVorbisComment(comment, t); err != nil {
+		return err
+	}
+
+	if granule := lastGranule(r, size); rate > 0 && granule > preSkip {
+		t.duration = time.Duration((granule-preSkip)*1000/rate) * time.Millisecond
+	}
+	return nil
+}
+
+// oggHeaderPackets reads the first n packets of an Ogg stream.
+func oggHeaderPackets(r io.Reader, n int) ([][]byte, error) {
+	var (
+		packets [][]byte
+		cur     []byte
+		hdr     = make([]byte, oggHeaderSize)
+	)
+	for len(packets) < n {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, err
+		}
+		if string(hdr[:4]) != "OggS" {
+			return nil, errors.New("not an Ogg file")
+		}
+
+		lacing := make([]byte, hdr[26])
+		if _, err := io.ReadFull(r, lacing); err != nil {
+			return nil, err
+		}
+		for _, l := range lacing {
+			seg := make([]byte, l)
+			if _, err := io.ReadFull(r, seg); err != nil {
+				return nil, err
+			}
+			cur = append(cur, seg...)
+			if len(cur) > maxOggPacket {
+				return nil, errors.New("Ogg header packet is too big")
+			}
+			// A segment shorter than 255 bytes ends the packet, anything
+			// else means it carries on in the next segment.
+			if l < 255 {
+				packets = append(packets, cur)
+				cur = nil
+			}
+		}
+	}
+	return packets[:n], nil
+}
+
+// lastGranule returns the granule position of the last page in the file,
+// which is the number of samples in the stream. It returns zero if it can't
+// find one.
+func lastGranule(r io.ReadSeeker, size int64) int64 {
+	off := size - oggTailSize
+	if off < 0 {
+		off = 0
+	}
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return 0
+	}
+	tail, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0
+	}
+
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		if i+oggHeaderSize > len(tail) {
+			continue
+		}
+		// Pages where no packet finishes have a granule position of -1.
+		if g := int64(binary.LittleEndian.Uint64(tail[i+6:])); g >= 0 {
+			return g
+		}
+	}
+	return 0
+}
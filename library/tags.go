@@ -0,0 +1,169 @@
+package library
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// frontCover is the ID3v2 and FLAC picture type for the front cover of the
+// album.
+const frontCover = 3
+
+var errShort = errors.New("tag data is truncated")
+
+// tags is the metadata read from a music file.
+type tags struct {
+	title    string
+	artists  []string
+	album    string
+	isrc     string
+	date     string
+	duration time.Duration
+	pic      *picture
+}
+
+// releaseDate trims a date from a tag down to the date, in the same format
+// Spotify uses, which is 2006-01-02, 2006-01 or 2006. Taggers sometimes
+// include the time too.
+func releaseDate(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, "T "); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) > len("2006-01-02") {
+		s = s[:len("2006-01-02")]
+	}
+	return s
+}
+
+// picture is album art embedded in a music file.
+type picture struct {
+	mime string
+	// kind is the ID3v2/FLAC picture type.
+	kind uint32
+	data []byte
+}
+
+// addPicture keeps the front cover if there is one, and the first picture
+// otherwise.
+func (t *tags) addPicture(p *picture) {
+	if p == nil || len(p.data) == 0 {
+		return
+	}
+	if t.pic == nil || (t.pic.kind != frontCover && p.kind == frontCover) {
+		t.pic = p
+	}
+}
+
+// imageMIME works out the MIME type of an image, preferring what the data
+// looks like over what the file says it is, since taggers often get it wrong.
+func imageMIME(declared string, data []byte) string {
+	if sniffed := http.DetectContentType(data); strings.HasPrefix(sniffed, "image/") {
+		return sniffed
+	}
+
+	declared = strings.ToLower(strings.TrimSpace(declared))
+	switch declared {
+	case "jpg", "jpeg", "image/jpg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	}
+	if !strings.Contains(declared, "/") {
+		return "image/" + declared
+	}
+	return declared
+}
+
+// cursor reads fields from a byte slice, and remembers if it ran off the end,
+// so callers can check once at the end instead of after every field.
+type cursor struct {
+	b     []byte
+	short bool
+}
+
+func (c *cursor) next(n int) []byte {
+	if n < 0 || n > len(c.b) {
+		c.short, c.b = true, nil
+		return nil
+	}
+	v := c.b[:n]
+	c.b = c.b[n:]
+	return v
+}
+
+func (c *cursor) u32le() uint32 {
+	b := c.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (c *cursor) u32be() uint32 {
+	b := c.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// parseVorbisComment reads a Vorbis comment block, which FLAC and Ogg files
+// both use for their tags.
+func parseVorbisComment(b []byte, t *tags) error {
+	c := &cursor{b: b}
+	c.next(int(c.u32le())) // Vendor string
+	n := c.u32le()
+	for i := uint32(0); i < n && !c.short; i++ {
+		field := c.next(int(c.u32le()))
+		eq := strings.IndexByte(string(field), '=')
+		if eq < 0 {
+			continue
+		}
+		key, val := strings.ToUpper(string(field[:eq])), string(field[eq+1:])
+
+		switch key {
+		case "TITLE":
+			t.title = val
+		case "ARTIST":
+			t.artists = append(t.artists, val)
+		case "ALBUM":
+			t.album = val
+		case "ISRC":
+			t.isrc = val
+		case "DATE":
+			t.date = releaseDate(val)
+		case "METADATA_BLOCK_PICTURE":
+			data, err := base64.StdEncoding.DecodeString(val)
+			if err != nil {
+				continue
+			}
+			if p, err := parseFLACPicture(data); err == nil {
+				t.addPicture(p)
+			}
+		}
+	}
+	if c.short {
+		return errShort
+	}
+	return nil
+}
+
+// parseFLACPicture reads a FLAC PICTURE block, which Ogg files also embed in
+// their comments.
+func parseFLACPicture(b []byte) (*picture, error) {
+	c := &cursor{b: b}
+	kind := c.u32be()
+	mime := c.next(int(c.u32be()))
+	c.next(int(c.u32be())) // Description
+	c.next(16)             // Width, height, color depth and palette size
+	data := c.next(int(c.u32be()))
+	if c.short {
+		return nil, errShort
+	}
+	return &picture{mime: imageMIME(string(mime), data), kind: kind, data: data}, nil
+}
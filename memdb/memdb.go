@@ -13,11 +13,13 @@ import (
 
 func New(src rand.Source) (*DB, error) {
 	return &DB{
-		rooms:   make(map[db.RoomID]*room),
-		users:   make(map[db.UserID]*db.User),
-		queues:  make(map[db.RoomID][]*queue),
-		history: make(map[db.RoomID][]*db.TrackEntry),
-		src:     src,
+		rooms:    make(map[db.RoomID]*room),
+		users:    make(map[db.UserID]*db.User),
+		queues:   make(map[db.RoomID][]*queue),
+		history:  make(map[db.RoomID][]*db.TrackEntry),
+		recaps:   make(map[db.RoomID][]byte),
+		playback: make(map[db.RoomID]*db.PlaybackState),
+		src:      src,
 	}, nil
 }
 
@@ -49,7 +51,11 @@ type DB struct {
 	queues map[db.RoomID][]*queue
 	// Map from roomID -> list of played track entries
 	history map[db.RoomID][]*db.TrackEntry
-	src     rand.Source
+	// Map from roomID -> encoded recap
+	recaps map[db.RoomID][]byte
+	// Map from roomID -> playback state of the current track
+	playback map[db.RoomID]*db.PlaybackState
+	src      rand.Source
 }
 
 func (m *DB) Room(id db.RoomID) (*db.Room, error) {
@@ -64,6 +70,21 @@ func (m *DB) Room(id db.RoomID) (*db.Room, error) {
 }
 
 func (m *DB) NextTrack(rID db.RoomID) (*db.User, *radio.Track, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.nextTrack(rID, false)
+}
+
+func (m *DB) PeekTrack(rID db.RoomID) (*db.User, *radio.Track, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.nextTrack(rID, true)
+}
+
+// nextTrack finds the next track to play in the room. If peek is true, it
+// works off a copy of the rotator, and leaves the room as it was. The caller
+// must hold the lock.
+func (m *DB) nextTrack(rID db.RoomID, peek bool) (*db.User, *radio.Track, error) {
 	r, ok := m.rooms[rID]
 	if !ok {
 		return nil, nil, db.ErrRoomNotFound
@@ -74,8 +95,13 @@ func (m *DB) NextTrack(rID db.RoomID) (*db.User, *radio.Track, error) {
 		return nil, nil, db.ErrQueueNotFound
 	}
 
+	rot := r.rotator
+	if peek {
+		rot = db.LoadRotator(db.SaveRotator(r.rotator))
+	}
+
 	for i := 0; i < len(qs); i++ {
-		idx := r.rotator.NextIndex()
+		idx := rot.NextIndex()
 
 		if idx >= len(qs) {
 			return nil, nil, errors.New("invalid index in rotation")
@@ -93,6 +119,10 @@ func (m *DB) NextTrack(rID db.RoomID) (*db.User, *radio.Track, error) {
 			continue
 		}
 
+		if peek {
+			return u, nt, nil
+		}
+
 		q.Tracks[q.Offset].Played = true
 		q.Offset++
 		return u, nt, nil
@@ -170,6 +200,18 @@ func (m *DB) AddUserToRoom(rID db.RoomID, uID db.UserID) error {
 	return nil
 }
 
+func (m *DB) EndRoom(rID db.RoomID) error {
+	m.Lock()
+	defer m.Unlock()
+
+	r, ok := m.rooms[rID]
+	if !ok {
+		return db.ErrRoomNotFound
+	}
+	r.room.Ended = true
+	return nil
+}
+
 func (m *DB) User(id db.UserID) (*db.User, error) {
 	m.RLock()
 	defer m.RUnlock()
@@ -242,6 +284,24 @@ func (m *DB) Tracks(id db.QueueID, qo *db.QueueOptions) ([]*db.QueueTrack, error
 	return qts, nil
 }
 
+func (m *DB) UserTracks(uID db.UserID) ([]*radio.Track, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var ts []*radio.Track
+	for _, qs := range m.queues {
+		for _, q := range qs {
+			if q.ID.UserID != uID {
+				continue
+			}
+			for _, qt := range q.Tracks {
+				ts = append(ts, qt.Track)
+			}
+		}
+	}
+	return ts, nil
+}
+
 func (m *DB) queueByID(id db.QueueID) (*queue, bool) {
 	qs, ok := m.queues[id.RoomID]
 	if !ok {
@@ -298,7 +358,7 @@ func (m *DB) AddTrack(id db.QueueID, track *radio.Track, afterQTID string) error
 	}
 
 	// If we're here, we didn't find the track.
-	return db.ErrQueueNotFound
+	return db.ErrQueueTrackNotFound
 }
 
 func (m *DB) RemoveTrack(id db.QueueID, qtID string) error {
@@ -328,7 +388,66 @@ func (m *DB) RemoveTrack(id db.QueueID, qtID string) error {
 	}
 
 	// If we're here, we didn't find the track.
-	return db.ErrQueueNotFound
+	return db.ErrQueueTrackNotFound
+}
+
+func (m *DB) MoveTrack(id db.QueueID, qtID, afterQTID string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	q, ok := m.queueByID(id)
+	if !ok {
+		return db.ErrQueueNotFound
+	}
+
+	if qtID == afterQTID {
+		return errors.New("can't move a track after itself")
+	}
+
+	from := -1
+	for i, qt := range q.Tracks {
+		if qt.ID == qtID {
+			from = i
+			break
+		}
+	}
+	if from == -1 {
+		return db.ErrQueueTrackNotFound
+	}
+	qt := q.Tracks[from]
+	if qt.Played {
+		return errors.New("can't move a track that's already played")
+	}
+
+	// Work out where the track goes, once it's been taken out of the queue.
+	rest := make([]*db.QueueTrack, 0, len(q.Tracks))
+	rest = append(rest, q.Tracks[:from]...)
+	rest = append(rest, q.Tracks[from+1:]...)
+
+	to := 0
+	if afterQTID != "" {
+		to = -1
+		for i, t := range rest {
+			if t.ID == afterQTID {
+				to = i + 1
+				break
+			}
+		}
+		if to == -1 {
+			return db.ErrQueueTrackNotFound
+		}
+	}
+
+	// If the next track has already played, no moving tracks in front of it.
+	if to < len(rest) && rest[to].Played {
+		return errors.New("can't move a track before one that's already played")
+	}
+
+	rest = append(rest, nil)
+	copy(rest[to+1:], rest[to:])
+	rest[to] = qt
+	q.Tracks = rest
+	return nil
 }
 
 func (m *DB) History(rID db.RoomID) ([]*db.TrackEntry, error) {
@@ -351,3 +470,121 @@ func (m *DB) AddToHistory(rID db.RoomID, trackEntry *db.TrackEntry) (int, error)
 func (m *DB) MarkVetoed(db.RoomID, db.UserID) error {
 	return db.ErrOperationNotImplemented
 }
+
+func (m *DB) Recap(rID db.RoomID) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	rc, ok := m.recaps[rID]
+	if !ok {
+		return nil, db.ErrRecapNotFound
+	}
+	return rc, nil
+}
+
+func (m *DB) AddRecap(rID db.RoomID, recap []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.rooms[rID]; !ok {
+		return db.ErrRoomNotFound
+	}
+	m.recaps[rID] = recap
+	return nil
+}
+
+func (m *DB) Playback(rID db.RoomID) (*db.PlaybackState, error) {
+	m.RLock()
+	defer m.RUnlock()
+	ps, ok := m.playback[rID]
+	if !ok {
+		return nil, db.ErrPlaybackNotFound
+	}
+	cp := *ps
+	return &cp, nil
+}
+
+func (m *DB) SetPlayback(rID db.RoomID, ps *db.PlaybackState) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.rooms[rID]; !ok {
+		return db.ErrRoomNotFound
+	}
+	cp := *ps
+	m.playback[rID] = &cp
+	return nil
+}
+
+func (m *DB) UpdatePlayback(rID db.RoomID, ps *db.PlaybackState) error {
+	m.Lock()
+	defer m.Unlock()
+	cur, ok := m.playback[rID]
+	if !ok || cur.HistoryIndex != ps.HistoryIndex {
+		return db.ErrPlaybackChanged
+	}
+	cp := *ps
+	m.playback[rID] = &cp
+	return nil
+}
+
+func (m *DB) AddVote(rID db.RoomID, uID db.UserID) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	tes, ok := m.history[rID]
+	if !ok {
+		return 0, db.ErrRoomNotFound
+	}
+	if len(tes) == 0 {
+		return 0, errors.New("no tracks in history")
+	}
+
+	te := tes[len(tes)-1]
+	for _, id := range te.UpvotedBy {
+		if id == uID {
+			return len(te.UpvotedBy), nil
+		}
+	}
+	te.UpvotedBy = append(te.UpvotedBy, uID)
+	return len(te.UpvotedBy), nil
+}
+
+func (m *DB) AddMessage(rID db.RoomID, msg *db.ChatMessage) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	tes, ok := m.history[rID]
+	if !ok {
+		return 0, db.ErrRoomNotFound
+	}
+	if len(tes) == 0 {
+		return 0, errors.New("no tracks in history")
+	}
+
+	te := tes[len(tes)-1]
+	msg.ID = db.RandomMessageID(m.src, te.Messages)
+	te.Messages = append(te.Messages, msg)
+	return len(tes) - 1, nil
+}
+
+func (m *DB) DeleteMessage(rID db.RoomID, idx int, msgID string) error {
+	m.Lock()
+	defer m.Unlock()
+	tes, ok := m.history[rID]
+	if !ok {
+		return db.ErrRoomNotFound
+	}
+	if idx < 0 || idx >= len(tes) {
+		return db.ErrMessageNotFound
+	}
+
+	te := tes[idx]
+	for i, msg := range te.Messages {
+		if msg.ID != msgID {
+			continue
+		}
+		// Copy the messages, instead of removing it in place, because callers
+		// of History might still be looking at the old ones.
+		msgs := make([]*db.ChatMessage, 0, len(te.Messages)-1)
+		msgs = append(msgs, te.Messages[:i]...)
+		te.Messages = append(msgs, te.Messages[i+1:]...)
+		return nil
+	}
+	return db.ErrMessageNotFound
+}
@@ -0,0 +1,225 @@
+package radio
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions configure a Cache. Zero values get the defaults.
+type CacheOptions struct {
+	// Size is the most tracks, and separately the most searches, to keep. It
+	// defaults to 1000.
+	Size int
+	// TrackTTL is how long a track is kept. It defaults to an hour.
+	TrackTTL time.Duration
+	// SearchTTL is how long search results and artists' top tracks are kept,
+	// which is short so that new releases show up. It defaults to five minutes.
+	SearchTTL time.Duration
+	// NotFoundTTL is how long we remember that a track doesn't exist. It
+	// defaults to a minute.
+	NotFoundTTL time.Duration
+}
+
+// CacheStats are a Cache's counters. Lookups of an artist's top tracks count
+// as searches.
+type CacheStats struct {
+	TrackHits    uint64 `json:"trackHits"`
+	TrackMisses  uint64 `json:"trackMisses"`
+	SearchHits   uint64 `json:"searchHits"`
+	SearchMisses uint64 `json:"searchMisses"`
+}
+
+// Cache is a SongServer that keeps the results of another SongServer, so
+// repeated lookups don't go back to it. Tracks that come back in search
+// results are cached too, since they're usually added to a queue next.
+// Errors aren't cached, except for tracks that don't exist.
+type Cache struct {
+	ss   SongServer
+	opts CacheOptions
+
+	mu       sync.Mutex
+	tracks   *lru
+	searches *lru
+	stats    CacheStats
+}
+
+// NewCache returns a Cache in front of ss.
+func NewCache(ss SongServer, opts *CacheOptions) *Cache {
+	var o CacheOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Size <= 0 {
+		o.Size = 1000
+	}
+	if o.TrackTTL <= 0 {
+		o.TrackTTL = time.Hour
+	}
+	if o.SearchTTL <= 0 {
+		o.SearchTTL = 5 * time.Minute
+	}
+	if o.NotFoundTTL <= 0 {
+		o.NotFoundTTL = time.Minute
+	}
+	return &Cache{
+		ss:       ss,
+		opts:     o,
+		tracks:   newLRU(o.Size),
+		searches: newLRU(o.Size),
+	}
+}
+
+// trackResult is what's cached for a track lookup: either the track, or the
+// error saying it doesn't exist.
+type trackResult struct {
+	track Track
+	err   error
+}
+
+func (c *Cache) Track(ctx context.Context, id string) (Track, error) {
+	c.mu.Lock()
+	if v, ok := c.tracks.get(id, time.Now()); ok {
+		c.stats.TrackHits++
+		c.mu.Unlock()
+		res := v.(trackResult)
+		return res.track, res.err
+	}
+	c.stats.TrackMisses++
+	c.mu.Unlock()
+
+	t, err := c.ss.Track(ctx, id)
+	switch {
+	case err == nil:
+		c.put(id, trackResult{track: t}, c.opts.TrackTTL)
+	case errors.Is(err, ErrNotFound):
+		c.put(id, trackResult{err: err}, c.opts.NotFoundTTL)
+	}
+	return t, err
+}
+
+func (c *Cache) put(id string, res trackResult, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tracks.put(id, res, time.Now().Add(ttl))
+}
+
+func (c *Cache) Search(ctx context.Context, query string, opts *SearchOptions) (*SearchResults, error) {
+	o := opts.WithDefaults()
+	// Searches that only differ by case or spacing get the same results.
+	q := strings.Join(strings.Fields(strings.ToLower(query)), " ")
+	key := fmt.Sprintf("search:%s:%d:%d:%s:%s", o.Type, o.Limit, o.Offset, o.Market, q)
+
+	v, err := c.cached(key, func() (interface{}, []Track, error) {
+		res, err := c.ss.Search(ctx, query, &o)
+		if err != nil {
+			return nil, nil, err
+		}
+		return res, res.Tracks, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*SearchResults), nil
+}
+
+func (c *Cache) ArtistTopTracks(ctx context.Context, artistID, market string) ([]Track, error) {
+	v, err := c.cached("top:"+market+":"+artistID, func() (interface{}, []Track, error) {
+		ts, err := c.ss.ArtistTopTracks(ctx, artistID, market)
+		return ts, ts, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]Track), nil
+}
+
+// cached returns what's in the search cache for the key, or calls fetch and
+// caches what it returns. The tracks it returns are put in the track cache
+// too. They share the search's counters.
+func (c *Cache) cached(key string, fetch func() (interface{}, []Track, error)) (interface{}, error) {
+	c.mu.Lock()
+	if v, ok := c.searches.get(key, time.Now()); ok {
+		c.stats.SearchHits++
+		c.mu.Unlock()
+		return v, nil
+	}
+	c.stats.SearchMisses++
+	c.mu.Unlock()
+
+	v, ts, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.searches.put(key, v, now.Add(c.opts.SearchTTL))
+	for _, t := range ts {
+		c.tracks.put(t.ID, trackResult{track: t}, now.Add(c.opts.TrackTTL))
+	}
+	return v, nil
+}
+
+// Stats returns the cache's hit and miss counters.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// lru is a least recently used cache, where entries also expire. It isn't
+// safe for concurrent use.
+type lru struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	val interface{}
+	exp time.Time
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) get(key string, now time.Time) (interface{}, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !now.Before(e.exp) {
+		l.order.Remove(el)
+		delete(l.items, key)
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return e.val, true
+}
+
+func (l *lru) put(key string, val interface{}, exp time.Time) {
+	if el, ok := l.items[key]; ok {
+		el.Value = &lruEntry{key: key, val: val, exp: exp}
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruEntry{key: key, val: val, exp: exp})
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruEntry).key)
+	}
+}
@@ -0,0 +1,167 @@
+package radio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// countingServer serves a single track, and counts how often it's asked.
+type countingServer struct {
+	searches, lookups int
+	err               error
+}
+
+var dreams = Track{ID: "1", Name: "Dreams", Artists: []Artist{{Name: "Fleetwood Mac"}}}
+
+func (s *countingServer) Search(ctx context.Context, query string, opts *SearchOptions) (*SearchResults, error) {
+	s.searches++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &SearchResults{Tracks: []Track{dreams}, Total: 1}, nil
+}
+
+func (s *countingServer) ArtistTopTracks(ctx context.Context, artistID, market string) ([]Track, error) {
+	s.searches++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []Track{dreams}, nil
+}
+
+func (s *countingServer) Track(ctx context.Context, id string) (Track, error) {
+	s.lookups++
+	if s.err != nil {
+		return Track{}, s.err
+	}
+	if id != dreams.ID {
+		return Track{}, fmt.Errorf("fake: %w", ErrNotFound)
+	}
+	return dreams, nil
+}
+
+func TestCache(t *testing.T) {
+	ss := &countingServer{}
+	c := NewCache(ss, nil)
+	ctx := context.Background()
+
+	for _, q := range []string{"dreams", "Dreams ", "  DREAMS"} {
+		res, err := c.Search(ctx, q, nil)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", q, err)
+		}
+		if diff := cmp.Diff([]Track{dreams}, res.Tracks); diff != "" {
+			t.Errorf("Search(%q) (-want +got)\n%s", q, diff)
+		}
+	}
+	if ss.searches != 1 {
+		t.Errorf("made %d searches, want 1", ss.searches)
+	}
+
+	// Other pages and types are different searches.
+	for _, opts := range []*SearchOptions{{Offset: 20}, {Type: SearchArtists}, {Market: "GB"}} {
+		if _, err := c.Search(ctx, "dreams", opts); err != nil {
+			t.Fatalf("Search(%+v): %v", opts, err)
+		}
+	}
+	// The defaults are filled in before the key is made.
+	if _, err := c.Search(ctx, "dreams", &SearchOptions{Type: SearchTracks, Limit: DefaultSearchLimit}); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if ss.searches != 4 {
+		t.Errorf("made %d searches, want 4", ss.searches)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.ArtistTopTracks(ctx, "fleetwood-mac", "US"); err != nil {
+			t.Fatalf("ArtistTopTracks: %v", err)
+		}
+	}
+	if ss.searches != 5 {
+		t.Errorf("made %d searches, want 5", ss.searches)
+	}
+
+	// The track came back in the search, so it's already cached.
+	got, err := c.Track(ctx, "1")
+	if err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	if diff := cmp.Diff(dreams, got); diff != "" {
+		t.Errorf("Track (-want +got)\n%s", diff)
+	}
+
+	// Tracks that don't exist are cached too.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Track(ctx, "2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Track(2) = %v, want %v", err, ErrNotFound)
+		}
+	}
+	if ss.lookups != 1 {
+		t.Errorf("made %d lookups, want 1", ss.lookups)
+	}
+
+	want := CacheStats{TrackHits: 2, TrackMisses: 1, SearchHits: 4, SearchMisses: 5}
+	if diff := cmp.Diff(want, c.Stats()); diff != "" {
+		t.Errorf("Stats (-want +got)\n%s", diff)
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	errDown := errors.New("service unavailable")
+	ss := &countingServer{err: errDown}
+	c := NewCache(ss, nil)
+	ctx := context.Background()
+
+	// Other errors aren't cached, so we try again once the server is back.
+	if _, err := c.Search(ctx, "dreams", nil); err != errDown {
+		t.Errorf("Search = %v, want %v", err, errDown)
+	}
+	if _, err := c.Track(ctx, "1"); err != errDown {
+		t.Errorf("Track = %v, want %v", err, errDown)
+	}
+	ss.err = nil
+	if _, err := c.Search(ctx, "dreams", nil); err != nil {
+		t.Errorf("Search: %v", err)
+	}
+	if ss.searches != 2 {
+		t.Errorf("made %d searches, want 2", ss.searches)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	ss := &countingServer{}
+	c := NewCache(ss, &CacheOptions{Size: 2, SearchTTL: 20 * time.Millisecond})
+	ctx := context.Background()
+
+	search := func(q string) {
+		t.Helper()
+		if _, err := c.Search(ctx, q, nil); err != nil {
+			t.Fatalf("Search(%q): %v", q, err)
+		}
+	}
+
+	search("a")
+	search("b")
+	search("a")
+	// This pushes out "b", which was used least recently.
+	search("c")
+	search("a")
+	if ss.searches != 3 {
+		t.Errorf("made %d searches, want 3", ss.searches)
+	}
+	search("b")
+	if ss.searches != 4 {
+		t.Errorf("made %d searches, want 4", ss.searches)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	search("b")
+	if ss.searches != 5 {
+		t.Errorf("made %d searches, want 5", ss.searches)
+	}
+}
@@ -0,0 +1,306 @@
+package radio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Provider is a SongServer to use in a Multi, and the name that's put in
+// front of the IDs of its tracks.
+type Provider struct {
+	Name       string
+	SongServer SongServer
+}
+
+// Multi is a SongServer that searches several others at once. The IDs of its
+// tracks are the provider's name and the provider's ID, separated by a colon,
+// so lookups go back to the right provider. Players that need the provider's
+// own ID can get it with SplitID.
+//
+// With only one provider, IDs are left as they are, but IDs with a provider in
+// front still work. That way tracks stored while a server had more than one
+// provider can still be looked up after it's restarted with just one.
+type Multi struct {
+	providers []Provider
+	// prefixed is true if IDs get the provider's name in front. It depends on
+	// how many providers NewMulti was given, so a Multi from Only makes the
+	// same IDs as the one it came from.
+	prefixed bool
+}
+
+// NewMulti returns a Multi for the providers. When the same track comes from
+// more than one of them, the one that ranks higher is kept, and ties go to the
+// provider listed first.
+func NewMulti(providers ...Provider) *Multi {
+	return &Multi{providers: providers, prefixed: len(providers) > 1}
+}
+
+// Only returns a Multi that only uses the providers with the given names, in
+// the order m has them. IDs from other providers aren't found.
+func (m *Multi) Only(names ...string) (*Multi, error) {
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name] = true
+	}
+
+	var providers []Provider
+	for _, p := range m.providers {
+		if want[p.Name] {
+			providers = append(providers, p)
+			delete(want, p.Name)
+		}
+	}
+	for _, name := range names {
+		if want[name] {
+			return nil, fmt.Errorf("no provider named %q", name)
+		}
+	}
+	return &Multi{providers: providers, prefixed: m.prefixed}, nil
+}
+
+// SplitID splits an ID from a Multi into the name of the provider and the
+// provider's own ID. IDs that didn't come from a Multi have no provider.
+func SplitID(id string) (provider, providerID string) {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return "", id
+}
+
+// Search searches every provider at the same time, and merges the results,
+// taking the best result from each in turn. Duplicate tracks and artists are
+// dropped. If some providers fail, the results from the rest are still
+// returned.
+//
+// Every provider is asked for the same page, so a merged page has up to the
+// limit from each of them, and the next page is at offset+limit for all of
+// them too. Total is the most results any one provider has, so pages run out
+// when the provider with the most does. Duplicates are only dropped within a
+// page.
+func (m *Multi) Search(ctx context.Context, query string, opts *SearchOptions) (*SearchResults, error) {
+	o := opts.WithDefaults()
+	results := make([]*SearchResults, len(m.providers))
+	errs := make([]error, len(m.providers))
+
+	var wg sync.WaitGroup
+	for i, p := range m.providers {
+		wg.Add(1)
+		go func(i int, p Provider) {
+			defer wg.Done()
+			results[i], errs[i] = p.SongServer.Search(ctx, query, &o)
+		}(i, p)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Failed to search %s for %q: %v", m.providers[i].Name, query, err)
+			results[i] = &SearchResults{}
+			failed++
+		}
+	}
+	if failed == len(m.providers) && failed > 0 {
+		return nil, errs[0]
+	}
+
+	res := &SearchResults{
+		Tracks:    []Track{},
+		Albums:    []Album{},
+		Artists:   []Artist{},
+		Playlists: []Playlist{},
+	}
+	counts := func(n func(r *SearchResults) int) []int {
+		cs := make([]int, len(results))
+		for i, r := range results {
+			cs[i] = n(r)
+		}
+		return cs
+	}
+
+	seen := make(map[string]bool)
+	interleave(counts(func(r *SearchResults) int { return len(r.Tracks) }), func(p, i int) {
+		t := results[p].Tracks[i]
+		if dup(seen, dedupKeys(t)) {
+			return
+		}
+		res.Tracks = append(res.Tracks, m.namespace(p, t))
+	})
+	interleave(counts(func(r *SearchResults) int { return len(r.Artists) }), func(p, i int) {
+		a := results[p].Artists[i]
+		if name := normalize(a.Name); name != "" && dup(seen, []string{"artist:" + name}) {
+			return
+		}
+		a.ID = m.prefix(p, a.ID)
+		res.Artists = append(res.Artists, a)
+	})
+	interleave(counts(func(r *SearchResults) int { return len(r.Albums) }), func(p, i int) {
+		a := results[p].Albums[i]
+		a.ID = m.prefix(p, a.ID)
+		res.Albums = append(res.Albums, a)
+	})
+	interleave(counts(func(r *SearchResults) int { return len(r.Playlists) }), func(p, i int) {
+		pl := results[p].Playlists[i]
+		pl.ID = m.prefix(p, pl.ID)
+		res.Playlists = append(res.Playlists, pl)
+	})
+
+	for _, r := range results {
+		if r.Total > res.Total {
+			res.Total = r.Total
+		}
+	}
+	return res, nil
+}
+
+// Track looks up the track with the provider its ID names. IDs without a
+// provider, like the IDs of tracks that were queued before there was more
+// than one provider, are looked up with each provider in turn.
+func (m *Multi) Track(ctx context.Context, id string) (Track, error) {
+	var t Track
+	p, err := m.route(id, func(ss SongServer, pid string) error {
+		var err error
+		t, err = ss.Track(ctx, pid)
+		return err
+	})
+	if err != nil {
+		return Track{}, err
+	}
+	return m.namespace(p, t), nil
+}
+
+// ArtistTopTracks looks up the artist with the provider its ID names, the
+// same way Track does.
+func (m *Multi) ArtistTopTracks(ctx context.Context, artistID, market string) ([]Track, error) {
+	var ts []Track
+	p, err := m.route(artistID, func(ss SongServer, pid string) error {
+		var err error
+		ts, err = ss.ArtistTopTracks(ctx, pid, market)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Track, len(ts))
+	for i, t := range ts {
+		res[i] = m.namespace(p, t)
+	}
+	return res, nil
+}
+
+// route calls fn with the provider the ID names, and the provider's own ID,
+// and returns the index of the provider. If the ID doesn't name a provider, fn
+// is called with each one until it succeeds.
+func (m *Multi) route(id string, fn func(ss SongServer, pid string) error) (int, error) {
+	name, pid := SplitID(id)
+	if name != "" {
+		for i, p := range m.providers {
+			if p.Name == name {
+				return i, fn(p.SongServer, pid)
+			}
+		}
+		return 0, fmt.Errorf("no provider named %q: %w", name, ErrNotFound)
+	}
+
+	// Providers might reject IDs that aren't theirs as invalid instead of not
+	// found, so errors only matter if nobody has the ID.
+	var firstErr error
+	for i, p := range m.providers {
+		err := fn(p.SongServer, id)
+		if err == nil {
+			return i, nil
+		}
+		if firstErr == nil && !errors.Is(err, ErrNotFound) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return 0, fmt.Errorf("no provider has %q: %w", id, ErrNotFound)
+}
+
+// namespace returns a copy of a track from the provider at index p, with the
+// provider's name in front of its IDs.
+func (m *Multi) namespace(p int, t Track) Track {
+	t.ID = m.prefix(p, t.ID)
+	t.Album.ID = m.prefix(p, t.Album.ID)
+	artists := make([]Artist, len(t.Artists))
+	for i, a := range t.Artists {
+		a.ID = m.prefix(p, a.ID)
+		artists[i] = a
+	}
+	t.Artists = artists
+	return t
+}
+
+// prefix puts the name of the provider at index p in front of an ID, unless
+// it's empty or the provider is the only one.
+func (m *Multi) prefix(p int, id string) string {
+	if id == "" || !m.prefixed {
+		return id
+	}
+	return m.providers[p].Name + ":" + id
+}
+
+// interleave calls fn with the index of each provider and of each of its
+// results, taking the best result from each provider in turn. counts are how
+// many results each provider has.
+func interleave(counts []int, fn func(p, i int)) {
+	for rank := 0; ; rank++ {
+		more := false
+		for p, n := range counts {
+			if rank < n {
+				more = true
+				fn(p, rank)
+			}
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// dup returns true if any of the keys have been seen, and marks them all as
+// seen.
+func dup(seen map[string]bool, keys []string) bool {
+	found := false
+	for _, k := range keys {
+		found = found || seen[k]
+		seen[k] = true
+	}
+	return found
+}
+
+// dedupKeys returns the keys that identify the same recording from different
+// providers: its ISRC, and its main artist and name with the punctuation and
+// case taken out.
+func dedupKeys(t Track) []string {
+	var keys []string
+	if isrc := strings.ToUpper(strings.TrimSpace(t.ExternalIDs.ISRC)); isrc != "" {
+		keys = append(keys, "isrc:"+isrc)
+	}
+	var artist string
+	if len(t.Artists) > 0 {
+		artist = normalize(t.Artists[0].Name)
+	}
+	if name := normalize(t.Name); name != "" {
+		keys = append(keys, "name:"+artist+"\x00"+name)
+	}
+	return keys
+}
+
+// normalize lowercases s, and reduces it to its letters and numbers, with a
+// single space between each word.
+func normalize(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	return strings.Join(words, " ")
+}
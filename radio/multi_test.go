@@ -0,0 +1,285 @@
+package radio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// listServer returns the same tracks for every search, a page at a time, after
+// a delay. Every artist's top tracks are its tracks too.
+type listServer struct {
+	tracks []Track
+	delay  time.Duration
+	err    error
+}
+
+func (s *listServer) Search(ctx context.Context, query string, opts *SearchOptions) (*SearchResults, error) {
+	time.Sleep(s.delay)
+	if s.err != nil {
+		return nil, s.err
+	}
+	o := opts.WithDefaults()
+	ts := s.tracks
+	if o.Offset < len(ts) {
+		ts = ts[o.Offset:]
+	} else {
+		ts = nil
+	}
+	if o.Limit < len(ts) {
+		ts = ts[:o.Limit]
+	}
+	res := &SearchResults{Tracks: ts, Total: len(s.tracks)}
+	for _, t := range ts {
+		res.Artists = append(res.Artists, t.Artists...)
+	}
+	return res, nil
+}
+
+func (s *listServer) ArtistTopTracks(ctx context.Context, artistID, market string) ([]Track, error) {
+	var ts []Track
+	for _, t := range s.tracks {
+		if t.Artists[0].ID == artistID {
+			ts = append(ts, t)
+		}
+	}
+	if len(ts) == 0 {
+		return nil, fmt.Errorf("list: artist %w", ErrNotFound)
+	}
+	return ts, nil
+}
+
+func (s *listServer) Track(ctx context.Context, id string) (Track, error) {
+	for _, t := range s.tracks {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return Track{}, fmt.Errorf("list: %w", ErrNotFound)
+}
+
+func track(id, artist, name, isrc string) Track {
+	return Track{
+		ID:          id,
+		Name:        name,
+		Artists:     []Artist{{ID: normalize(artist), Name: artist}},
+		ExternalIDs: ExternalIDs{ISRC: isrc},
+	}
+}
+
+func TestMultiSearch(t *testing.T) {
+	lib := &listServer{
+		delay: 50 * time.Millisecond,
+		tracks: []Track{
+			track("a", "Fleetwood Mac", "Dreams", ""),
+			track("b", "Steely Dan", "Do It Again", "USMC17200001"),
+		},
+	}
+	sp := &listServer{
+		delay: 50 * time.Millisecond,
+		tracks: []Track{
+			// Same ISRC, different name.
+			track("1", "Steely Dan", "Do It Again - Remastered", "USMC17200001"),
+			// Same artist and name, once the punctuation is gone.
+			track("2", "fleetwood mac", "Dreams!", "USWB10400049"),
+			track("3", "The Cranberries", "Dreams", "GBUM71029604"),
+		},
+	}
+	m := NewMulti(Provider{Name: "library", SongServer: lib}, Provider{Name: "spotify", SongServer: sp})
+
+	start := time.Now()
+	res, err := m.Search(context.Background(), "dreams", nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if d := time.Since(start); d >= 100*time.Millisecond {
+		t.Errorf("Search took %s, want the providers searched at the same time", d)
+	}
+
+	var got []string
+	for _, tr := range res.Tracks {
+		got = append(got, tr.ID)
+	}
+	// Spotify's copy of "Do It Again" ranks higher than the library's, so it's
+	// the one that's kept.
+	want := []string{"library:a", "spotify:1", "spotify:3"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Search tracks (-want +got)\n%s", diff)
+	}
+
+	got = nil
+	for _, a := range res.Artists {
+		got = append(got, a.ID)
+	}
+	want = []string{"library:fleetwood mac", "spotify:steely dan", "spotify:the cranberries"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Search artists (-want +got)\n%s", diff)
+	}
+	if res.Total != 3 {
+		t.Errorf("Search total = %d, want 3", res.Total)
+	}
+
+	// Results still come back if a provider is down.
+	errDown := errors.New("service unavailable")
+	sp.err = errDown
+	res, err = m.Search(context.Background(), "dreams", nil)
+	if err != nil || len(res.Tracks) != 2 {
+		t.Errorf("Search = %v, %v, want the library's 2 tracks", res, err)
+	}
+	lib.err = errDown
+	if _, err := m.Search(context.Background(), "dreams", nil); err != errDown {
+		t.Errorf("Search = %v, want %v", err, errDown)
+	}
+}
+
+func TestMultiSearchPages(t *testing.T) {
+	lib := &listServer{tracks: []Track{
+		track("a", "Fleetwood Mac", "Dreams", ""),
+		track("b", "Steely Dan", "Do It Again", ""),
+		track("c", "The Cranberries", "Dreams", ""),
+	}}
+	sp := &listServer{tracks: []Track{track("1", "Russ", "Losin Control", "")}}
+	m := NewMulti(Provider{Name: "library", SongServer: lib}, Provider{Name: "spotify", SongServer: sp})
+
+	// Paging through to the end, the way serveSearch's nextOffset does, gets
+	// everything exactly once.
+	var got []string
+	opts := &SearchOptions{Limit: 2}
+	for {
+		res, err := m.Search(context.Background(), "anything", opts)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		for _, tr := range res.Tracks {
+			got = append(got, tr.ID)
+		}
+		if opts.Offset += opts.Limit; opts.Offset >= res.Total {
+			break
+		}
+	}
+	want := []string{"library:a", "spotify:1", "library:b", "library:c"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Search pages (-want +got)\n%s", diff)
+	}
+}
+
+func TestMultiTrack(t *testing.T) {
+	lib := &listServer{tracks: []Track{track("a", "Fleetwood Mac", "Dreams", "")}}
+	sp := &listServer{tracks: []Track{track("a", "Steely Dan", "Do It Again", "")}}
+	m := NewMulti(Provider{Name: "library", SongServer: lib}, Provider{Name: "spotify", SongServer: sp})
+
+	tests := []struct {
+		id       string
+		wantName string
+		wantID   string
+	}{
+		{"library:a", "Dreams", "library:a"},
+		{"spotify:a", "Do It Again", "spotify:a"},
+		// IDs from before there was a Multi go to the first provider that
+		// has them.
+		{"a", "Dreams", "library:a"},
+	}
+	for _, tc := range tests {
+		got, err := m.Track(context.Background(), tc.id)
+		if err != nil {
+			t.Errorf("Track(%q): %v", tc.id, err)
+			continue
+		}
+		if got.Name != tc.wantName || got.ID != tc.wantID {
+			t.Errorf("Track(%q) = %q with ID %q, want %q with ID %q", tc.id, got.Name, got.ID, tc.wantName, tc.wantID)
+		}
+	}
+
+	for _, id := range []string{"spotify:b", "youtube:a", "b"} {
+		if _, err := m.Track(context.Background(), id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Track(%q) = %v, want %v", id, err, ErrNotFound)
+		}
+	}
+}
+
+func TestMultiSingleProvider(t *testing.T) {
+	sp := &listServer{tracks: []Track{track("a", "Steely Dan", "Do It Again", "")}}
+	m := NewMulti(Provider{Name: "spotify", SongServer: sp})
+
+	// IDs are left alone, whether or not they were stored with a provider in
+	// front of them.
+	for _, id := range []string{"a", "spotify:a"} {
+		got, err := m.Track(context.Background(), id)
+		if err != nil {
+			t.Errorf("Track(%q): %v", id, err)
+			continue
+		}
+		if got.ID != "a" || got.Artists[0].ID != "steely dan" {
+			t.Errorf("Track(%q) has IDs %q and %q, want %q and %q", id, got.ID, got.Artists[0].ID, "a", "steely dan")
+		}
+	}
+
+	res, err := m.Search(context.Background(), "anything", nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Tracks) != 1 || res.Tracks[0].ID != "a" {
+		t.Errorf("Search returned %+v, want track %q", res.Tracks, "a")
+	}
+
+	// Providers that have gone away can't be looked up.
+	if _, err := m.Track(context.Background(), "library:a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Track(%q) = %v, want %v", "library:a", err, ErrNotFound)
+	}
+}
+
+func TestMultiOnly(t *testing.T) {
+	lib := &listServer{tracks: []Track{track("a", "Fleetwood Mac", "Dreams", "")}}
+	sp := &listServer{tracks: []Track{track("b", "Steely Dan", "Do It Again", "")}}
+	m := NewMulti(Provider{Name: "library", SongServer: lib}, Provider{Name: "spotify", SongServer: sp})
+
+	only, err := m.Only("spotify")
+	if err != nil {
+		t.Fatalf("Only: %v", err)
+	}
+
+	// IDs keep their prefix, so they're the same as the full Multi's.
+	res, err := only.Search(context.Background(), "anything", nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Tracks) != 1 || res.Tracks[0].ID != "spotify:b" {
+		t.Errorf("Search returned %+v, want track %q", res.Tracks, "spotify:b")
+	}
+	if got, err := only.Track(context.Background(), "spotify:b"); err != nil || got.ID != "spotify:b" {
+		t.Errorf("Track(%q) = %q, %v, want %q", "spotify:b", got.ID, err, "spotify:b")
+	}
+
+	// Providers that weren't picked can't be looked up.
+	for _, id := range []string{"library:a", "a"} {
+		if _, err := only.Track(context.Background(), id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Track(%q) = %v, want %v", id, err, ErrNotFound)
+		}
+	}
+
+	if _, err := m.Only("spotify", "youtube"); err == nil {
+		t.Error("Only with an unknown provider succeeded, want an error")
+	}
+}
+
+func TestMultiArtistTopTracks(t *testing.T) {
+	lib := &listServer{tracks: []Track{track("a", "Fleetwood Mac", "Dreams", "")}}
+	sp := &listServer{tracks: []Track{track("a", "Steely Dan", "Do It Again", "")}}
+	m := NewMulti(Provider{Name: "library", SongServer: lib}, Provider{Name: "spotify", SongServer: sp})
+
+	ts, err := m.ArtistTopTracks(context.Background(), "spotify:steely dan", "US")
+	if err != nil {
+		t.Fatalf("ArtistTopTracks: %v", err)
+	}
+	if len(ts) != 1 || ts[0].ID != "spotify:a" || ts[0].Artists[0].ID != "spotify:steely dan" {
+		t.Errorf("ArtistTopTracks = %+v, want Spotify's track with its IDs prefixed", ts)
+	}
+
+	if _, err := m.ArtistTopTracks(context.Background(), "library:steely dan", "US"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ArtistTopTracks = %v, want %v", err, ErrNotFound)
+	}
+}
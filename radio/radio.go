@@ -1,28 +1,159 @@
 package radio
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is wrapped by the errors SongServers return when a track or an
+// artist doesn't exist, so callers like Cache can tell that apart from other
+// failures.
+var ErrNotFound = errors.New("not found")
+
+// SongServer looks up tracks to play. The context limits how long a lookup
+// can take, and cancels it if whoever asked for it goes away.
 type SongServer interface {
-	Search(query string) ([]Track, error)
-	Track(id string) (Track, error)
+	// Search returns a page of results of the type in the options. SongServers
+	// that don't have a type of result return none, instead of an error.
+	Search(ctx context.Context, query string, opts *SearchOptions) (*SearchResults, error)
+	Track(ctx context.Context, id string) (Track, error)
+	// ArtistTopTracks returns the most popular tracks by an artist, which comes
+	// from the Artists of a search or of a track. The market is an ISO 3166-1
+	// country code, or empty for the SongServer's default.
+	ArtistTopTracks(ctx context.Context, artistID, market string) ([]Track, error)
+}
+
+// SearchType is the kind of thing to search for.
+type SearchType string
+
+const (
+	SearchTracks    = SearchType("track")
+	SearchAlbums    = SearchType("album")
+	SearchArtists   = SearchType("artist")
+	SearchPlaylists = SearchType("playlist")
+)
+
+const (
+	// DefaultSearchLimit is how many results are in a page, unless the options
+	// say otherwise, which matches what Spotify returns by default.
+	DefaultSearchLimit = 20
+	// MaxSearchLimit is the most results that can be in a page, which is the
+	// most Spotify allows.
+	MaxSearchLimit = 50
+)
+
+// SearchOptions say which page of which results a search returns.
+type SearchOptions struct {
+	// Type defaults to SearchTracks.
+	Type SearchType
+	// Limit is how many results to return, which defaults to
+	// DefaultSearchLimit and can be at most MaxSearchLimit.
+	Limit int
+	// Offset is how many results to skip.
+	Offset int
+	// Market is an ISO 3166-1 country code, which limits the results to what's
+	// available there. It's ignored by SongServers that aren't region locked.
+	Market string
+}
+
+// WithDefaults returns a copy of the options with the defaults filled in, and
+// the limit and offset kept in range. The options can be nil.
+func (o *SearchOptions) WithDefaults() SearchOptions {
+	var opts SearchOptions
+	if o != nil {
+		opts = *o
+	}
+	if opts.Type == "" {
+		opts.Type = SearchTracks
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultSearchLimit
+	}
+	if opts.Limit > MaxSearchLimit {
+		opts.Limit = MaxSearchLimit
+	}
+	if opts.Offset < 0 {
+		opts.Offset = 0
+	}
+	return opts
+}
+
+// Page returns the start and end of the page the options ask for, out of n
+// results.
+func (o SearchOptions) Page(n int) (int, int) {
+	start, end := o.Offset, o.Offset+o.Limit
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// SearchResults are a page of search results. Only the list for the type of
+// search is filled in.
+type SearchResults struct {
+	Tracks    []Track
+	Albums    []Album
+	Artists   []Artist
+	Playlists []Playlist
+	// Total is how many results there are, across every page.
+	Total int
 }
 
 type Tracks struct {
 	Items []Track `json:"items"`
 }
 
+// Track is a track from a SongServer. Its fields and their JSON names follow
+// the Spotify API, so Spotify's responses decode straight into it. Other
+// SongServers fill in what they can.
 type Track struct {
-	Artists []Artist `json:"artists"`
-	Name    string   `json:"name"`
-	ID      string   `json:"id"`
-	Album   Album    `json:"album"`
+	Artists    []Artist `json:"artists"`
+	Name       string   `json:"name"`
+	ID         string   `json:"id"`
+	Album      Album    `json:"album"`
+	DurationMS int      `json:"duration_ms"`
+	Explicit   bool     `json:"explicit"`
+	// Popularity is between 0 and 100, where 100 is the most popular.
+	Popularity  int         `json:"popularity"`
+	ExternalIDs ExternalIDs `json:"external_ids"`
+	// PreviewURL is a 30 second sample of the track, if there is one.
+	PreviewURL string `json:"preview_url"`
+	// Provider is the name of the SongServer the track came from, like
+	// "spotify".
+	Provider string `json:"provider"`
+}
+
+// ExternalIDs identify a track outside of the SongServer it came from.
+type ExternalIDs struct {
+	// ISRC is the International Standard Recording Code, which is the same for
+	// a recording wherever it's from.
+	ISRC string `json:"isrc"`
 }
 
 type Album struct {
+	ID     string  `json:"id"`
 	Name   string  `json:"name"`
 	Images []Image `json:"images"`
+	// ReleaseDate is formatted like 2006-01-02, but it might only have the year
+	// and month, or just the year.
+	ReleaseDate string `json:"release_date"`
 }
 
 type Artist struct {
+	ID   string `json:"id"`
 	Name string `json:"name"`
+	// Images are only included in search results, not in tracks.
+	Images []Image `json:"images,omitempty"`
+}
+
+type Playlist struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Images      []Image `json:"images"`
 }
 
 type Image struct {
@@ -0,0 +1,363 @@
+// Package radiotest provides a fake radio.SongServer, which serves tracks from
+// a fixture file instead of Spotify, for development and tests.
+package radiotest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/bcspragu/Radiotation/radio"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxTopTracks is the most tracks returned for an artist, which matches what
+// Spotify returns.
+const maxTopTracks = 10
+
+// Provider is the name of the SongServer in the tracks it returns.
+const Provider = "radiotest"
+
+var (
+	ErrNotFound       = fmt.Errorf("radiotest: track %w", radio.ErrNotFound)
+	ErrArtistNotFound = fmt.Errorf("radiotest: artist %w", radio.ErrNotFound)
+)
+
+// SongServer is a radio.SongServer that serves a fixed list of tracks. It can
+// be made slow, or made to fail, to see how its callers cope. It's safe to
+// change while it's in use.
+type SongServer struct {
+	tracks []radio.Track
+	byID   map[string]radio.Track
+
+	mu        sync.Mutex
+	latency   time.Duration
+	searchErr error
+	trackErr  error
+}
+
+// New returns a SongServer for the given tracks.
+func New(tracks []radio.Track) *SongServer {
+	s := &SongServer{
+		tracks: tracks,
+		byID:   make(map[string]radio.Track),
+	}
+	for _, t := range tracks {
+		s.byID[t.ID] = t
+	}
+	return s
+}
+
+// fixture is the format of a fixture file. It's simpler than radio.Track, so
+// it's easier to write by hand.
+type fixture struct {
+	Tracks []struct {
+		ID         string   `json:"id" yaml:"id"`
+		Name       string   `json:"name" yaml:"name"`
+		Artists    []string `json:"artists" yaml:"artists"`
+		Album      string   `json:"album" yaml:"album"`
+		ArtURL     string   `json:"artURL" yaml:"artURL"`
+		DurationMS int      `json:"durationMS" yaml:"durationMS"`
+		Explicit   bool     `json:"explicit" yaml:"explicit"`
+		ISRC       string   `json:"isrc" yaml:"isrc"`
+	} `json:"tracks" yaml:"tracks"`
+}
+
+// Load returns a SongServer for the tracks in a JSON or YAML fixture file,
+// depending on its extension.
+func Load(path string) (*SongServer, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f fixture
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(dat, &f)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(dat, &f)
+	default:
+		return nil, fmt.Errorf("fixture %s isn't a .json or .yaml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fixture %s: %v", path, err)
+	}
+
+	var ts []radio.Track
+	for i, ft := range f.Tracks {
+		if ft.ID == "" {
+			return nil, fmt.Errorf("track %d in fixture %s has no ID", i, path)
+		}
+		t := radio.Track{
+			ID:          ft.ID,
+			Name:        ft.Name,
+			Album:       radio.Album{Name: ft.Album},
+			DurationMS:  ft.DurationMS,
+			Explicit:    ft.Explicit,
+			ExternalIDs: radio.ExternalIDs{ISRC: ft.ISRC},
+			Provider:    Provider,
+		}
+		for _, a := range ft.Artists {
+			t.Artists = append(t.Artists, radio.Artist{ID: ArtistID(a), Name: a})
+		}
+		if ft.ArtURL != "" {
+			t.Album.Images = []radio.Image{{Width: 640, Height: 640, URL: ft.ArtURL}}
+		}
+		ts = append(ts, t)
+	}
+	return New(ts), nil
+}
+
+// SetLatency makes every request take at least d, unless its context is done
+// first.
+func (s *SongServer) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetSearchError makes Search return err, until it's set back to nil.
+func (s *SongServer) SetSearchError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.searchErr = err
+}
+
+// SetTrackError makes Track return err, until it's set back to nil.
+func (s *SongServer) SetTrackError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trackErr = err
+}
+
+// wait sleeps for the configured latency, unless the context is done first,
+// and returns the error configured for the request, which is one of the error
+// fields.
+func (s *SongServer) wait(ctx context.Context, err *error) error {
+	s.mu.Lock()
+	latency, e := s.latency, *err
+	s.mu.Unlock()
+
+	t := time.NewTimer(latency)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return e
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Search returns the tracks where every word of the query matches a word in
+// the name, artists or album, or the artists where every word matches a word
+// of their name, allowing for typos. Closer matches come first. There are no
+// albums or playlists.
+func (s *SongServer) Search(ctx context.Context, query string, opts *radio.SearchOptions) (*radio.SearchResults, error) {
+	if err := s.wait(ctx, &s.searchErr); err != nil {
+		return nil, err
+	}
+
+	o := opts.WithDefaults()
+	res := &radio.SearchResults{}
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return res, nil
+	}
+
+	switch o.Type {
+	case radio.SearchTracks:
+		ts := s.searchTracks(terms)
+		start, end := o.Page(len(ts))
+		res.Tracks, res.Total = ts[start:end], len(ts)
+	case radio.SearchArtists:
+		as := s.searchArtists(terms)
+		start, end := o.Page(len(as))
+		res.Artists, res.Total = as[start:end], len(as)
+	}
+	return res, nil
+}
+
+func (s *SongServer) searchTracks(terms []string) []radio.Track {
+	type match struct {
+		t     radio.Track
+		score int
+	}
+	var matches []match
+	for _, t := range s.tracks {
+		text := []string{t.Name, t.Album.Name}
+		for _, a := range t.Artists {
+			text = append(text, a.Name)
+		}
+		if score, ok := score(text, terms); ok {
+			matches = append(matches, match{t: t, score: score})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].t.Name < matches[j].t.Name
+	})
+
+	ts := make([]radio.Track, len(matches))
+	for i, m := range matches {
+		ts[i] = m.t
+	}
+	return ts
+}
+
+func (s *SongServer) searchArtists(terms []string) []radio.Artist {
+	type match struct {
+		a     radio.Artist
+		score int
+	}
+	var matches []match
+	seen := make(map[string]bool)
+	for _, t := range s.tracks {
+		for _, a := range t.Artists {
+			a.ID = ArtistID(a.Name)
+			if seen[a.ID] {
+				continue
+			}
+			seen[a.ID] = true
+			if score, ok := score([]string{a.Name}, terms); ok {
+				matches = append(matches, match{a: a, score: score})
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].a.Name < matches[j].a.Name
+	})
+
+	as := make([]radio.Artist, len(matches))
+	for i, m := range matches {
+		as[i] = m.a
+	}
+	return as
+}
+
+// Track returns the track with the given ID.
+func (s *SongServer) Track(ctx context.Context, id string) (radio.Track, error) {
+	if err := s.wait(ctx, &s.trackErr); err != nil {
+		return radio.Track{}, err
+	}
+
+	t, ok := s.byID[id]
+	if !ok {
+		return radio.Track{}, ErrNotFound
+	}
+	return t, nil
+}
+
+// ArtistTopTracks returns the artist's first tracks, in the order they were
+// given. It fails like Track does. The market is ignored.
+func (s *SongServer) ArtistTopTracks(ctx context.Context, artistID, market string) ([]radio.Track, error) {
+	if err := s.wait(ctx, &s.trackErr); err != nil {
+		return nil, err
+	}
+
+	var ts []radio.Track
+	for _, t := range s.tracks {
+		for _, a := range t.Artists {
+			if ArtistID(a.Name) == artistID {
+				ts = append(ts, t)
+				break
+			}
+		}
+	}
+	if len(ts) == 0 {
+		return nil, ErrArtistNotFound
+	}
+	if len(ts) > maxTopTracks {
+		ts = ts[:maxTopTracks]
+	}
+	return ts, nil
+}
+
+// ArtistID returns the ID of an artist, which is the words of their name in
+// lowercase with dashes between them, like "fleetwood-mac". It's only based on
+// their name, so tracks don't need IDs for their artists.
+func ArtistID(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	return strings.Join(words, "-")
+}
+
+// score returns how well the text matches the search terms, and false if any
+// of the terms don't match at all. Each term scores by its best match among
+// the words of the text.
+func score(text []string, terms []string) (int, bool) {
+	words := strings.Fields(strings.ToLower(strings.Join(text, " ")))
+
+	total := 0
+	for _, term := range terms {
+		best := 0
+		for _, w := range words {
+			if s := matchWord(term, w); s > best {
+				best = s
+			}
+		}
+		if best == 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total, true
+}
+
+// matchWord scores how well a search term matches a word: 3 for the same
+// word, 2 for part of it, 1 for a likely typo, and 0 for no match.
+func matchWord(term, word string) int {
+	switch {
+	case term == word:
+		return 3
+	case strings.Contains(word, term):
+		return 2
+	case len(term) >= 4 && distance(term, word) <= len(term)/4:
+		return 1
+	}
+	return 0
+}
+
+// distance returns the Levenshtein distance between two strings.
+func distance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	cur := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			// Substitute, delete or insert, whichever is cheapest.
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(br)]
+}
@@ -0,0 +1,166 @@
+package radiotest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLoad(t *testing.T) {
+	s, err := Load("testdata/tracks.yaml")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(s.tracks) == 0 {
+		t.Fatal("Load returned no tracks")
+	}
+
+	path := filepath.Join(t.TempDir(), "tracks.json")
+	dat := []byte(`{"tracks": [{"id": "1", "name": "Dreams", "artists": ["Fleetwood Mac"], "album": "Rumours", "artURL": "/rumours.jpg", "durationMS": 257000, "isrc": "USWB10400049"}]}`)
+	if err := ioutil.WriteFile(path, dat, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	s, err = Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	want := radio.Track{
+		ID:      "1",
+		Name:    "Dreams",
+		Artists: []radio.Artist{{ID: "fleetwood-mac", Name: "Fleetwood Mac"}},
+		Album: radio.Album{
+			Name:   "Rumours",
+			Images: []radio.Image{{Width: 640, Height: 640, URL: "/rumours.jpg"}},
+		},
+		DurationMS:  257000,
+		ExternalIDs: radio.ExternalIDs{ISRC: "USWB10400049"},
+		Provider:    Provider,
+	}
+	got, err := s.Track(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Track (-want +got)\n%s", diff)
+	}
+
+	if _, err := s.Track(context.Background(), "2"); err != ErrNotFound {
+		t.Errorf("Track(2) = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s, err := Load("testdata/tracks.yaml")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	artists := &radio.SearchOptions{Type: radio.SearchArtists}
+	tests := []struct {
+		query string
+		opts  *radio.SearchOptions
+		want  []string
+	}{
+		{"", nil, nil},
+		{"nothing like it", nil, nil},
+		{"dreams", nil, []string{"Dreams"}},
+		// Part of a word.
+		{"reel", nil, []string{"Reelin' in the Years"}},
+		// A typo.
+		{"stely dan dirty", nil, []string{"Dirty Work"}},
+		{"bowie queen", nil, []string{"Under Pressure"}},
+		// Exact matches come before partial ones.
+		{"do it", nil, []string{"Do It Again", "Do It Myself"}},
+		{"queen", nil, []string{"Bohemian Rhapsody", "Under Pressure"}},
+		{"do it", &radio.SearchOptions{Offset: 1}, []string{"Do It Myself"}},
+		{"stely", artists, []string{"Steely Dan"}},
+		{"fire", artists, []string{"Earth, Wind & Fire"}},
+		{"dreams", &radio.SearchOptions{Type: radio.SearchAlbums}, nil},
+	}
+
+	for _, tc := range tests {
+		res, err := s.Search(context.Background(), tc.query, tc.opts)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", tc.query, err)
+		}
+		var got []string
+		for _, tr := range res.Tracks {
+			got = append(got, tr.Name)
+		}
+		for _, a := range res.Artists {
+			got = append(got, a.Name)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Search(%q, %+v) (-want +got)\n%s", tc.query, tc.opts, diff)
+		}
+	}
+}
+
+func TestArtistTopTracks(t *testing.T) {
+	s, err := Load("testdata/tracks.yaml")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	ts, err := s.ArtistTopTracks(context.Background(), "steely-dan", "")
+	if err != nil {
+		t.Fatalf("ArtistTopTracks: %v", err)
+	}
+	var got []string
+	for _, tr := range ts {
+		got = append(got, tr.Name)
+	}
+	if diff := cmp.Diff([]string{"Do It Again", "Reelin' in the Years", "Dirty Work"}, got); diff != "" {
+		t.Errorf("ArtistTopTracks (-want +got)\n%s", diff)
+	}
+
+	if _, err := s.ArtistTopTracks(context.Background(), "nobody", ""); err != ErrArtistNotFound {
+		t.Errorf("ArtistTopTracks(nobody) = %v, want %v", err, ErrArtistNotFound)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := New([]radio.Track{{ID: "1", Name: "Dreams"}})
+
+	errDown := errors.New("service unavailable")
+	s.SetSearchError(errDown)
+	if _, err := s.Search(context.Background(), "dreams", nil); err != errDown {
+		t.Errorf("Search = %v, want %v", err, errDown)
+	}
+	// Only searches fail.
+	if _, err := s.Track(context.Background(), "1"); err != nil {
+		t.Errorf("Track: %v", err)
+	}
+
+	s.SetSearchError(nil)
+	s.SetTrackError(errDown)
+	if _, err := s.Search(context.Background(), "dreams", nil); err != nil {
+		t.Errorf("Search: %v", err)
+	}
+	if _, err := s.Track(context.Background(), "1"); err != errDown {
+		t.Errorf("Track = %v, want %v", err, errDown)
+	}
+
+	s.SetTrackError(nil)
+	s.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	if _, err := s.Track(context.Background(), "1"); err != nil {
+		t.Errorf("Track: %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Track took %s, want at least 20ms", d)
+	}
+	s.SetLatency(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Track(ctx, "1"); err != context.Canceled {
+		t.Errorf("Track = %v, want %v", err, context.Canceled)
+	}
+}
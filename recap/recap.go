@@ -0,0 +1,275 @@
+// Package recap builds the summary of a room that's generated when the room
+// ends, and renders it as a standalone HTML page.
+package recap
+
+import (
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/bcspragu/Radiotation/stats"
+)
+
+// Recap is the end-of-session summary of a room.
+type Recap struct {
+	RoomID      db.RoomID `json:"roomID"`
+	RoomName    string    `json:"roomName"`
+	GeneratedAt time.Time `json:"generatedAt"`
+
+	TopArtists []*stats.ArtistCount `json:"topArtists"`
+	Members    []*Member            `json:"members"`
+
+	// LongestRun is the longest stretch of consecutive tracks that nobody
+	// vetoed.
+	LongestRun int `json:"longestRun"`
+	// MostReacted are the tracks with the most emoji reactions, most first.
+	MostReacted []*TrackCount `json:"mostReacted"`
+
+	Timeline []*Entry    `json:"timeline"`
+	Stats    *stats.Room `json:"stats"`
+}
+
+// Member is the recap for a single member of the room.
+type Member struct {
+	User         *db.User `json:"user"`
+	TracksPlayed int      `json:"tracksPlayed"`
+	// MostUpvoted is the member's track that got the most votes, adding up
+	// every time it played, if any of their tracks got votes.
+	MostUpvoted *TrackCount `json:"mostUpvoted"`
+	// MostVetoed is the member's track that was vetoed the most, if any of
+	// their tracks were vetoed.
+	MostVetoed *TrackCount `json:"mostVetoed"`
+}
+
+// TrackCount is a track, and the number of times something happened to it.
+type TrackCount struct {
+	Track *radio.Track `json:"track"`
+	Count int          `json:"count"`
+}
+
+// Entry is a single track in the timeline of the room.
+type Entry struct {
+	Track    *radio.Track `json:"track"`
+	User     *db.User     `json:"user"`
+	PlayedAt time.Time    `json:"playedAt"`
+	Replay   bool         `json:"replay"`
+	Vetoed   bool         `json:"vetoed"`
+	VetoedBy *db.User     `json:"vetoedBy"`
+}
+
+// Build generates the recap for a room from its members, history and queues.
+func Build(rm *db.Room, users []*db.User, hist []*db.TrackEntry, queues map[db.UserID][]*db.QueueTrack) *Recap {
+	rs := stats.Compute(users, hist, queues)
+
+	byID := make(map[db.UserID]*db.User)
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+
+	rc := &Recap{
+		RoomID:      rm.ID,
+		RoomName:    rm.DisplayName,
+		GeneratedAt: time.Now(),
+		TopArtists:  rs.TopArtists,
+		LongestRun:  longestRun(hist),
+		MostReacted: mostReacted(hist, maxMostReacted),
+		Timeline:    []*Entry{},
+		Stats:       rs,
+	}
+
+	for _, us := range rs.Users {
+		rc.Members = append(rc.Members, &Member{
+			User:         us.User,
+			TracksPlayed: us.TracksPlayed,
+			MostUpvoted:  mostCounted(us.User.ID, hist, upvotes),
+			MostVetoed:   mostCounted(us.User.ID, hist, vetoes),
+		})
+	}
+
+	for _, te := range hist {
+		e := &Entry{
+			Track:    te.Track,
+			User:     byID[te.UserID],
+			PlayedAt: te.PlayedAt,
+			Replay:   te.Replay,
+			Vetoed:   te.Vetoed,
+		}
+		if te.Vetoed {
+			e.VetoedBy = byID[te.VetoedBy]
+		}
+		rc.Timeline = append(rc.Timeline, e)
+	}
+
+	return rc
+}
+
+func longestRun(hist []*db.TrackEntry) int {
+	var best, cur int
+	for _, te := range hist {
+		if te.Vetoed {
+			cur = 0
+			continue
+		}
+		cur++
+		if cur > best {
+			best = cur
+		}
+	}
+	return best
+}
+
+// maxMostReacted is how many tracks are listed in a recap's MostReacted.
+const maxMostReacted = 5
+
+// mostReacted returns up to n of the tracks with the most reactions, adding
+// up reactions from every time a track played.
+func mostReacted(hist []*db.TrackEntry, n int) []*TrackCount {
+	var (
+		counts = make(map[string]*TrackCount)
+		tcs    = []*TrackCount{}
+	)
+	for _, te := range hist {
+		r := te.Reactions()
+		if r == 0 || te.Track == nil {
+			continue
+		}
+		tc, ok := counts[te.Track.ID]
+		if !ok {
+			tc = &TrackCount{Track: te.Track}
+			counts[te.Track.ID] = tc
+			tcs = append(tcs, tc)
+		}
+		tc.Count += r
+	}
+
+	// Ties go to whichever track was reacted to first.
+	sort.SliceStable(tcs, func(i, j int) bool {
+		return tcs[i].Count > tcs[j].Count
+	})
+	if len(tcs) > n {
+		tcs = tcs[:n]
+	}
+	return tcs
+}
+
+func upvotes(te *db.TrackEntry) int {
+	return len(te.UpvotedBy)
+}
+
+func vetoes(te *db.TrackEntry) int {
+	if te.Vetoed {
+		return 1
+	}
+	return 0
+}
+
+// mostCounted returns the user's track with the highest count, adding up the
+// counts from every time it played, or nil if none of their tracks count.
+func mostCounted(uid db.UserID, hist []*db.TrackEntry, count func(*db.TrackEntry) int) *TrackCount {
+	var (
+		counts = make(map[string]*TrackCount)
+		best   *TrackCount
+	)
+	for _, te := range hist {
+		if te.UserID != uid || te.Track == nil {
+			continue
+		}
+		n := count(te)
+		if n == 0 {
+			continue
+		}
+		tc, ok := counts[te.Track.ID]
+		if !ok {
+			tc = &TrackCount{Track: te.Track}
+			counts[te.Track.ID] = tc
+		}
+		tc.Count += n
+		// Ties go to whichever track got there first.
+		if best == nil || tc.Count > best.Count {
+			best = tc
+		}
+	}
+	return best
+}
+
+// HTML writes the recap as a self-contained HTML page.
+func HTML(w io.Writer, rc *Recap) error {
+	return htmlTmpl.Execute(w, rc)
+}
+
+var htmlTmpl = template.Must(template.New("recap").Funcs(template.FuncMap{
+	"name":    userName,
+	"artists": artistNames,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("3:04 PM")
+	},
+}).Parse(htmlSrc))
+
+func userName(u *db.User) string {
+	if u == nil {
+		return "Someone"
+	}
+	return strings.TrimSpace(u.First + " " + u.Last)
+}
+
+func artistNames(t *radio.Track) string {
+	if t == nil {
+		return ""
+	}
+	var names []string
+	for _, a := range t.Artists {
+		names = append(names, a.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+const htmlSrc = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.RoomName}} - Radiotation Recap</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 0 auto; padding: 1em; color: #222; }
+h1 { margin-bottom: 0; }
+.subtitle { color: #777; margin-top: 0.25em; }
+table { width: 100%; border-collapse: collapse; }
+td, th { text-align: left; padding: 0.25em 0.5em; border-bottom: 1px solid #eee; }
+.vetoed { color: #b00; }
+.replay { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.RoomName}}</h1>
+<p class="subtitle">{{.Stats.TracksPlayed}} tracks, {{printf "%.0f" .Stats.TotalMinutes}} minutes, longest run without a veto: {{.LongestRun}}</p>
+
+<h2>Top Artists</h2>
+<ol>
+{{range .TopArtists}}<li>{{.Name}} ({{.Count}})</li>
+{{end}}</ol>
+
+{{if .MostReacted}}<h2>Most Reacted</h2>
+<ol>
+{{range .MostReacted}}<li>{{.Track.Name}} - {{artists .Track}} ({{.Count}})</li>
+{{end}}</ol>
+
+{{end}}<h2>Members</h2>
+<table>
+<tr><th>Name</th><th>Tracks</th><th>Most Upvoted</th><th>Most Vetoed</th></tr>
+{{range .Members}}<tr><td>{{name .User}}</td><td>{{.TracksPlayed}}</td><td>{{with .MostUpvoted}}{{.Track.Name}} ({{.Count}}){{end}}</td><td>{{with .MostVetoed}}{{.Track.Name}} ({{.Count}}){{end}}</td></tr>
+{{end}}</table>
+
+<h2>Timeline</h2>
+<table>
+{{range .Timeline}}<tr{{if .Vetoed}} class="vetoed"{{else if .Replay}} class="replay"{{end}}><td>{{time .PlayedAt}}</td><td>{{.Track.Name}} - {{artists .Track}}</td><td>{{name .User}}{{if .Replay}} (replay){{end}}{{if .Vetoed}} (vetoed by {{name .VetoedBy}}){{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`
@@ -0,0 +1,91 @@
+package recap
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuild(t *testing.T) {
+	var (
+		alice = &db.User{ID: db.UserID("alice"), First: "Alice"}
+		bob   = &db.User{ID: db.UserID("bob"), First: "Bob"}
+
+		wolf  = &radio.Track{ID: "wolf", Name: "Do It Myself", Artists: []radio.Artist{{Name: "Russ"}}}
+		cloud = &radio.Track{ID: "cloud", Name: "There Is a Cloud", Artists: []radio.Artist{{Name: "Elevation Worship"}}}
+		thril = &radio.Track{ID: "thrill", Name: "Can't Buy a Thrill", Artists: []radio.Artist{{Name: "Steely Dan"}}}
+	)
+
+	var (
+		chat  = &db.ChatMessage{Text: "nice"}
+		react = &db.ChatMessage{Text: "🔥", Reaction: true}
+	)
+
+	hist := []*db.TrackEntry{
+		{UserID: alice.ID, Track: wolf, Messages: []*db.ChatMessage{chat, react}, UpvotedBy: []db.UserID{bob.ID}},
+		{UserID: bob.ID, Track: cloud, Vetoed: true, VetoedBy: alice.ID},
+		{UserID: alice.ID, Track: thril, UpvotedBy: []db.UserID{alice.ID, bob.ID}},
+		{UserID: bob.ID, Track: cloud, Messages: []*db.ChatMessage{react, react}},
+		{UserID: alice.ID, Track: wolf, Messages: []*db.ChatMessage{react, chat, react}, UpvotedBy: []db.UserID{alice.ID, bob.ID}},
+		{UserID: bob.ID, Track: thril, Vetoed: true, VetoedBy: alice.ID},
+		{UserID: bob.ID, Track: cloud, Vetoed: true, VetoedBy: alice.ID},
+	}
+
+	rc := Build(&db.Room{ID: db.RoomID("ROOM"), DisplayName: "Test Room"}, []*db.User{alice, bob}, hist, nil)
+
+	if rc.LongestRun != 3 {
+		t.Errorf("LongestRun = %d, want 3", rc.LongestRun)
+	}
+
+	if got := len(rc.Timeline); got != len(hist) {
+		t.Errorf("len(Timeline) = %d, want %d", got, len(hist))
+	}
+
+	if got := rc.Timeline[1].VetoedBy; got != alice {
+		t.Errorf("Timeline[1].VetoedBy = %v, want %v", got, alice)
+	}
+
+	wantMembers := []*Member{
+		// Do It Myself's votes add up across both times it played.
+		{User: alice, TracksPlayed: 3, MostUpvoted: &TrackCount{Track: wolf, Count: 3}},
+		{User: bob, TracksPlayed: 4, MostVetoed: &TrackCount{Track: cloud, Count: 2}},
+	}
+	if diff := cmp.Diff(wantMembers, rc.Members); diff != "" {
+		t.Errorf("Members (-want +got)\n%s", diff)
+	}
+
+	wantReacted := []*TrackCount{
+		{Track: wolf, Count: 3},
+		{Track: cloud, Count: 2},
+	}
+	if diff := cmp.Diff(wantReacted, rc.MostReacted); diff != "" {
+		t.Errorf("MostReacted (-want +got)\n%s", diff)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	u := &db.User{ID: db.UserID("mallory"), First: "<script>", Last: "Mallory"}
+	hist := []*db.TrackEntry{
+		{UserID: u.ID, Track: &radio.Track{ID: "1", Name: "Track One", Artists: []radio.Artist{{Name: "Someone"}}}},
+	}
+	rc := Build(&db.Room{ID: db.RoomID("ROOM"), DisplayName: "Test Room"}, []*db.User{u}, hist, nil)
+
+	var buf bytes.Buffer
+	if err := HTML(&buf, rc); err != nil {
+		t.Fatalf("HTML: %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"Test Room", "Track One - Someone", "&lt;script&gt; Mallory"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("HTML output doesn't contain %q", want)
+		}
+	}
+	if strings.Contains(out, "<script>") {
+		t.Error("HTML output contains unescaped user input")
+	}
+}
@@ -1,133 +1,485 @@
 package spotify
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bcspragu/Radiotation/radio"
 )
 
+// Provider is the name of the SongServer in the tracks it returns.
+const Provider = "spotify"
+
+// DefaultTimeout is how long requests to Spotify can take, if NewSongServer
+// isn't given an HTTP client.
+const DefaultTimeout = 10 * time.Second
+
+const (
+	// maxRetries is how many times a rate limited request is retried before
+	// giving up.
+	maxRetries = 3
+	// maxRetryWait is the longest we'll wait to retry a rate limited request.
+	// If Spotify asks us to wait longer than that, we give up right away.
+	maxRetryWait = 30 * time.Second
+	// defaultRetryWait is how long we wait if Spotify doesn't say.
+	defaultRetryWait = time.Second
+)
+
+// minRenewal is the least time between background renewals of the token, so
+// a token that comes back already expired, or close to it, isn't renewed in a
+// tight loop. Tests lower it.
+var minRenewal = 10 * time.Second
+
+var (
+	ErrUnauthorized = errors.New("spotify: unauthorized")
+	ErrRateLimited  = errors.New("spotify: rate limited")
+	ErrNotFound     = fmt.Errorf("spotify: %w", radio.ErrNotFound)
+)
+
+// Error is returned when Spotify responds with an error status. Use errors.Is
+// with ErrUnauthorized, ErrRateLimited or ErrNotFound to check what kind of
+// error it is.
+type Error struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Message is Spotify's description of the error, if it gave one.
+	Message string
+	// RetryAfter is how long Spotify asked us to wait before trying again, for
+	// rate limited requests.
+	RetryAfter time.Duration
+
+	kind error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("spotify: HTTP %d", e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
 type spotifySongServer struct {
 	apiEndpoint string
 	clientID    string
 	secret      string
+	client      *http.Client
 	tr          *tokenRefresher
 }
 
-type spotifyResponse struct {
-	Tracks radio.Tracks
+// DefaultMarket is the market for an artist's top tracks when none is given,
+// since the API requires one.
+const DefaultMarket = "US"
+
+// searchResponse is a page of search results. Only the type that was asked
+// for is in it.
+type searchResponse struct {
+	Tracks struct {
+		Items []radio.Track `json:"items"`
+		Total int           `json:"total"`
+	} `json:"tracks"`
+	Albums struct {
+		Items []radio.Album `json:"items"`
+		Total int           `json:"total"`
+	} `json:"albums"`
+	Artists struct {
+		Items []radio.Artist `json:"items"`
+		Total int            `json:"total"`
+	} `json:"artists"`
+	Playlists struct {
+		// Playlists that have been deleted come back as nulls.
+		Items []*radio.Playlist `json:"items"`
+		Total int               `json:"total"`
+	} `json:"playlists"`
 }
 
+// tokenRefresher keeps an access token for the API. Only one refresh runs at
+// a time, and requests that need a token while it runs wait for it instead of
+// fetching their own. Tokens are renewed in the background before they
+// expire, so requests rarely have to wait at all.
 type tokenRefresher struct {
-	tkn       string
-	exp       time.Time
+	fetch     func(context.Context) (string, time.Duration, error)
 	threshold time.Duration
+
+	mu      sync.Mutex
+	tkn     string
+	exp     time.Time
+	call    *tokenCall
+	renew   *time.Timer
+	stopped bool
+}
+
+// tokenCall is a refresh that's in flight. done is closed when it finishes.
+type tokenCall struct {
+	done chan struct{}
+	tkn  string
+	err  error
+}
+
+// token returns the current token, waiting for a new one if it has expired.
+func (tr *tokenRefresher) token(ctx context.Context) (string, error) {
+	tr.mu.Lock()
+	if !tr.exp.IsZero() && time.Until(tr.exp) > tr.threshold {
+		tkn := tr.tkn
+		tr.mu.Unlock()
+		return tkn, nil
+	}
+	c := tr.refreshLocked()
+	tr.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.tkn, c.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// invalidate marks tkn as expired, if it's still the current token, so the
+// next request gets a new one. Requests that are rejected at the same time
+// all have the same token, so it's only refreshed once.
+func (tr *tokenRefresher) invalidate(tkn string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.tkn == tkn {
+		tr.exp = time.Time{}
+	}
+}
+
+// refreshLocked starts fetching a new token, unless that's already happening,
+// and returns the refresh. The fetch isn't tied to the context of any one
+// request, since other requests might be waiting on it too. tr.mu must be
+// held.
+func (tr *tokenRefresher) refreshLocked() *tokenCall {
+	if tr.call != nil {
+		return tr.call
+	}
+	c := &tokenCall{done: make(chan struct{})}
+	tr.call = c
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		tkn, ttl, err := tr.fetch(ctx)
+
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		if err == nil {
+			tr.tkn, tr.exp = tkn, time.Now().Add(ttl)
+			tr.scheduleLocked(ttl)
+		}
+		c.tkn, c.err = tkn, err
+		tr.call = nil
+		close(c.done)
+	}()
+	return c
+}
+
+// scheduleLocked renews the token in the background when most of its
+// lifetime is up, but no sooner than minRenewal. tr.mu must be held.
+func (tr *tokenRefresher) scheduleLocked(ttl time.Duration) {
+	if tr.renew != nil {
+		tr.renew.Stop()
+	}
+	if tr.stopped {
+		return
+	}
+	wait := ttl * 9 / 10
+	if wait < minRenewal {
+		wait = minRenewal
+	}
+	tr.renew = time.AfterFunc(wait, func() {
+		tr.mu.Lock()
+		if tr.stopped {
+			tr.mu.Unlock()
+			return
+		}
+		c := tr.refreshLocked()
+		tr.mu.Unlock()
+
+		<-c.done
+		if c.err != nil {
+			// Requests will try again once the token expires.
+			log.Printf("Failed to renew Spotify token: %v", c.err)
+		}
+	})
 }
 
-func (s *spotifySongServer) token() string {
-	remain := s.tr.exp.Sub(time.Now())
-	if !s.tr.exp.IsZero() && remain > s.tr.threshold {
-		log.Printf("Loading cached token, expires in %s", remain.String())
-		return s.tr.tkn
+// stop stops renewing the token in the background.
+func (tr *tokenRefresher) stop() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.stopped = true
+	if tr.renew != nil {
+		tr.renew.Stop()
 	}
-	return s.getToken()
 }
 
-func (s *spotifySongServer) getToken() string {
+// fetchToken gets a new token from the accounts service, and returns it along
+// with how long it's valid for.
+func (s *spotifySongServer) fetchToken(ctx context.Context) (string, time.Duration, error) {
 	u := fmt.Sprintf("https://accounts.%s/api/token", s.apiEndpoint)
 
 	form := url.Values{}
 	form.Add("grant_type", "client_credentials")
 
-	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(form.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
 	if err != nil {
-		log.Println(err)
-		return ""
+		return "", 0, err
 	}
 
 	encoded := base64.StdEncoding.EncodeToString([]byte(s.clientID + ":" + s.secret))
 	req.Header.Set("Authorization", "Basic "+encoded)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.client.Do(req)
 	if err != nil {
-		log.Println(err)
-		return ""
+		return "", 0, fmt.Errorf("failed to get Spotify token: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		// The token endpoint responds with a 400 for bad credentials, not a 401.
+		kind := ErrUnauthorized
+		if resp.StatusCode == http.StatusTooManyRequests {
+			kind = ErrRateLimited
+		}
+		return "", 0, fmt.Errorf("failed to get Spotify token: %w", newError(resp, kind))
+	}
+
 	var tkn struct {
 		AccessToken string `json:"access_token"`
 		ExpiresIn   int    `json:"expires_in"`
 	}
-	err = json.NewDecoder(resp.Body).Decode(&tkn)
-	if err != nil {
-		log.Println(err)
-		return ""
+	if err := json.NewDecoder(resp.Body).Decode(&tkn); err != nil {
+		return "", 0, fmt.Errorf("failed to decode Spotify token: %w", err)
+	}
+	if tkn.AccessToken == "" {
+		return "", 0, errors.New("spotify: token response had no access token")
 	}
-	s.tr.tkn = tkn.AccessToken
-	s.tr.exp = time.Now().Add(time.Duration(tkn.ExpiresIn) * time.Second)
-	return s.tr.tkn
+	return tkn.AccessToken, time.Duration(tkn.ExpiresIn) * time.Second, nil
 }
 
-func NewSongServer(apiEndpoint, clientID, secret string) radio.SongServer {
+// SongServer is a radio.SongServer that keeps a token for the Spotify API
+// fresh in the background. Close stops that.
+type SongServer interface {
+	radio.SongServer
+	io.Closer
+}
+
+// NewSongServer returns a SongServer that looks up tracks with the Spotify API.
+// Requests are made with the given client, which should have a timeout. If
+// it's nil, a client with DefaultTimeout is used.
+func NewSongServer(apiEndpoint, clientID, secret string, client *http.Client) SongServer {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
 	s := &spotifySongServer{
 		apiEndpoint: apiEndpoint,
 		clientID:    clientID,
 		secret:      secret,
-		tr: &tokenRefresher{
-			threshold: 5 * time.Second, // Expire the token 5 seconds before it actually expires
-		},
+		client:      client,
+	}
+	s.tr = &tokenRefresher{
+		fetch:     s.fetchToken,
+		threshold: 5 * time.Second, // Expire the token 5 seconds before it actually expires
+	}
+	// Preload our token. If it fails, we'll try again on the first request.
+	if _, err := s.tr.token(context.Background()); err != nil {
+		log.Printf("Failed to preload Spotify token: %v", err)
 	}
-	s.token() // Preload our token
 	return s
 }
 
-func (s *spotifySongServer) requestWithAuth(u string) *http.Request {
-	r, _ := http.NewRequest(http.MethodGet, u, nil)
-	r.Header.Set("Authorization", "Bearer "+s.token())
-	return r
+// Close stops renewing the token in the background. Requests still work
+// afterwards, but have to wait for a new token once it expires.
+func (s *spotifySongServer) Close() error {
+	s.tr.stop()
+	return nil
 }
 
-func (s *spotifySongServer) Track(id string) (radio.Track, error) {
-	url := fmt.Sprintf("https://api.%s/v1/tracks/%s", s.apiEndpoint, url.QueryEscape(id))
-	req := s.requestWithAuth(url)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return radio.Track{}, fmt.Errorf("error querying Spotify API: %v", err)
+// get makes a GET request to the Spotify API, and decodes the response into
+// v. If the token has been revoked or has expired early, it's refreshed and
+// the request is retried once. Rate limited requests are retried after the
+// wait Spotify asks for, up to maxRetries times.
+func (s *spotifySongServer) get(ctx context.Context, u string, v interface{}) error {
+	refreshed := false
+	for retries := 0; ; {
+		tkn, err := s.tr.token(ctx)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tkn)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("error querying Spotify API: %w", err)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				return fmt.Errorf("error loading data from Spotify API: %w", err)
+			}
+			return nil
+		case http.StatusUnauthorized:
+			apiErr := newError(resp, ErrUnauthorized)
+			resp.Body.Close()
+			if refreshed {
+				return apiErr
+			}
+			refreshed = true
+			s.tr.invalidate(tkn)
+		case http.StatusTooManyRequests:
+			apiErr := newError(resp, ErrRateLimited)
+			resp.Body.Close()
+			if retries >= maxRetries || apiErr.RetryAfter > maxRetryWait {
+				return apiErr
+			}
+			retries++
+			if err := sleep(ctx, apiErr.RetryAfter); err != nil {
+				return err
+			}
+		case http.StatusNotFound:
+			defer resp.Body.Close()
+			return newError(resp, ErrNotFound)
+		default:
+			defer resp.Body.Close()
+			return newError(resp, nil)
+		}
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return radio.Track{}, fmt.Errorf("error reading from Spotify API: %v", err)
+}
+
+// sleep waits for d, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newError returns an Error for the error response, with the message from its
+// body, if there is one. The API and the token endpoint format their errors
+// differently, so we handle both.
+func newError(resp *http.Response, kind error) *Error {
+	e := &Error{StatusCode: resp.StatusCode, kind: kind}
+
+	var body struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
 	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		var code string
+		switch {
+		case body.ErrorDescription != "":
+			e.Message = body.ErrorDescription
+		case json.Unmarshal(body.Error, &apiErr) == nil && apiErr.Message != "":
+			e.Message = apiErr.Message
+		case json.Unmarshal(body.Error, &code) == nil:
+			e.Message = code
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		e.RetryAfter = defaultRetryWait
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		}
+	}
+	return e
+}
+
+func (s *spotifySongServer) Track(ctx context.Context, id string) (radio.Track, error) {
+	url := fmt.Sprintf("https://api.%s/v1/tracks/%s", s.apiEndpoint, url.QueryEscape(id))
 	var track radio.Track
-	err = json.Unmarshal(body, &track)
-	if err != nil {
-		return radio.Track{}, fmt.Errorf("error loading data from Spotify API: %v", err)
+	if err := s.get(ctx, url, &track); err != nil {
+		return radio.Track{}, err
 	}
+	track.Provider = Provider
 	return track, nil
 }
 
-func (s *spotifySongServer) Search(query string) ([]radio.Track, error) {
-	url := fmt.Sprintf("https://api.%s/v1/search?q=%s&type=track", s.apiEndpoint, url.QueryEscape(query))
-	req := s.requestWithAuth(url)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return []radio.Track{}, fmt.Errorf("error querying Spotify API: %v", err)
+func (s *spotifySongServer) Search(ctx context.Context, query string, opts *radio.SearchOptions) (*radio.SearchResults, error) {
+	o := opts.WithDefaults()
+	q := url.Values{}
+	q.Set("q", query)
+	q.Set("type", string(o.Type))
+	q.Set("limit", strconv.Itoa(o.Limit))
+	q.Set("offset", strconv.Itoa(o.Offset))
+	if o.Market != "" {
+		q.Set("market", o.Market)
 	}
-	defer resp.Body.Close()
 
-	var spotifyResp spotifyResponse
-	if err := json.NewDecoder(resp.Body).Decode(&spotifyResp); err != nil {
-		return []radio.Track{}, fmt.Errorf("error loading data from Spotify API: %v", err)
+	var resp searchResponse
+	if err := s.get(ctx, fmt.Sprintf("https://api.%s/v1/search?%s", s.apiEndpoint, q.Encode()), &resp); err != nil {
+		return nil, err
+	}
+
+	res := &radio.SearchResults{}
+	switch o.Type {
+	case radio.SearchTracks:
+		res.Tracks, res.Total = withProvider(resp.Tracks.Items), resp.Tracks.Total
+	case radio.SearchAlbums:
+		res.Albums, res.Total = resp.Albums.Items, resp.Albums.Total
+	case radio.SearchArtists:
+		res.Artists, res.Total = resp.Artists.Items, resp.Artists.Total
+	case radio.SearchPlaylists:
+		for _, p := range resp.Playlists.Items {
+			if p != nil {
+				res.Playlists = append(res.Playlists, *p)
+			}
+		}
+		res.Total = resp.Playlists.Total
+	}
+	return res, nil
+}
+
+func (s *spotifySongServer) ArtistTopTracks(ctx context.Context, artistID, market string) ([]radio.Track, error) {
+	if market == "" {
+		market = DefaultMarket
+	}
+	u := fmt.Sprintf("https://api.%s/v1/artists/%s/top-tracks?market=%s", s.apiEndpoint, url.PathEscape(artistID), url.QueryEscape(market))
+	var resp struct {
+		Tracks []radio.Track `json:"tracks"`
+	}
+	if err := s.get(ctx, u, &resp); err != nil {
+		return nil, err
+	}
+	return withProvider(resp.Tracks), nil
+}
+
+// withProvider sets the provider of tracks from the API.
+func withProvider(ts []radio.Track) []radio.Track {
+	for i := range ts {
+		ts[i].Provider = Provider
 	}
-	return spotifyResp.Tracks.Items, nil
+	return ts
 }
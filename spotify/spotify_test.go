@@ -0,0 +1,420 @@
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeSpotify stands in for the accounts and API hosts of Spotify. The API
+// responds with each of the queued statuses in turn, and then with a 200.
+type fakeSpotify struct {
+	// tokenDelay is how long the accounts host takes to respond, and expiresIn
+	// is how many seconds its tokens last, or an hour if it's zero. They
+	// shouldn't be changed once the server is running.
+	tokenDelay time.Duration
+	expiresIn  int
+
+	mu         sync.Mutex
+	badCreds   bool
+	statuses   []int
+	retryAfter string
+	tokens     int
+	calls      int
+	authHeader []string
+	queries    []url.Values
+}
+
+func (f *fakeSpotify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Host == "accounts.example.com" {
+		time.Sleep(f.tokenDelay)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Host {
+	case "accounts.example.com":
+		if f.badCreds {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_client", "error_description": "Invalid client secret"}`)
+			return
+		}
+		f.tokens++
+		expiresIn := f.expiresIn
+		if expiresIn == 0 {
+			expiresIn = 3600
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", f.tokens),
+			"expires_in":   expiresIn,
+		})
+	case "api.example.com":
+		f.calls++
+		f.authHeader = append(f.authHeader, r.Header.Get("Authorization"))
+		f.queries = append(f.queries, r.URL.Query())
+		if len(f.statuses) > 0 {
+			status := f.statuses[0]
+			f.statuses = f.statuses[1:]
+			if status == http.StatusTooManyRequests && f.retryAfter != "" {
+				w.Header().Set("Retry-After", f.retryAfter)
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"error": {"status": %d, "message": "%s"}}`, status, http.StatusText(status))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/tracks/1":
+			fmt.Fprint(w, `{
+				"id": "1",
+				"name": "Dreams",
+				"artists": [{"id": "08GQAI4eElDnROBrJRGE0X", "name": "Fleetwood Mac"}],
+				"album": {"name": "Rumours", "release_date": "1977-02-04", "images": []},
+				"duration_ms": 257800,
+				"explicit": false,
+				"popularity": 84,
+				"external_ids": {"isrc": "USWB10400049"},
+				"preview_url": "https://p.scdn.co/mp3-preview/1"
+			}`)
+		case "/v1/search":
+			switch r.URL.Query().Get("type") {
+			case "track":
+				fmt.Fprint(w, `{"tracks": {"items": [{"id": "1", "name": "Dreams"}], "total": 120}}`)
+			case "artist":
+				fmt.Fprint(w, `{"artists": {"items": [{"id": "08GQAI4eElDnROBrJRGE0X", "name": "Fleetwood Mac"}], "total": 1}}`)
+			case "playlist":
+				fmt.Fprint(w, `{"playlists": {"items": [null, {"id": "p1", "name": "Soft Rock"}], "total": 2}}`)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": {"status": 400, "message": "unsupported type"}}`)
+			}
+		case "/v1/artists/08GQAI4eElDnROBrJRGE0X/top-tracks":
+			fmt.Fprint(w, `{"tracks": [{"id": "1", "name": "Dreams"}, {"id": "2", "name": "Landslide"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"status": 404, "message": "non existing id"}}`)
+		}
+	default:
+		http.Error(w, "unknown host "+r.Host, http.StatusBadGateway)
+	}
+}
+
+// tokenCount returns how many tokens have been handed out.
+func (f *fakeSpotify) tokenCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tokens
+}
+
+func newTestServer(t *testing.T, f *fakeSpotify) *spotifySongServer {
+	t.Helper()
+	ts := httptest.NewTLSServer(f)
+	t.Cleanup(ts.Close)
+	// The test server's client sends requests for example.com and its
+	// subdomains to the test server.
+	s := NewSongServer("example.com", "client", "secret", ts.Client()).(*spotifySongServer)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestTrack(t *testing.T) {
+	f := &fakeSpotify{}
+	s := newTestServer(t, f)
+
+	got, err := s.Track(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	want := radio.Track{
+		ID:          "1",
+		Name:        "Dreams",
+		Artists:     []radio.Artist{{ID: "08GQAI4eElDnROBrJRGE0X", Name: "Fleetwood Mac"}},
+		Album:       radio.Album{Name: "Rumours", ReleaseDate: "1977-02-04", Images: []radio.Image{}},
+		DurationMS:  257800,
+		Popularity:  84,
+		ExternalIDs: radio.ExternalIDs{ISRC: "USWB10400049"},
+		PreviewURL:  "https://p.scdn.co/mp3-preview/1",
+		Provider:    Provider,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Track (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"Bearer token-1"}, f.authHeader); diff != "" {
+		t.Errorf("Authorization headers (-want +got)\n%s", diff)
+	}
+
+	_, err = s.Track(context.Background(), "2")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Track(2) = %v, want %v", err, ErrNotFound)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Message != "non existing id" {
+		t.Errorf("Track(2) = %#v, want an *Error with Spotify's message", err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	f := &fakeSpotify{statuses: []int{http.StatusInternalServerError}}
+	s := newTestServer(t, f)
+
+	// Errors used to be decoded as empty search results.
+	res, err := s.Search(context.Background(), "dreams", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Search = %v, %v, want a 500 error", res, err)
+	}
+
+	res, err = s.Search(context.Background(), "dreams", nil)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Tracks) != 1 {
+		t.Errorf("Search returned %d tracks, want 1", len(res.Tracks))
+	}
+}
+
+func TestSearchOptions(t *testing.T) {
+	f := &fakeSpotify{}
+	s := newTestServer(t, f)
+	ctx := context.Background()
+
+	res, err := s.Search(ctx, "dreams", &radio.SearchOptions{Limit: 10, Offset: 30, Market: "GB"})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	want := url.Values{
+		"q":      {"dreams"},
+		"type":   {"track"},
+		"limit":  {"10"},
+		"offset": {"30"},
+		"market": {"GB"},
+	}
+	if diff := cmp.Diff(want, f.queries[0]); diff != "" {
+		t.Errorf("query (-want +got)\n%s", diff)
+	}
+	if res.Total != 120 || len(res.Tracks) != 1 || res.Tracks[0].Provider != Provider {
+		t.Errorf("Search = %+v, want a track from Spotify out of 120", res)
+	}
+
+	res, err = s.Search(ctx, "fleetwood", &radio.SearchOptions{Type: radio.SearchArtists})
+	if err != nil {
+		t.Fatalf("Search(artists): %v", err)
+	}
+	if len(res.Artists) != 1 || res.Artists[0].ID != "08GQAI4eElDnROBrJRGE0X" || len(res.Tracks) != 0 {
+		t.Errorf("Search(artists) = %+v, want Fleetwood Mac", res)
+	}
+
+	// Deleted playlists are left out.
+	res, err = s.Search(ctx, "soft rock", &radio.SearchOptions{Type: radio.SearchPlaylists})
+	if err != nil {
+		t.Fatalf("Search(playlists): %v", err)
+	}
+	if diff := cmp.Diff([]radio.Playlist{{ID: "p1", Name: "Soft Rock"}}, res.Playlists); diff != "" {
+		t.Errorf("Search(playlists) (-want +got)\n%s", diff)
+	}
+}
+
+func TestArtistTopTracks(t *testing.T) {
+	f := &fakeSpotify{}
+	s := newTestServer(t, f)
+
+	ts, err := s.ArtistTopTracks(context.Background(), "08GQAI4eElDnROBrJRGE0X", "")
+	if err != nil {
+		t.Fatalf("ArtistTopTracks: %v", err)
+	}
+	if len(ts) != 2 || ts[1].Name != "Landslide" || ts[1].Provider != Provider {
+		t.Errorf("ArtistTopTracks = %+v, want 2 tracks from Spotify", ts)
+	}
+	if got := f.queries[0].Get("market"); got != DefaultMarket {
+		t.Errorf("market = %q, want %q", got, DefaultMarket)
+	}
+
+	if _, err := s.ArtistTopTracks(context.Background(), "nobody", "US"); !errors.Is(err, radio.ErrNotFound) {
+		t.Errorf("ArtistTopTracks(nobody) = %v, want %v", err, radio.ErrNotFound)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	f := &fakeSpotify{
+		statuses:   []int{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		retryAfter: "0",
+	}
+	s := newTestServer(t, f)
+
+	if _, err := s.Search(context.Background(), "dreams", nil); err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if f.calls != 3 {
+		t.Errorf("made %d calls, want 3", f.calls)
+	}
+
+	// Give up after a few retries.
+	f.calls = 0
+	f.statuses = []int{429, 429, 429, 429, 429}
+	if _, err := s.Search(context.Background(), "dreams", nil); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Search = %v, want %v", err, ErrRateLimited)
+	}
+	if f.calls != maxRetries+1 {
+		t.Errorf("made %d calls, want %d", f.calls, maxRetries+1)
+	}
+
+	// Don't wait around if Spotify wants us to wait too long.
+	f.calls = 0
+	f.statuses = []int{http.StatusTooManyRequests}
+	f.retryAfter = "3600"
+	start := time.Now()
+	_, err := s.Search(context.Background(), "dreams", nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter != time.Hour {
+		t.Errorf("Search = %v, want a rate limit error with an hour to wait", err)
+	}
+	if f.calls != 1 {
+		t.Errorf("made %d calls, want 1", f.calls)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Search took %s, want it to give up right away", d)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	f := &fakeSpotify{statuses: []int{http.StatusUnauthorized}}
+	s := newTestServer(t, f)
+
+	if _, err := s.Track(context.Background(), "1"); err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Bearer token-1", "Bearer token-2"}, f.authHeader); diff != "" {
+		t.Errorf("Authorization headers (-want +got)\n%s", diff)
+	}
+
+	// Only refresh once.
+	f.calls = 0
+	f.statuses = []int{http.StatusUnauthorized, http.StatusUnauthorized}
+	if _, err := s.Track(context.Background(), "1"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Track = %v, want %v", err, ErrUnauthorized)
+	}
+	if f.calls != 2 {
+		t.Errorf("made %d calls, want 2", f.calls)
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	f := &fakeSpotify{badCreds: true}
+	s := newTestServer(t, f)
+
+	_, err := s.Search(context.Background(), "dreams", nil)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Search = %v, want %v", err, ErrUnauthorized)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Message != "Invalid client secret" {
+		t.Errorf("Search = %#v, want an *Error with Spotify's message", err)
+	}
+	// We shouldn't call the API without a token.
+	if f.calls != 0 {
+		t.Errorf("made %d calls to the API, want 0", f.calls)
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	f := &fakeSpotify{tokenDelay: 50 * time.Millisecond}
+	s := newTestServer(t, f)
+	s.tr.invalidate("token-1")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Search(context.Background(), "dreams", nil); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Search: %v", err)
+	}
+
+	// One token for the preload, and one shared by all the searches.
+	if n := f.tokenCount(); n != 2 {
+		t.Errorf("fetched %d tokens, want 2", n)
+	}
+}
+
+func TestRefreshCancelled(t *testing.T) {
+	f := &fakeSpotify{tokenDelay: 100 * time.Millisecond}
+	s := newTestServer(t, f)
+	s.tr.invalidate("token-1")
+
+	// A request that gives up waiting doesn't stop the refresh for everyone
+	// else.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.Search(ctx, "dreams", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Search = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := s.Search(context.Background(), "dreams", nil); err != nil {
+		t.Errorf("Search: %v", err)
+	}
+	if n := f.tokenCount(); n != 2 {
+		t.Errorf("fetched %d tokens, want 2", n)
+	}
+}
+
+func TestBackgroundRenewal(t *testing.T) {
+	setMinRenewal(t, 0)
+	f := &fakeSpotify{expiresIn: 1}
+	s := newTestServer(t, f)
+
+	// The token lasts a second, so it should be renewed after 900ms, without
+	// any requests.
+	deadline := time.Now().Add(3 * time.Second)
+	for f.tokenCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("token wasn't renewed in the background")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.Close()
+	n := f.tokenCount()
+	time.Sleep(time.Second)
+	if got := f.tokenCount(); got != n {
+		t.Errorf("fetched %d tokens after stopping, want %d", got, n)
+	}
+}
+
+func TestRenewalAlreadyExpired(t *testing.T) {
+	setMinRenewal(t, 500*time.Millisecond)
+	// Tokens that are already expired when we get them would be renewed right
+	// away, over and over, without a minimum.
+	f := &fakeSpotify{expiresIn: -1}
+	newTestServer(t, f)
+
+	time.Sleep(time.Second)
+	if n := f.tokenCount(); n > 3 {
+		t.Errorf("fetched %d tokens in a second, want at most 3", n)
+	}
+}
+
+// setMinRenewal changes minRenewal for the rest of the test.
+func setMinRenewal(t *testing.T, d time.Duration) {
+	t.Helper()
+
+	old := minRenewal
+	minRenewal = d
+	t.Cleanup(func() { minRenewal = old })
+}
@@ -0,0 +1,17 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+ALTER TABLE Rooms ADD COLUMN owner_id TEXT REFERENCES Users(id);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+CREATE TABLE Rooms_backup (
+  id TEXT,
+  display_name TEXT NOT NULL,
+  normalized_name TEXT NOT NULL,
+  rotator BLOB NOT NULL,
+  rotator_type INTEGER NOT NULL,
+  PRIMARY KEY (id)
+);
+INSERT INTO Rooms_backup SELECT id, display_name, normalized_name, rotator, rotator_type FROM Rooms;
+DROP TABLE Rooms;
+ALTER TABLE Rooms_backup RENAME TO Rooms;
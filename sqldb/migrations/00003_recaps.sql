@@ -0,0 +1,27 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+ALTER TABLE Rooms ADD COLUMN ended BOOLEAN NOT NULL DEFAULT 0 CHECK (ended IN (0,1));
+
+CREATE TABLE Recaps (
+	room_id TEXT,
+	recap BLOB NOT NULL,
+	FOREIGN KEY (room_id) REFERENCES Rooms(id)
+	PRIMARY KEY (room_id)
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP TABLE Recaps;
+
+CREATE TABLE Rooms_backup (
+  id TEXT,
+  display_name TEXT NOT NULL,
+  normalized_name TEXT NOT NULL,
+  rotator BLOB NOT NULL,
+  rotator_type INTEGER NOT NULL,
+  owner_id TEXT REFERENCES Users(id),
+  PRIMARY KEY (id)
+);
+INSERT INTO Rooms_backup SELECT id, display_name, normalized_name, rotator, rotator_type, owner_id FROM Rooms;
+DROP TABLE Rooms;
+ALTER TABLE Rooms_backup RENAME TO Rooms;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+CREATE TABLE Playback (
+	room_id TEXT,
+	history_index INTEGER NOT NULL,
+	paused BOOLEAN NOT NULL CHECK (paused IN (0,1)),
+	position_ms INTEGER NOT NULL,
+	-- Nanoseconds since the Unix epoch.
+	updated_at INTEGER NOT NULL,
+	FOREIGN KEY (room_id) REFERENCES Rooms(id)
+	PRIMARY KEY (room_id)
+);
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+DROP TABLE Playback;
@@ -0,0 +1,120 @@
+// Package migrations registers the migrations that can't be written in SQL.
+// Anything that applies the migrations in this directory has to import it.
+package migrations
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"regexp"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(upTrackProvider, downTrackProvider)
+}
+
+var (
+	spotifyID = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+	libraryID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// guessProvider works out where a track came from, before tracks said so
+// themselves. Spotify and library IDs look different enough to tell apart,
+// and anything else is left blank.
+func guessProvider(id string) string {
+	switch {
+	case spotifyID.MatchString(id):
+		return "spotify"
+	case libraryID.MatchString(id):
+		return "library"
+	}
+	return ""
+}
+
+// upTrackProvider re-encodes the tracks stored in the Tracks and History
+// tables, filling in the provider of each one. Gob ignores the fields that
+// are missing, so the other new metadata is left empty for old tracks.
+func upTrackProvider(tx *sql.Tx) error {
+	tracks, err := loadBlobs(tx, `SELECT id, track FROM Tracks`)
+	if err != nil {
+		return err
+	}
+	for id, dat := range tracks {
+		var t radio.Track
+		if err := gob.NewDecoder(bytes.NewReader(dat)).Decode(&t); err != nil {
+			return fmt.Errorf("failed to decode track %q: %v", id, err)
+		}
+		if t.Provider != "" {
+			continue
+		}
+		t.Provider = guessProvider(t.ID)
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&t); err != nil {
+			return fmt.Errorf("failed to encode track %q: %v", id, err)
+		}
+		if _, err := tx.Exec(`UPDATE Tracks SET track = ? WHERE id = ?`, buf.Bytes(), id); err != nil {
+			return fmt.Errorf("failed to update track %q: %v", id, err)
+		}
+	}
+
+	histories, err := loadBlobs(tx, `SELECT room_id, track_entries FROM History`)
+	if err != nil {
+		return err
+	}
+	for rid, dat := range histories {
+		var entries []*db.TrackEntry
+		if err := gob.NewDecoder(bytes.NewReader(dat)).Decode(&entries); err != nil {
+			return fmt.Errorf("failed to decode history for room %q: %v", rid, err)
+		}
+		for _, te := range entries {
+			if te.Track != nil && te.Track.Provider == "" {
+				te.Track.Provider = guessProvider(te.Track.ID)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+			return fmt.Errorf("failed to encode history for room %q: %v", rid, err)
+		}
+		if _, err := tx.Exec(`UPDATE History SET track_entries = ? WHERE room_id = ?`, buf.Bytes(), rid); err != nil {
+			return fmt.Errorf("failed to update history for room %q: %v", rid, err)
+		}
+	}
+	return nil
+}
+
+// downTrackProvider doesn't need to do anything, since older versions ignore
+// the fields they don't know about when they decode a track.
+func downTrackProvider(tx *sql.Tx) error {
+	return nil
+}
+
+// loadBlobs reads every row of a query for a key and a blob. They're all read
+// before any are updated, since SQLite doesn't like writes to a table while
+// it's being read.
+func loadBlobs(tx *sql.Tx, query string) (map[string][]byte, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := make(map[string][]byte)
+	for rows.Next() {
+		var (
+			key string
+			dat []byte
+		)
+		if err := rows.Scan(&key, &dat); err != nil {
+			return nil, err
+		}
+		blobs[key] = dat
+	}
+	return blobs, rows.Err()
+}
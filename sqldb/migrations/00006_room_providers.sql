@@ -0,0 +1,20 @@
+-- +goose Up
+-- SQL in this section is executed when the migration is applied.
+-- A comma-separated list of provider names, or empty for all of them.
+ALTER TABLE Rooms ADD COLUMN providers TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+-- SQL in this section is executed when the migration is rolled back.
+CREATE TABLE Rooms_backup (
+  id TEXT,
+  display_name TEXT NOT NULL,
+  normalized_name TEXT NOT NULL,
+  rotator BLOB NOT NULL,
+  rotator_type INTEGER NOT NULL,
+  owner_id TEXT REFERENCES Users(id),
+  ended BOOLEAN NOT NULL DEFAULT 0 CHECK (ended IN (0,1)),
+  PRIMARY KEY (id)
+);
+INSERT INTO Rooms_backup SELECT id, display_name, normalized_name, rotator, rotator_type, owner_id, ended FROM Rooms;
+DROP TABLE Rooms;
+ALTER TABLE Rooms_backup RENAME TO Rooms;
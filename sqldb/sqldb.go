@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/bcspragu/Radiotation/db"
 	"github.com/bcspragu/Radiotation/radio"
@@ -20,9 +21,10 @@ import (
 
 var (
 	roomExistsStmt  = `SELECT EXISTS(SELECT 1 FROM Rooms WHERE id = ?)`
-	getRoomStmt     = `SELECT id, display_name, rotator_type FROM Rooms WHERE id = ?`
-	searchRoomsStmt = `SELECT id, display_name, rotator_type FROM Rooms WHERE normalized_name LIKE '%' || ? || '%'`
-	addRoomStmt     = `INSERT INTO Rooms (id, display_name, normalized_name, rotator, rotator_type) VALUES (?, ?, ?, ?, ?)`
+	getRoomStmt     = `SELECT id, display_name, rotator_type, owner_id, ended, providers FROM Rooms WHERE id = ?`
+	searchRoomsStmt = `SELECT id, display_name, rotator_type, owner_id, ended, providers FROM Rooms WHERE normalized_name LIKE '%' || ? || '%'`
+	addRoomStmt     = `INSERT INTO Rooms (id, display_name, normalized_name, rotator, rotator_type, owner_id, providers) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	endRoomStmt     = `UPDATE Rooms SET ended = 1 WHERE id = ?`
 
 	getRotatorStmt    = `SELECT rotator FROM Rooms WHERE id = ?`
 	updateRotatorStmt = `UPDATE Rooms SET rotator = ? WHERE id = ?`
@@ -37,16 +39,21 @@ var (
 		VALUES (?, ?, ?, ?, ?, ?, 0)`
 	getQueueStmt      = `SELECT next_queue_track_id FROM Queues WHERE room_id = ? AND user_id = ?`
 	getQueueTrackStmt = `SELECT previous_id, next_id, played FROM QueueTracks
-		WHERE id = ?`
-	getFirstQueueTrackStmt    = `SELECT id FROM QueueTracks WHERE previous_id IS NULL AND room_id = ? AND user_id = ?`
+		WHERE id = ? AND room_id = ? AND user_id = ?`
+	getFirstQueueTrackStmt    = `SELECT id FROM QueueTracks WHERE previous_id IS NULL AND room_id = ? AND user_id = ? AND id != ?`
 	setQueueTrackPreviousStmt = `UPDATE QueueTracks SET previous_id = ? WHERE id = ?`
 	setQueueTrackNextStmt     = `UPDATE QueueTracks SET next_id = ? WHERE id = ?`
+	setQueueTrackLinksStmt    = `UPDATE QueueTracks SET previous_id = ?, next_id = ? WHERE id = ?`
 	setQueueTrackPlayedStmt   = `UPDATE QueueTracks SET played = 1 WHERE id = ?`
 	removeQueueTrackStmt      = `DELETE FROM QueueTracks WHERE id = ?`
 	getTracksStmt             = `SELECT QueueTracks.id, previous_id, next_id, played, track FROM QueueTracks
 		JOIN Tracks
 		ON QueueTracks.track_id = Tracks.id
 		WHERE room_id = ? AND user_id = ?`
+	getUserTracksStmt = `SELECT track FROM QueueTracks
+		JOIN Tracks
+		ON QueueTracks.track_id = Tracks.id
+		WHERE user_id = ?`
 	nextTrackStmt = `SELECT QueueTracks.id, track, next_id FROM QueueTracks
 	JOIN Tracks
 	ON QueueTracks.track_id = Tracks.id
@@ -58,6 +65,13 @@ var (
 	createHistoryStmt = `INSERT INTO History (room_id, track_entries) VALUES (?, ?)`
 	getHistoryStmt    = `SELECT track_entries FROM History WHERE room_id = ?`
 	updateHistoryStmt = `UPDATE History SET track_entries = ? WHERE room_id = ?`
+
+	getRecapStmt = `SELECT recap FROM Recaps WHERE room_id = ?`
+	addRecapStmt = `INSERT OR REPLACE INTO Recaps (room_id, recap) VALUES (?, ?)`
+
+	getPlaybackStmt    = `SELECT history_index, paused, position_ms, updated_at FROM Playback WHERE room_id = ?`
+	setPlaybackStmt    = `INSERT OR REPLACE INTO Playback (room_id, history_index, paused, position_ms, updated_at) VALUES (?, ?, ?, ?, ?)`
+	updatePlaybackStmt = `UPDATE Playback SET paused = ?, position_ms = ?, updated_at = ? WHERE room_id = ? AND history_index = ?`
 )
 
 // DB implements the Radiotation database API, backed by a SQLite database.
@@ -297,15 +311,26 @@ func loadRoom(s scanner) (*db.Room, error) {
 		id          string
 		displayName string
 		rotatorType int
+		ownerID     sql.NullString
+		ended       bool
+		providers   string
 	}
-	if err := s.Scan(&rr.id, &rr.displayName, &rr.rotatorType); err != nil {
+	if err := s.Scan(&rr.id, &rr.displayName, &rr.rotatorType, &rr.ownerID, &rr.ended, &rr.providers); err != nil {
 		return nil, err
 	}
 
+	var providers []string
+	if rr.providers != "" {
+		providers = strings.Split(rr.providers, ",")
+	}
+
 	return &db.Room{
 		ID:          db.RoomID(rr.id),
 		DisplayName: rr.displayName,
 		RotatorType: db.RotatorType(rr.rotatorType),
+		OwnerID:     db.UserID(rr.ownerID.String),
+		Ended:       rr.ended,
+		Providers:   providers,
 	}, nil
 }
 
@@ -330,6 +355,16 @@ func (s *DB) Room(rid db.RoomID) (*db.Room, error) {
 }
 
 func (s *DB) NextTrack(rID db.RoomID) (*db.User, *radio.Track, error) {
+	return s.nextTrack(rID, false)
+}
+
+func (s *DB) PeekTrack(rID db.RoomID) (*db.User, *radio.Track, error) {
+	return s.nextTrack(rID, true)
+}
+
+// nextTrack finds the next track to play in the room. If peek is true, the
+// transaction is rolled back instead of being committed, so nothing changes.
+func (s *DB) nextTrack(rID db.RoomID, peek bool) (*db.User, *radio.Track, error) {
 	type result struct {
 		user  *db.User
 		track radio.Track
@@ -389,6 +424,11 @@ func (s *DB) NextTrack(rID db.RoomID) (*db.User, *radio.Track, error) {
 				return
 			}
 
+			if peek {
+				tChan <- &result{user: u, track: track}
+				return
+			}
+
 			// Update our next track, because we're taking this one.
 			// next_queue_track_id, room_id, user_id
 			if _, err := tx.Exec(updateNextTrackStmt, nextID, string(rID), u.ID); err != nil {
@@ -495,7 +535,8 @@ func (s *DB) AddRoom(rm *db.Room) (db.RoomID, error) {
 			return
 		}
 
-		_, err = tx.Exec(addRoomStmt, string(id), rm.DisplayName, normalize(rm.DisplayName), rBytes, rm.RotatorType)
+		ownerID := sql.NullString{String: string(rm.OwnerID), Valid: rm.OwnerID != ""}
+		_, err = tx.Exec(addRoomStmt, string(id), rm.DisplayName, normalize(rm.DisplayName), rBytes, rm.RotatorType, ownerID, strings.Join(rm.Providers, ","))
 		if err != nil {
 			resChan <- &result{err: err}
 			return
@@ -556,6 +597,28 @@ func (s *DB) AddUserToRoom(rid db.RoomID, uid db.UserID) error {
 	return <-errChan
 }
 
+func (s *DB) EndRoom(rid db.RoomID) error {
+	errChan := make(chan error)
+	s.dbChan <- func(sdb *sql.DB) {
+		res, err := sdb.Exec(endRoomStmt, string(rid))
+		if err != nil {
+			errChan <- err
+			return
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		if n == 0 {
+			errChan <- db.ErrRoomNotFound
+			return
+		}
+		errChan <- nil
+	}
+	return <-errChan
+}
+
 func addToRotator(tx *sql.Tx, rID db.RoomID) error {
 	rot, err := loadRotator(tx, rID)
 	if err != nil {
@@ -672,74 +735,62 @@ func (s *DB) Tracks(qID db.QueueID, qo *db.QueueOptions) ([]*db.QueueTrack, erro
 	return res.qts, nil
 }
 
-// AddTrack adds a track after the given qtID. If a blank ID is given, the song
-// is added first. The song can't be added before a song that's already played.
-func (s *DB) AddTrack(qID db.QueueID, track *radio.Track, afterQTID string) error {
-	errChan := make(chan error)
+func (s *DB) UserTracks(uid db.UserID) ([]*radio.Track, error) {
+	type result struct {
+		tracks []*radio.Track
+		err    error
+	}
+
+	tChan := make(chan *result)
 	s.dbChan <- func(sdb *sql.DB) {
-		tx, err := sdb.Begin()
+		rows, err := sdb.Query(getUserTracksStmt, uid)
 		if err != nil {
-			errChan <- err
+			tChan <- &result{err: err}
 			return
 		}
-		defer tx.Rollback()
-
-		var (
-			id     = db.RandomTrackID(s.src)
-			prevID sql.NullString
-			nextID sql.NullString
-		)
+		defer rows.Close()
 
-		if afterQTID == "" {
-			// This means they want to insert the track first. First, we look for an existing first track.
-			var firstTrackID string
-			if err := tx.QueryRow(getFirstQueueTrackStmt, string(qID.RoomID), qID.UserID).Scan(&firstTrackID); err == sql.ErrNoRows {
-				// There are no tracks in the queue, we're the first. We can leave
-				// prevID and nextID as null.
-			} else if err != nil {
-				errChan <- err
+		var res result
+		for rows.Next() {
+			var trackBytes []byte
+			if err := rows.Scan(&trackBytes); err != nil {
+				tChan <- &result{err: err}
 				return
-			} else {
-				// No error, we found our first track. Make it the second track now.
-				nextID.Valid = true
-				nextID.String = firstTrackID
 			}
-		} else {
-			// Load the track we want to insert our new track after.
-			prevTrack, err := loadQueueTrack(tx, afterQTID)
-			if err != nil {
-				errChan <- err
+			var t *radio.Track
+			if err := gob.NewDecoder(bytes.NewReader(trackBytes)).Decode(&t); err != nil {
+				tChan <- &result{err: err}
 				return
 			}
-			prevID.Valid = true
-			prevID.String = afterQTID
-			nextID = prevTrack.nextID
+			res.tracks = append(res.tracks, t)
 		}
+		res.err = rows.Err()
+		tChan <- &res
+	}
+	res := <-tChan
+	if res.err != nil {
+		return nil, fmt.Errorf("failed to load tracks for user: %v", res.err)
+	}
+	return res.tracks, nil
+}
 
-		var nextQueueTrackID sql.NullString
-		if err := tx.QueryRow(getQueueStmt, string(qID.RoomID), qID.UserID).Scan(&nextQueueTrackID); err == sql.ErrNoRows {
+// AddTrack adds a track after the given qtID. If a blank ID is given, the song
+// is added first. The song can't be added before a song that's already played.
+func (s *DB) AddTrack(qID db.QueueID, track *radio.Track, afterQTID string) error {
+	errChan := make(chan error)
+	s.dbChan <- func(sdb *sql.DB) {
+		tx, err := sdb.Begin()
+		if err != nil {
 			errChan <- err
 			return
 		}
+		defer tx.Rollback()
 
-		if nextID.Valid {
-			// Before we insert the track, look up the track after us and make sure it
-			// hasn't played yet.
-			nextTrack, err := loadQueueTrack(tx, nextID.String)
-			if err != nil {
-				errChan <- err
-				return
-			}
+		id := db.RandomTrackID(s.src)
 
-			if nextTrack.played {
-				errChan <- errors.New("can't add song before one that's already played")
-				return
-			}
-		}
-
-		// Insert the track, and once that's successful, start updating the
-		// surrounding tracks.
-		if _, err := tx.Exec(addQueueTrackStmt, id, prevID, nextID, track.ID, string(qID.RoomID), qID.UserID); err != nil {
+		// Insert the track with no links, and once that's successful, link it
+		// into the queue.
+		if _, err := tx.Exec(addQueueTrackStmt, id, nil, nil, track.ID, string(qID.RoomID), qID.UserID); err != nil {
 			errChan <- err
 			return
 		}
@@ -755,25 +806,7 @@ func (s *DB) AddTrack(qID db.QueueID, track *radio.Track, afterQTID string) erro
 			return
 		}
 
-		// There are three cases when we need to set ourself as the next track:
-		// 1. If there's no next track to be played
-		// 2. If there is a next track, but we've been added before it.
-		// 3. If there is a next track, and we just got placed in front of it.
-		if !nextQueueTrackID.Valid || (nextQueueTrackID.Valid && afterQTID == "") || (nextQueueTrackID.Valid && nextQueueTrackID.String == nextID.String) {
-			if _, err := tx.Exec(updateNextTrackStmt, id, string(qID.RoomID), qID.UserID); err != nil {
-				errChan <- err
-				return
-			}
-		}
-
-		// If we have a track before this track, update it to point to this track.
-		if _, err := tx.Exec(setQueueTrackNextStmt, id, prevID); err != nil {
-			errChan <- err
-			return
-		}
-
-		// If we have a track after this track, update it to point to this track.
-		if _, err := tx.Exec(setQueueTrackPreviousStmt, id, nextID); err != nil {
+		if err := linkQueueTrack(tx, qID, id, afterQTID); err != nil {
 			errChan <- err
 			return
 		}
@@ -783,6 +816,84 @@ func (s *DB) AddTrack(qID db.QueueID, track *radio.Track, afterQTID string) erro
 	return <-errChan
 }
 
+// linkQueueTrack links the QueueTrack with the given ID into the queue after
+// afterQTID, or first if afterQTID is blank, and updates the tracks around it
+// to point to it. The QueueTrack must not currently be linked into the queue.
+func linkQueueTrack(tx *sql.Tx, qID db.QueueID, id, afterQTID string) error {
+	var (
+		prevID sql.NullString
+		nextID sql.NullString
+	)
+
+	if afterQTID == "" {
+		// This means they want to insert the track first. First, we look for an existing first track.
+		var firstTrackID string
+		if err := tx.QueryRow(getFirstQueueTrackStmt, string(qID.RoomID), qID.UserID, id).Scan(&firstTrackID); err == sql.ErrNoRows {
+			// There are no tracks in the queue, we're the first. We can leave
+			// prevID and nextID as null.
+		} else if err != nil {
+			return err
+		} else {
+			// No error, we found our first track. Make it the second track now.
+			nextID.Valid = true
+			nextID.String = firstTrackID
+		}
+	} else {
+		// Load the track we want to insert our new track after.
+		prevTrack, err := loadQueueTrack(tx, qID, afterQTID)
+		if err != nil {
+			return err
+		}
+		prevID.Valid = true
+		prevID.String = afterQTID
+		nextID = prevTrack.nextID
+	}
+
+	var nextQueueTrackID sql.NullString
+	if err := tx.QueryRow(getQueueStmt, string(qID.RoomID), qID.UserID).Scan(&nextQueueTrackID); err == sql.ErrNoRows {
+		return err
+	}
+
+	if nextID.Valid {
+		// Before we link the track, look up the track after us and make sure it
+		// hasn't played yet.
+		nextTrack, err := loadQueueTrack(tx, qID, nextID.String)
+		if err != nil {
+			return err
+		}
+
+		if nextTrack.played {
+			return errors.New("can't add song before one that's already played")
+		}
+	}
+
+	if _, err := tx.Exec(setQueueTrackLinksStmt, prevID, nextID, id); err != nil {
+		return err
+	}
+
+	// There are three cases when we need to set ourself as the next track:
+	// 1. If there's no next track to be played
+	// 2. If there is a next track, but we've been added before it.
+	// 3. If there is a next track, and we just got placed in front of it.
+	if !nextQueueTrackID.Valid || (nextQueueTrackID.Valid && afterQTID == "") || (nextQueueTrackID.Valid && nextQueueTrackID.String == nextID.String) {
+		if _, err := tx.Exec(updateNextTrackStmt, id, string(qID.RoomID), qID.UserID); err != nil {
+			return err
+		}
+	}
+
+	// If we have a track before this track, update it to point to this track.
+	if _, err := tx.Exec(setQueueTrackNextStmt, id, prevID); err != nil {
+		return err
+	}
+
+	// If we have a track after this track, update it to point to this track.
+	if _, err := tx.Exec(setQueueTrackPreviousStmt, id, nextID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 type queueTrack struct {
 	id     string
 	prevID sql.NullString
@@ -790,9 +901,15 @@ type queueTrack struct {
 	played bool
 }
 
-func loadQueueTrack(tx *sql.Tx, id string) (*queueTrack, error) {
+// loadQueueTrack loads the QueueTrack with the given ID from the queue. It
+// returns db.ErrQueueTrackNotFound if the track is in someone else's queue, so
+// a client can't link another user's tracks into their own queue.
+func loadQueueTrack(tx *sql.Tx, qID db.QueueID, id string) (*queueTrack, error) {
 	qt := queueTrack{id: id}
-	if err := tx.QueryRow(getQueueTrackStmt, id).Scan(&qt.prevID, &qt.nextID, &qt.played); err != nil {
+	err := tx.QueryRow(getQueueTrackStmt, id, string(qID.RoomID), qID.UserID).Scan(&qt.prevID, &qt.nextID, &qt.played)
+	if err == sql.ErrNoRows {
+		return nil, db.ErrQueueTrackNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -812,57 +929,44 @@ func (s *DB) RemoveTrack(qID db.QueueID, qtID string) error {
 		}
 		defer tx.Rollback()
 
-		var (
-			prevID sql.NullString
-			nextID sql.NullString
-			played bool
-		)
-
-		if err := tx.QueryRow(getQueueTrackStmt, qtID).Scan(&prevID, &nextID, &played); err != nil {
+		if err := unlinkQueueTrack(tx, qID, qtID); err != nil {
 			errChan <- err
 			return
 		}
 
-		if played {
-			errChan <- errors.New("can't delete songs that have already played")
-			return
-		}
-
-		var nextQueueTrackID sql.NullString
-		if err := tx.QueryRow(getQueueStmt, string(qID.RoomID), qID.UserID).Scan(&nextQueueTrackID); err == sql.ErrNoRows {
+		if _, err := tx.Exec(removeQueueTrackStmt, qtID); err != nil {
 			errChan <- err
 			return
 		}
 
-		if !nextQueueTrackID.Valid {
-			errChan <- errors.New("something is broken, can't remove a track that exists if it hasn't been played but there's no next_queue_track_id")
-			return
-		}
+		errChan <- tx.Commit()
+	}
+	return <-errChan
+}
 
-		// The song we're removing was the next up, need to set it to the next
-		// track.
-		if nextQueueTrackID.String == qtID {
-			if _, err := tx.Exec(updateNextTrackStmt, nextID, string(qID.RoomID), qID.UserID); err != nil {
-				errChan <- err
-				return
-			}
-		}
+// MoveTrack moves a track that hasn't played yet to after the given
+// afterQTID, or to the front of the queue if afterQTID is blank. Like
+// AddTrack, the track can't be moved before a track that's already played.
+func (s *DB) MoveTrack(qID db.QueueID, qtID, afterQTID string) error {
+	if qtID == afterQTID {
+		return errors.New("can't move a track after itself")
+	}
 
-		// If there was a previous song, we need to update it to point to the next
-		// song, or nothing.
-		if _, err := tx.Exec(setQueueTrackNextStmt, nextID, prevID); err != nil {
+	errChan := make(chan error)
+	s.dbChan <- func(sdb *sql.DB) {
+		tx, err := sdb.Begin()
+		if err != nil {
 			errChan <- err
 			return
 		}
+		defer tx.Rollback()
 
-		// If there was a next song, we need to update it to point to the previous
-		// song, or nothing.
-		if _, err := tx.Exec(setQueueTrackPreviousStmt, prevID, nextID); err != nil {
+		if err := unlinkQueueTrack(tx, qID, qtID); err != nil {
 			errChan <- err
 			return
 		}
 
-		if _, err := tx.Exec(removeQueueTrackStmt, qtID); err != nil {
+		if err := linkQueueTrack(tx, qID, qtID, afterQTID); err != nil {
 			errChan <- err
 			return
 		}
@@ -872,6 +976,55 @@ func (s *DB) RemoveTrack(qID db.QueueID, qtID string) error {
 	return <-errChan
 }
 
+// unlinkQueueTrack takes a track that hasn't played yet out of the queue by
+// pointing the tracks around it at each other, leaving it with no links.
+func unlinkQueueTrack(tx *sql.Tx, qID db.QueueID, qtID string) error {
+	qt, err := loadQueueTrack(tx, qID, qtID)
+	if err != nil {
+		return err
+	}
+	prevID, nextID := qt.prevID, qt.nextID
+
+	if qt.played {
+		return errors.New("can't delete songs that have already played")
+	}
+
+	var nextQueueTrackID sql.NullString
+	if err := tx.QueryRow(getQueueStmt, string(qID.RoomID), qID.UserID).Scan(&nextQueueTrackID); err == sql.ErrNoRows {
+		return err
+	}
+
+	if !nextQueueTrackID.Valid {
+		return errors.New("something is broken, can't remove a track that exists if it hasn't been played but there's no next_queue_track_id")
+	}
+
+	// The song we're removing was the next up, need to set it to the next
+	// track.
+	if nextQueueTrackID.String == qtID {
+		if _, err := tx.Exec(updateNextTrackStmt, nextID, string(qID.RoomID), qID.UserID); err != nil {
+			return err
+		}
+	}
+
+	// If there was a previous song, we need to update it to point to the next
+	// song, or nothing.
+	if _, err := tx.Exec(setQueueTrackNextStmt, nextID, prevID); err != nil {
+		return err
+	}
+
+	// If there was a next song, we need to update it to point to the previous
+	// song, or nothing.
+	if _, err := tx.Exec(setQueueTrackPreviousStmt, prevID, nextID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(setQueueTrackLinksStmt, nil, nil, qtID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (s *DB) History(rid db.RoomID) ([]*db.TrackEntry, error) {
 	type result struct {
 		tracks []*db.TrackEntry
@@ -965,6 +1118,151 @@ func (s *DB) MarkVetoed(rid db.RoomID, uid db.UserID) error {
 	return <-errChan
 }
 
+func (s *DB) Recap(rid db.RoomID) ([]byte, error) {
+	type result struct {
+		recap []byte
+		err   error
+	}
+	rChan := make(chan *result)
+	s.dbChan <- func(sdb *sql.DB) {
+		var res result
+		res.err = sdb.QueryRow(getRecapStmt, string(rid)).Scan(&res.recap)
+		rChan <- &res
+	}
+	res := <-rChan
+	if res.err == sql.ErrNoRows {
+		return nil, db.ErrRecapNotFound
+	}
+	if res.err != nil {
+		return nil, fmt.Errorf("failed to load recap: %v", res.err)
+	}
+	return res.recap, nil
+}
+
+func (s *DB) AddRecap(rid db.RoomID, recap []byte) error {
+	errChan := make(chan error)
+	s.dbChan <- func(sdb *sql.DB) {
+		_, err := sdb.Exec(addRecapStmt, string(rid), recap)
+		errChan <- err
+	}
+	return <-errChan
+}
+
+func (s *DB) Playback(rid db.RoomID) (*db.PlaybackState, error) {
+	type result struct {
+		ps  *db.PlaybackState
+		err error
+	}
+	rChan := make(chan *result)
+	s.dbChan <- func(sdb *sql.DB) {
+		var (
+			ps        db.PlaybackState
+			updatedAt int64
+		)
+		err := sdb.QueryRow(getPlaybackStmt, string(rid)).Scan(&ps.HistoryIndex, &ps.Paused, &ps.PositionMS, &updatedAt)
+		if err != nil {
+			rChan <- &result{err: err}
+			return
+		}
+		ps.UpdatedAt = time.Unix(0, updatedAt)
+		rChan <- &result{ps: &ps}
+	}
+	res := <-rChan
+	if res.err == sql.ErrNoRows {
+		return nil, db.ErrPlaybackNotFound
+	}
+	if res.err != nil {
+		return nil, fmt.Errorf("failed to load playback state: %v", res.err)
+	}
+	return res.ps, nil
+}
+
+func (s *DB) SetPlayback(rid db.RoomID, ps *db.PlaybackState) error {
+	errChan := make(chan error)
+	s.dbChan <- func(sdb *sql.DB) {
+		_, err := sdb.Exec(setPlaybackStmt, string(rid), ps.HistoryIndex, ps.Paused, ps.PositionMS, ps.UpdatedAt.UnixNano())
+		errChan <- err
+	}
+	return <-errChan
+}
+
+func (s *DB) UpdatePlayback(rid db.RoomID, ps *db.PlaybackState) error {
+	errChan := make(chan error)
+	s.dbChan <- func(sdb *sql.DB) {
+		res, err := sdb.Exec(updatePlaybackStmt, ps.Paused, ps.PositionMS, ps.UpdatedAt.UnixNano(), string(rid), ps.HistoryIndex)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		if n == 0 {
+			errChan <- db.ErrPlaybackChanged
+			return
+		}
+		errChan <- nil
+	}
+	return <-errChan
+}
+
+func (s *DB) AddVote(rid db.RoomID, uid db.UserID) (int, error) {
+	type result struct {
+		votes int
+		err   error
+	}
+	resChan := make(chan *result)
+	s.dbChan <- func(sdb *sql.DB) {
+		tx, err := sdb.Begin()
+		if err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		defer tx.Rollback()
+		ts, err := loadTrackEntries(tx.QueryRow(getHistoryStmt, string(rid)))
+		if err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+
+		if len(ts) == 0 {
+			resChan <- &result{err: errors.New("no tracks in history")}
+			return
+		}
+
+		te := ts[len(ts)-1]
+		for _, id := range te.UpvotedBy {
+			if id == uid {
+				resChan <- &result{votes: len(te.UpvotedBy)}
+				return
+			}
+		}
+		te.UpvotedBy = append(te.UpvotedBy, uid)
+
+		teBytes, err := trackEntryBytes(ts)
+		if err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		if _, err := tx.Exec(updateHistoryStmt, teBytes, string(rid)); err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		resChan <- &result{votes: len(te.UpvotedBy)}
+	}
+	res := <-resChan
+	if res.err == sql.ErrNoRows {
+		return 0, db.ErrRoomNotFound
+	}
+	return res.votes, res.err
+}
+
 func (s *DB) uniqueID(tx *sql.Tx) (db.RoomID, error) {
 	i := 0
 	var id string
@@ -1022,3 +1320,104 @@ func (CryptoRandSource) Int63() int64 {
 }
 
 func (CryptoRandSource) Seed(int64) {}
+
+func (s *DB) AddMessage(rid db.RoomID, msg *db.ChatMessage) (int, error) {
+	type result struct {
+		idx int
+		err error
+	}
+	resChan := make(chan *result)
+	s.dbChan <- func(sdb *sql.DB) {
+		tx, err := sdb.Begin()
+		if err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		defer tx.Rollback()
+		ts, err := loadTrackEntries(tx.QueryRow(getHistoryStmt, string(rid)))
+		if err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+
+		if len(ts) == 0 {
+			resChan <- &result{err: errors.New("no tracks in history")}
+			return
+		}
+
+		te := ts[len(ts)-1]
+		msg.ID = db.RandomMessageID(s.src, te.Messages)
+		te.Messages = append(te.Messages, msg)
+
+		teBytes, err := trackEntryBytes(ts)
+		if err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		if _, err := tx.Exec(updateHistoryStmt, teBytes, string(rid)); err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			resChan <- &result{err: err}
+			return
+		}
+		resChan <- &result{idx: len(ts) - 1}
+	}
+	res := <-resChan
+	if res.err == sql.ErrNoRows {
+		return 0, db.ErrRoomNotFound
+	}
+	return res.idx, res.err
+}
+
+func (s *DB) DeleteMessage(rid db.RoomID, idx int, msgID string) error {
+	errChan := make(chan error)
+	s.dbChan <- func(sdb *sql.DB) {
+		tx, err := sdb.Begin()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer tx.Rollback()
+		ts, err := loadTrackEntries(tx.QueryRow(getHistoryStmt, string(rid)))
+		if err != nil {
+			errChan <- err
+			return
+		}
+
+		if idx < 0 || idx >= len(ts) {
+			errChan <- db.ErrMessageNotFound
+			return
+		}
+
+		te, found := ts[idx], false
+		for i, msg := range te.Messages {
+			if msg.ID == msgID {
+				te.Messages = append(te.Messages[:i], te.Messages[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			errChan <- db.ErrMessageNotFound
+			return
+		}
+
+		teBytes, err := trackEntryBytes(ts)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		if _, err := tx.Exec(updateHistoryStmt, teBytes, string(rid)); err != nil {
+			errChan <- err
+			return
+		}
+		errChan <- tx.Commit()
+	}
+	err := <-errChan
+	if err == sql.ErrNoRows {
+		return db.ErrRoomNotFound
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/hub"
+)
+
+// A Moderator decides whether a chat message or reaction can be sent to a
+// room. Returning an error rejects the message, and the error is shown to
+// the sender.
+type Moderator func(rm *db.Room, u *db.User, msg *db.ChatMessage) error
+
+// serveChat sends a chat message about the track that's currently playing.
+func (s *Srv) serveChat(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	var req hub.SendChatCommand
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	msg, err := s.sendChat(u, rm, req.Text, false)
+	if err != nil {
+		return err
+	}
+
+	jsonResp(w, msg)
+	return nil
+}
+
+// serveReact reacts to the track that's currently playing with an emoji.
+func (s *Srv) serveReact(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	var req hub.ReactCommand
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	msg, err := s.sendChat(u, rm, req.Emoji, true)
+	if err != nil {
+		return err
+	}
+
+	jsonResp(w, msg)
+	return nil
+}
+
+// serveDeleteChat deletes a chat message or reaction.
+func (s *Srv) serveDeleteChat(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	var req hub.DeleteChatCommand
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	if err := s.deleteChat(u, rm, req.HistoryIndex, req.MessageID); err != nil {
+		return err
+	}
+
+	jsonResp(w, struct{}{})
+	return nil
+}
+
+// sendChat attaches a chat message or reaction from the user to the track
+// that's currently playing, and sends it to everyone in the room.
+func (s *Srv) sendChat(u *db.User, rm *db.Room, text string, reaction bool) (*db.ChatMessage, error) {
+	if rm.Ended {
+		return nil, errRoomEnded
+	}
+	if err := s.checkMember(rm, u.ID); err != nil {
+		return nil, err
+	}
+
+	if reaction {
+		if err := validReaction(text); err != nil {
+			return nil, err
+		}
+	} else {
+		text = strings.TrimSpace(text)
+		if err := validChat(text); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := &db.ChatMessage{
+		UserID:   u.ID,
+		Text:     text,
+		Reaction: reaction,
+		SentAt:   time.Now(),
+	}
+	if s.cfg.Moderator != nil {
+		if err := s.cfg.Moderator(rm, u, msg); err != nil {
+			return nil, err
+		}
+	}
+
+	idx, err := s.historyDB.AddMessage(rm.ID, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.publish(rm.ID, hub.ChatMessageSent, &hub.ChatMessageEvent{
+		HistoryIndex: idx,
+		Message:      msg,
+	})
+	return msg, nil
+}
+
+// deleteChat deletes a chat message or reaction. The room's owner can delete
+// any message, other members can only delete their own.
+func (s *Srv) deleteChat(u *db.User, rm *db.Room, idx int, msgID string) error {
+	if err := s.checkMember(rm, u.ID); err != nil {
+		return err
+	}
+	if rm.OwnerID != u.ID {
+		hist, err := s.historyDB.History(rm.ID)
+		if err != nil {
+			return err
+		}
+		if idx < 0 || idx >= len(hist) {
+			return db.ErrMessageNotFound
+		}
+
+		msg := findMessage(hist[idx].Messages, msgID)
+		if msg == nil {
+			return db.ErrMessageNotFound
+		}
+		if msg.UserID != u.ID {
+			return errNotOwner
+		}
+	}
+
+	if err := s.historyDB.DeleteMessage(rm.ID, idx, msgID); err != nil {
+		return err
+	}
+
+	s.publish(rm.ID, hub.ChatMessageDeleted, &hub.ChatMessageDeletedEvent{
+		HistoryIndex: idx,
+		MessageID:    msgID,
+	})
+	return nil
+}
+
+func findMessage(msgs []*db.ChatMessage, id string) *db.ChatMessage {
+	for _, msg := range msgs {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// validChat returns an error if the text can't be sent as a chat message.
+func validChat(text string) error {
+	if text == "" {
+		return errors.New("can't send an empty message")
+	}
+	if len(text) > hub.MaxChatBytes {
+		return fmt.Errorf("messages can be at most %d bytes long", hub.MaxChatBytes)
+	}
+	if !utf8.ValidString(text) {
+		return errors.New("message isn't valid UTF-8")
+	}
+	for _, r := range text {
+		// Control characters get escaped to six bytes in JSON, which would
+		// blow past maxMessageSize, and there's no good reason to send them.
+		if unicode.IsControl(r) && r != '\n' {
+			return errors.New("message contains control characters")
+		}
+	}
+	return nil
+}
+
+// validReaction returns an error if the emoji can't be sent as a reaction. It
+// doesn't try to check that it's really an emoji, just that it's short and
+// isn't made up of words.
+func validReaction(emoji string) error {
+	if emoji == "" {
+		return errors.New("can't send an empty reaction")
+	}
+	if len(emoji) > hub.MaxReactionBytes {
+		return fmt.Errorf("reactions can be at most %d bytes long", hub.MaxReactionBytes)
+	}
+	if !utf8.ValidString(emoji) {
+		return errors.New("reaction isn't valid UTF-8")
+	}
+	for _, r := range emoji {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("%q isn't an emoji", emoji)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/hub"
+)
+
+// commandTimeout is how long a command sent over a WebSocket can take. Unlike
+// HTTP requests, commands don't get cancelled when the client goes away.
+const commandTimeout = 10 * time.Second
+
+// handleCommand runs a command sent over a WebSocket, using the same logic as
+// the equivalent REST endpoint.
+func (s *Srv) handleCommand(rm *db.Room, u *db.User, cmd *hub.Command) (interface{}, error) {
+	// The room the connection was registered with may be out of date, like if
+	// it has since ended.
+	rm, err := s.roomDB.Room(rm.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	switch cmd.Type {
+	case hub.AddTrack:
+		var req hub.AddTrackCommand
+		if err := decodePayload(cmd, &req); err != nil {
+			return nil, err
+		}
+		return nil, s.addTrack(ctx, u, rm, req.TrackID, req.Next)
+	case hub.RemoveTrack:
+		var req hub.RemoveTrackCommand
+		if err := decodePayload(cmd, &req); err != nil {
+			return nil, err
+		}
+		return nil, s.removeTrack(u, rm, req.QueueTrackID)
+	case hub.MoveTrack:
+		var req hub.MoveTrackCommand
+		if err := decodePayload(cmd, &req); err != nil {
+			return nil, err
+		}
+		return nil, s.moveTrack(u, rm, req.QueueTrackID, req.AfterID)
+	case hub.Vote:
+		votes, err := s.vote(u, rm)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			Votes int `json:"votes"`
+		}{votes}, nil
+	case hub.VetoTrack:
+		return nil, s.veto(u, rm)
+	case hub.SendChat:
+		var req hub.SendChatCommand
+		if err := decodePayload(cmd, &req); err != nil {
+			return nil, err
+		}
+		msg, err := s.sendChat(u, rm, req.Text, false)
+		if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	case hub.React:
+		var req hub.ReactCommand
+		if err := decodePayload(cmd, &req); err != nil {
+			return nil, err
+		}
+		msg, err := s.sendChat(u, rm, req.Emoji, true)
+		if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	case hub.DeleteChat:
+		var req hub.DeleteChatCommand
+		if err := decodePayload(cmd, &req); err != nil {
+			return nil, err
+		}
+		return nil, s.deleteChat(u, rm, req.HistoryIndex, req.MessageID)
+	default:
+		return nil, fmt.Errorf("unknown command type %q", cmd.Type)
+	}
+}
+
+func decodePayload(cmd *hub.Command, v interface{}) error {
+	if err := json.Unmarshal(cmd.Payload, v); err != nil {
+		return fmt.Errorf("malformed %q command: %v", cmd.Type, err)
+	}
+	return nil
+}
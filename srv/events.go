@@ -0,0 +1,92 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+)
+
+// heartbeatPeriod is how often we write something to idle event streams, so
+// that proxies don't decide the connection is dead.
+const heartbeatPeriod = 15 * time.Second
+
+// serveEvents streams the room's events as Server-Sent Events, for clients
+// that can't use WebSockets. Each event's data is the same JSON message that
+// WebSocket clients get, and sequenced messages use their sequence number as
+// the event ID, so browsers resume where they left off when they reconnect.
+func (s *Srv) serveEvents(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming isn't supported")
+	}
+
+	since, err := lastEventID(r)
+	if err != nil {
+		return err
+	}
+
+	sub := s.h.Subscribe(rm, u, since)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Once we've started streaming, we can't report errors with jsonErr, so we
+	// just stop.
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case f, ok := <-sub.Frames():
+			if !ok {
+				// We fell behind, the client will reconnect and catch up.
+				return nil
+			}
+			if f.Seq > 0 {
+				fmt.Fprintf(w, "id: %d\n", f.Seq)
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", f.Data); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// lastEventID returns the sequence number of the last event the client saw.
+// Browsers send it in the Last-Event-ID header when they reconnect, and
+// clients can pass it as the since parameter on their first connection.
+func lastEventID(r *http.Request) (uint64, error) {
+	str := r.Header.Get("Last-Event-ID")
+	if str == "" {
+		str = r.FormValue("since")
+	}
+	if str == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid event ID %q: %v", str, err)
+	}
+	return id, nil
+}
@@ -0,0 +1,162 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/library"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/gorilla/mux"
+)
+
+var errTrackNotInRoom = errors.New("radiotation: track isn't playing or queued in this room")
+
+// serveArt serves the album art embedded in a track from the local library.
+// Unlike audio, art is available to anyone who's logged in, not just a room's
+// members. Art URLs are part of every library track's images, which end up in
+// search results, queues, history and recaps, and don't say which room they're
+// for, so there's no room to check. Cover art isn't worth protecting the way
+// the audio is.
+func (s *Srv) serveArt(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.user(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	mime, data, err := s.cfg.Library.Art(id)
+	if err == library.ErrNotFound || err == library.ErrNoArt {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load album art for %s: %v", id, err)
+		http.Error(w, "failed to load album art", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mime)
+	// IDs don't change, but the files behind them can be retagged.
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(data)
+}
+
+// serveStream streams the audio of a track from the local library, including
+// parts of it for Range requests. It's only available to the room's members
+// and players, and only while the track is playing or queued in the room.
+//
+// Errors are sent as HTTP statuses instead of JSON, since it's usually an
+// audio element on the other end.
+func (s *Srv) serveStream(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["trackID"]
+	if err := s.stream(w, r, id); err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errNotLoggedIn, errPlayerNotAuthorized:
+			status = http.StatusUnauthorized
+		case errNotMember, errTrackNotInRoom:
+			status = http.StatusForbidden
+		case db.ErrRoomNotFound, library.ErrNotFound:
+			status = http.StatusNotFound
+		default:
+			log.Printf("Failed to stream %s: %v", id, err)
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func (s *Srv) stream(w http.ResponseWriter, r *http.Request, id string) error {
+	rm, err := s.room(r)
+	if err != nil {
+		return err
+	}
+
+	uid, err := s.streamer(r, rm)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkMember(rm, uid); err != nil {
+		return err
+	}
+
+	if err := s.trackInRoom(rm, id); err != nil {
+		return err
+	}
+
+	// With more than one provider, the library's IDs are namespaced.
+	provider, libID := radio.SplitID(id)
+	if provider != "" && provider != library.Provider {
+		return library.ErrNotFound
+	}
+	f, mime, err := s.cfg.Library.Open(libID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", mime)
+	// The ETag changes if the file is replaced or retagged, even though the
+	// ID doesn't.
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%x-%x"`, id, fi.Size(), fi.ModTime().UnixNano()))
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return nil
+}
+
+// streamer returns who's streaming from the room. Players identify themselves
+// with their credential, which counts as the user that registered them, and
+// everyone else with their login cookie.
+func (s *Srv) streamer(r *http.Request, rm *db.Room) (db.UserID, error) {
+	if r.Header.Get("Authorization") != "" {
+		p, err := s.player(r, rm.ID)
+		if err != nil {
+			return "", err
+		}
+		return p.UserID, nil
+	}
+
+	u, err := s.user(r)
+	if err != nil {
+		return "", err
+	}
+	return u.ID, nil
+}
+
+// trackInRoom returns an error if the track isn't playing, or waiting to be
+// played in someone's queue, in the room.
+func (s *Srv) trackInRoom(rm *db.Room, id string) error {
+	hist, err := s.historyDB.History(rm.ID)
+	if err != nil {
+		return err
+	}
+	if len(hist) > 0 {
+		if cur := hist[len(hist)-1]; cur.Track != nil && cur.Track.ID == id {
+			return nil
+		}
+	}
+
+	users, err := s.userDB.Users(rm.ID)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		qts, err := s.queueDB.Tracks(db.QueueID{RoomID: rm.ID, UserID: u.ID}, &db.QueueOptions{Type: db.UnplayedOnly})
+		if err != nil {
+			return err
+		}
+		for _, qt := range qts {
+			if qt.Track != nil && qt.Track.ID == id {
+				return nil
+			}
+		}
+	}
+	return errTrackNotInRoom
+}
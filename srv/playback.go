@@ -0,0 +1,145 @@
+package srv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/hub"
+)
+
+type playbackResp struct {
+	Playback *db.PlaybackState `json:"playback"`
+	// PositionMS is where playback is as of ServerTime, so clients don't have
+	// to work it out themselves.
+	PositionMS int64     `json:"positionMS"`
+	ServerTime time.Time `json:"serverTime"`
+}
+
+// servePlayback returns where playback of the current track is.
+func (s *Srv) servePlayback(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	ps, err := s.playbackDB.Playback(rm.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	jsonResp(w, &playbackResp{
+		Playback:   ps,
+		PositionMS: ps.PositionAt(now),
+		ServerTime: now,
+	})
+	return nil
+}
+
+// serveUpdatePlayback pauses, resumes or seeks within the current track, for
+// everyone in the room.
+func (s *Srv) serveUpdatePlayback(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	if rm.OwnerID != u.ID {
+		return errNotOwner
+	}
+	if rm.Ended {
+		return errRoomEnded
+	}
+
+	var req struct {
+		// HistoryIndex is the history entry the client thinks is playing, so
+		// that updates meant for a track that's since been skipped don't
+		// apply to the next one.
+		HistoryIndex *int `json:"historyIndex"`
+		// Action is one of "pause", "resume" or "seek".
+		Action string `json:"action"`
+		// PositionMS is only used for "seek".
+		PositionMS int64 `json:"positionMS"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	if req.HistoryIndex == nil {
+		return errors.New("no historyIndex given for the playback update")
+	}
+
+	ps, err := s.playbackDB.Playback(rm.ID)
+	if err != nil {
+		return err
+	}
+	if ps.HistoryIndex != *req.HistoryIndex {
+		return db.ErrPlaybackChanged
+	}
+
+	now := time.Now()
+	pos := ps.PositionAt(now)
+	switch req.Action {
+	case "pause":
+		ps.Paused = true
+	case "resume":
+		ps.Paused = false
+	case "seek":
+		if req.PositionMS < 0 {
+			return errors.New("can't seek to before the start of the track")
+		}
+		dur, err := s.durationMS(rm, ps)
+		if err != nil {
+			return err
+		}
+		// Tracks that don't know how long they are get the benefit of the
+		// doubt.
+		if dur > 0 && req.PositionMS > dur {
+			return errors.New("can't seek to past the end of the track")
+		}
+		pos = req.PositionMS
+	default:
+		return fmt.Errorf("unknown playback action %q", req.Action)
+	}
+	ps.PositionMS, ps.UpdatedAt = pos, now
+
+	// The next track could have started since we loaded the state, so only
+	// write it if this one is still playing.
+	if err := s.playbackDB.UpdatePlayback(rm.ID, ps); err != nil {
+		return err
+	}
+	s.publish(rm.ID, hub.PlaybackChanged, &hub.PlaybackChangedEvent{Playback: ps})
+
+	jsonResp(w, &playbackResp{
+		Playback:   ps,
+		PositionMS: pos,
+		ServerTime: now,
+	})
+	return nil
+}
+
+// durationMS returns how long the track that's playing is, in milliseconds, or
+// 0 if it doesn't say.
+func (s *Srv) durationMS(rm *db.Room, ps *db.PlaybackState) (int64, error) {
+	hist, err := s.historyDB.History(rm.ID)
+	if err != nil {
+		return 0, err
+	}
+	if ps.HistoryIndex < 0 || ps.HistoryIndex >= len(hist) {
+		return 0, fmt.Errorf("history entry %d is playing, but room %s only has %d", ps.HistoryIndex, rm.ID, len(hist))
+	}
+	if t := hist[ps.HistoryIndex].Track; t != nil {
+		return int64(t.DurationMS), nil
+	}
+	return 0, nil
+}
+
+// startPlayback records that the history entry at the given index just
+// started playing. Playback state is best effort, so failures are logged
+// instead of failing whatever started the track.
+func (s *Srv) startPlayback(rm *db.Room, idx int) {
+	ps := &db.PlaybackState{
+		HistoryIndex: idx,
+		UpdatedAt:    time.Now(),
+	}
+	if err := s.playbackDB.SetPlayback(rm.ID, ps); err != nil {
+		log.Printf("Failed to start playback of %d in room %s: %v", idx, rm.ID, err)
+		return
+	}
+	s.publish(rm.ID, hub.PlaybackChanged, &hub.PlaybackChangedEvent{Playback: ps})
+}
@@ -0,0 +1,101 @@
+package srv
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/gorilla/securecookie"
+)
+
+// debugPlayerID is recorded in the history for tracks popped through the
+// unauthenticated debug endpoint.
+const debugPlayerID = "debug"
+
+var errPlayerNotAuthorized = errors.New("radiotation: player not authorized for room")
+
+// playerCredential is handed out to a player device, and identifies it when it
+// advances a room. It can't be used for any room other than the one it was
+// created for.
+type playerCredential struct {
+	PlayerID string
+	RoomID   db.RoomID
+	// UserID is the user that registered the player.
+	UserID db.UserID
+}
+
+type playerHandler func(http.ResponseWriter, *http.Request, *playerCredential, *db.Room) error
+
+func (s *Srv) withRoomAndPlayer(ph playerHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rm, err := s.room(r)
+		if err != nil {
+			jsonErr(w, err)
+			return
+		}
+
+		p, err := s.player(r, rm.ID)
+		if err != nil {
+			jsonErr(w, err)
+			return
+		}
+
+		if err := ph(w, r, p, rm); err != nil {
+			jsonErr(w, err)
+			return
+		}
+	}
+}
+
+// serveCreatePlayer registers a new player device for the room, and returns
+// the credential it should send with each request.
+func (s *Srv) serveCreatePlayer(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	// Only members of a room can register players for it.
+	if _, err := s.queueDB.Tracks(db.QueueID{RoomID: rm.ID, UserID: u.ID}, &db.QueueOptions{Type: db.PlayedOnly}); err != nil {
+		return err
+	}
+
+	id := securecookie.GenerateRandomKey(12)
+	if id == nil {
+		return errors.New("Failed to generate player ID")
+	}
+
+	p := &playerCredential{
+		PlayerID: base64.RawURLEncoding.EncodeToString(id),
+		RoomID:   rm.ID,
+		UserID:   u.ID,
+	}
+
+	tkn, err := s.sc.Encode("player", p)
+	if err != nil {
+		return err
+	}
+
+	jsonResp(w, struct {
+		ID    string
+		Token string
+	}{p.PlayerID, tkn})
+	return nil
+}
+
+// player loads the player credential from the Authorization header of the
+// request, and checks that it was issued for the given room.
+func (s *Srv) player(r *http.Request, rid db.RoomID) (*playerCredential, error) {
+	tkn := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tkn == "" {
+		return nil, errPlayerNotAuthorized
+	}
+
+	var p *playerCredential
+	if err := s.sc.Decode("player", tkn, &p); err != nil {
+		return nil, errPlayerNotAuthorized
+	}
+
+	if p.RoomID != rid {
+		return nil, errPlayerNotAuthorized
+	}
+
+	return p, nil
+}
@@ -2,6 +2,7 @@ package srv
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
@@ -10,41 +11,49 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"firebase.google.com/go/auth"
 	"github.com/NaySoftware/go-fcm"
 	"github.com/bcspragu/Radiotation/db"
 	"github.com/bcspragu/Radiotation/hub"
+	"github.com/bcspragu/Radiotation/library"
 	"github.com/bcspragu/Radiotation/radio"
+	"github.com/bcspragu/Radiotation/recap"
+	"github.com/bcspragu/Radiotation/stats"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/websocket"
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
 	errNotLoggedIn = errors.New("radiotation: user not found")
+	errNotOwner    = errors.New("radiotation: only the room owner can do that")
+	errRoomEnded   = errors.New("radiotation: room has ended")
+	errNotMember   = errors.New("radiotation: not a member of the room")
 )
 
+// vetoEnabled turns on vetoing, which isn't ready yet. Until it is, every veto
+// fails, and histories never record one.
+const vetoEnabled = false
+
 type Srv struct {
 	sc         *securecookie.SecureCookie
 	h          *hub.Hub
 	mux        *mux.Router
+	upgrader   *websocket.Upgrader
 	fcm        *fcm.FcmClient
 	authClient *auth.Client
 	cfg        *Config
 
-	roomDB    db.RoomDB
-	userDB    db.UserDB
-	queueDB   db.QueueDB
-	historyDB db.HistoryDB
+	roomDB     db.RoomDB
+	userDB     db.UserDB
+	queueDB    db.QueueDB
+	historyDB  db.HistoryDB
+	recapDB    db.RecapDB
+	playbackDB db.PlaybackDB
 }
 
 type Config struct {
@@ -52,6 +61,28 @@ type Config struct {
 	SongServer radio.SongServer
 	FCMKey     string
 	AuthClient *auth.Client
+
+	// DebugPop allows anyone to advance a room with a GET request to
+	// /api/room/{id}/pop, without a player credential.
+	DebugPop bool
+
+	// AllowedOrigins are the origins, like https://example.com, that browsers
+	// can open WebSocket connections from, in addition to the server's own.
+	AllowedOrigins []string
+
+	// Broker passes room events between servers. If it's nil, events stay in
+	// this server.
+	Broker hub.Broker
+	// HubOptions configure the hub that clients connect to. It can be nil.
+	HubOptions *hub.Options
+
+	// Library is the local music library that SongServer serves tracks from,
+	// if there is one, which makes its album art available too.
+	Library *library.Library
+
+	// Moderator checks chat messages and reactions before they're sent. If
+	// it's nil, everything is allowed.
+	Moderator Moderator
 }
 
 // New returns an initialized server.
@@ -63,7 +94,6 @@ func New(sdb db.DB, cfg *Config) (*Srv, error) {
 
 	s := &Srv{
 		sc:         sc,
-		h:          hub.New(),
 		fcm:        fcm.NewFcmClient(cfg.FCMKey),
 		cfg:        cfg,
 		authClient: cfg.AuthClient,
@@ -71,8 +101,22 @@ func New(sdb db.DB, cfg *Config) (*Srv, error) {
 		userDB:     sdb,
 		queueDB:    sdb,
 		historyDB:  sdb,
+		recapDB:    sdb,
+		playbackDB: sdb,
 	}
 
+	s.upgrader = &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin(cfg.AllowedOrigins),
+	}
+	b := cfg.Broker
+	if b == nil {
+		b = hub.NewMemoryBroker()
+	}
+	if s.h, err = hub.New(b, s.handleCommand, cfg.HubOptions); err != nil {
+		return nil, err
+	}
 	s.mux = s.initMux()
 
 	return s, nil
@@ -89,10 +133,32 @@ func (s *Srv) initMux() *mux.Router {
 	// Search for a song.
 	m.HandleFunc("/api/room/{id}/search", s.withRoomAndUser(s.serveSearch)).Methods("GET")
 
-	// Get the next song. This should be a POST action, but its GET for
-	// debugging.
-	m.HandleFunc("/api/room/{id}/pop", s.serveSong).Methods("GET")
+	// Register a player device for a room.
+	m.HandleFunc("/api/room/{id}/player", s.withRoomAndUser(s.serveCreatePlayer)).Methods("POST")
+	// Get the next song, as a registered player.
+	m.HandleFunc("/api/room/{id}/pop", s.withRoomAndPlayer(s.servePop)).Methods("POST")
+	if s.cfg.DebugPop {
+		// Get the next song with no credentials, for debugging.
+		m.HandleFunc("/api/room/{id}/pop", s.serveDebugPop).Methods("GET")
+	}
 	m.HandleFunc("/api/room/{id}/veto", s.withRoomAndUser(s.serveVeto)).Methods("POST")
+	// Go back and replay the previous song.
+	m.HandleFunc("/api/room/{id}/previous", s.withRoomAndUser(s.servePrevious)).Methods("POST")
+
+	// Where playback of the current track is, and changing it.
+	m.HandleFunc("/api/room/{id}/playback", s.withRoomAndUser(s.servePlayback)).Methods("GET")
+	m.HandleFunc("/api/room/{id}/playback", s.withRoomAndUser(s.serveUpdatePlayback)).Methods("POST")
+	// Who is connected to a room right now.
+	m.HandleFunc("/api/room/{id}/presence", s.withRoomAndMember(s.servePresence)).Methods("GET")
+	// Listening statistics for a room.
+	m.HandleFunc("/api/room/{id}/stats", s.withRoomAndMember(s.serveStats)).Methods("GET")
+	// How similar the taste of each pair of members is.
+	m.HandleFunc("/api/room/{id}/similarity", s.withRoomAndMember(s.serveSimilarity)).Methods("GET")
+	// End a room, and generate its recap.
+	m.HandleFunc("/api/room/{id}/end", s.withRoomAndUser(s.serveEndRoom)).Methods("POST")
+	// Load the recap for a room that has ended.
+	m.HandleFunc("/api/room/{id}/recap", s.withRoomAndMember(s.serveRecap)).Methods("GET")
+	m.HandleFunc("/api/room/{id}/recap.html", s.withRoomAndMember(s.serveRecapHTML)).Methods("GET")
 
 	// Create a room.
 	m.HandleFunc("/api/room", s.serveCreateRoom).Methods("POST")
@@ -102,13 +168,46 @@ func (s *Srv) initMux() *mux.Router {
 	m.HandleFunc("/api/room/{id}/addLast", s.withRoomAndUser(s.addToQueueLast)).Methods("POST")
 	// Remove a song from a queue.
 	m.HandleFunc("/api/room/{id}/remove", s.withRoomAndUser(s.removeFromQueue)).Methods("POST")
+	// Move a track within the user's queue.
+	m.HandleFunc("/api/room/{id}/move", s.withRoomAndUser(s.serveMove)).Methods("POST")
+	// Vote for the track that's currently playing.
+	m.HandleFunc("/api/room/{id}/vote", s.withRoomAndUser(s.serveVote)).Methods("POST")
+	// Chat about, or react to, the track that's currently playing.
+	m.HandleFunc("/api/room/{id}/chat", s.withRoomAndUser(s.serveChat)).Methods("POST")
+	m.HandleFunc("/api/room/{id}/react", s.withRoomAndUser(s.serveReact)).Methods("POST")
+	// Delete a chat message or reaction.
+	m.HandleFunc("/api/room/{id}/chat/delete", s.withRoomAndUser(s.serveDeleteChat)).Methods("POST")
 
 	// WebSocket handler for new songs.
 	m.HandleFunc("/api/ws/room/{id}", s.serveData).Methods("GET")
+	// Server-Sent Events, for clients that can't use WebSockets.
+	m.HandleFunc("/api/room/{id}/events", s.withRoomAndMember(s.serveEvents)).Methods("GET")
+
+	if s.cfg.Library != nil {
+		// Album art from the local library.
+		m.HandleFunc("/api/art/{id}", s.serveArt).Methods("GET")
+		// Audio from the local library, for tracks in the room.
+		m.HandleFunc("/api/room/{id}/stream/{trackID}", s.serveStream).Methods("GET", "HEAD")
+	}
 
 	return m
 }
 
+// Close disconnects every client, which should happen before the HTTP server
+// is shut down, because it doesn't wait on connections that have been upgraded
+// to WebSockets, and it does wait on event streams.
+func (s *Srv) Close() {
+	s.h.Close()
+}
+
+// MetricsHandler returns a handler that serves the hub's per-room metrics as
+// JSON. They include every room ID, so it shouldn't be served publicly.
+func (s *Srv) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonResp(w, s.h.Metrics())
+	})
+}
+
 func (s *Srv) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
@@ -123,14 +222,14 @@ func (s *Srv) serveUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Srv) addToQueueNext(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
-	return s.addToQueue(w, r, u, rm, s.addNext)
+	return s.addToQueue(w, r, u, rm, true)
 }
 
 func (s *Srv) addToQueueLast(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
-	return s.addToQueue(w, r, u, rm, s.addLast)
+	return s.addToQueue(w, r, u, rm, false)
 }
 
-func (s *Srv) addToQueue(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room, add func(db.QueueID, *radio.Track) error) error {
+func (s *Srv) addToQueue(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room, next bool) error {
 	var req struct {
 		ID string `json:"id"`
 	}
@@ -138,15 +237,10 @@ func (s *Srv) addToQueue(w http.ResponseWriter, r *http.Request, u *db.User, rm
 		return err
 	}
 
-	track, err := s.track(req.ID)
-	if err != nil {
+	if err := s.addTrack(r.Context(), u, rm, req.ID, next); err != nil {
 		return err
 	}
 
-	if err := add(db.QueueID{RoomID: rm.ID, UserID: u.ID}, &track); err != nil {
-		log.Println(err)
-	}
-
 	jsonResp(w, struct{ ID string }{req.ID})
 	return nil
 }
@@ -159,53 +253,116 @@ func (s *Srv) removeFromQueue(w http.ResponseWriter, r *http.Request, u *db.User
 		return err
 	}
 
-	if err := s.queueDB.RemoveTrack(db.QueueID{RoomID: rm.ID, UserID: u.ID}, req.QueueTrackID); err != nil {
-		log.Println(err)
+	if err := s.removeTrack(u, rm, req.QueueTrackID); err != nil {
+		return err
 	}
 
 	jsonResp(w, struct{}{})
 	return nil
 }
 
-func (s *Srv) queueAction(w http.ResponseWriter, r *http.Request, remove bool) {
+func (s *Srv) serveMove(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	var req struct {
+		QueueTrackID string `json:"queueTrackID"`
+		AfterID      string `json:"afterID"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	if err := s.moveTrack(u, rm, req.QueueTrackID, req.AfterID); err != nil {
+		return err
+	}
+
+	jsonResp(w, struct{}{})
+	return nil
 }
 
-func (s *Srv) serveSong(w http.ResponseWriter, r *http.Request) {
-	contTkn := r.FormValue("continuationToken")
-	if contTkn != "" {
-		// TODO: Don't load a new song, get it from history.
+// addTrack adds the track with the given ID to the user's queue, either to be
+// played next or at the end.
+func (s *Srv) addTrack(ctx context.Context, u *db.User, rm *db.Room, trackID string, next bool) error {
+	if rm.Ended {
+		return errRoomEnded
+	}
+
+	track, err := s.track(ctx, rm, trackID)
+	if err != nil {
+		return err
 	}
 
+	add := s.addLast
+	if next {
+		add = s.addNext
+	}
+
+	if err := add(db.QueueID{RoomID: rm.ID, UserID: u.ID}, &track); err != nil {
+		return err
+	}
+
+	s.queueChanged(rm, u)
+	return nil
+}
+
+func (s *Srv) removeTrack(u *db.User, rm *db.Room, qtID string) error {
+	if rm.Ended {
+		return errRoomEnded
+	}
+
+	if err := s.queueDB.RemoveTrack(db.QueueID{RoomID: rm.ID, UserID: u.ID}, qtID); err != nil {
+		return err
+	}
+
+	s.queueChanged(rm, u)
+	return nil
+}
+
+func (s *Srv) moveTrack(u *db.User, rm *db.Room, qtID, afterID string) error {
+	if rm.Ended {
+		return errRoomEnded
+	}
+
+	if err := s.queueDB.MoveTrack(db.QueueID{RoomID: rm.ID, UserID: u.ID}, qtID, afterID); err != nil {
+		return err
+	}
+
+	s.queueChanged(rm, u)
+	return nil
+}
+
+func (s *Srv) queueAction(w http.ResponseWriter, r *http.Request, remove bool) {
+}
+
+func (s *Srv) servePop(w http.ResponseWriter, r *http.Request, p *playerCredential, rm *db.Room) error {
+	return s.pop(w, r, rm, p.PlayerID)
+}
+
+// serveDebugPop is an unauthenticated version of servePop, which is only
+// registered when DebugPop is set in the config.
+func (s *Srv) serveDebugPop(w http.ResponseWriter, r *http.Request) {
 	rm, err := s.room(r)
 	if err != nil {
 		jsonErr(w, err)
 		return
 	}
 
-	u, t, err := s.roomDB.NextTrack(rm.ID)
-	if err == db.ErrNoTracksInQueue {
-		jsonErr(w, errors.New("No tracks to choose from"))
-		return
-	} else if err != nil {
+	if err := s.pop(w, r, rm, debugPlayerID); err != nil {
 		jsonErr(w, err)
 		return
 	}
+}
 
-	idx, err := s.historyDB.AddToHistory(rm.ID, &db.TrackEntry{
-		Track:  t,
-		UserID: u.ID,
-	})
-	if err != nil {
-		jsonErr(w, fmt.Errorf("failed to add track %v from user %s to history for room %s: %v", t, u.ID, rm.ID, err))
-		return
+func (s *Srv) pop(w http.ResponseWriter, r *http.Request, rm *db.Room, playerID string) error {
+	contTkn := r.FormValue("continuationToken")
+	if contTkn != "" {
+		// TODO: Don't load a new song, get it from history.
 	}
 
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(t); err != nil {
-		jsonErr(w, err)
-		return
+	te, idx, err := s.advance(rm, playerID)
+	if err == db.ErrNoTracksInQueue {
+		return errors.New("No tracks to choose from")
+	} else if err != nil {
+		return err
 	}
-	s.h.BroadcastRoom(buf.Bytes(), rm)
 
 	type trackResponse struct {
 		Error             bool
@@ -217,23 +374,161 @@ func (s *Srv) serveSong(w http.ResponseWriter, r *http.Request) {
 	ct, err := makeContinuationToken(&continuationToken{
 		HistoryIndex: idx,
 		RoomID:       rm.ID,
-		UserID:       u.ID,
-		TrackID:      t.ID,
+		UserID:       te.UserID,
+		TrackID:      te.Track.ID,
 	})
 	if err != nil {
 		log.Printf("Failed to generate continuation token: %v", err)
 	}
 
-	err = json.NewEncoder(w).Encode(trackResponse{
-		Track:             t,
+	jsonResp(w, trackResponse{
+		Track:             te.Track,
 		ContinuationToken: ct,
 	})
+	return nil
+}
+
+// advance moves the room on to the next track in the rotation, records it in
+// the room's history, and lets everyone in the room know about it.
+func (s *Srv) advance(rm *db.Room, playerID string) (*db.TrackEntry, int, error) {
+	if rm.Ended {
+		return nil, 0, errRoomEnded
+	}
+
+	u, t, err := s.roomDB.NextTrack(rm.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	te := &db.TrackEntry{
+		Track:    t,
+		UserID:   u.ID,
+		PlayerID: playerID,
+		PlayedAt: time.Now(),
+	}
+	idx, err := s.historyDB.AddToHistory(rm.ID, te)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to add track %v from user %s to history for room %s: %v", t, u.ID, rm.ID, err)
+	}
+
+	s.publish(rm.ID, hub.TrackChanged, &hub.TrackChangedEvent{
+		Track:        t,
+		UserID:       u.ID,
+		HistoryIndex: idx,
+	})
+	s.startPlayback(rm, idx)
+	s.notifyUpNext(rm)
+
+	return te, idx, nil
+}
+
+// queueChanged tells the room that a user's queue changed. Any change can
+// change which track plays next, so the user who's up next hears about it too.
+func (s *Srv) queueChanged(rm *db.Room, u *db.User) {
+	s.publish(rm.ID, hub.QueueChanged, &hub.QueueChangedEvent{UserID: u.ID})
+	s.notifyUpNext(rm)
+}
+
+// notifyUpNext lets the user whose track is going to play next know about it.
+func (s *Srv) notifyUpNext(rm *db.Room) {
+	u, t, err := s.roomDB.PeekTrack(rm.ID)
+	if err == db.ErrNoTracksInQueue {
+		return
+	} else if err != nil {
+		log.Printf("Failed to load next track for room %s: %v", rm.ID, err)
+		return
+	}
+
+	if err := s.h.SendUser(rm.ID, u.ID, hub.UpNext, &hub.UpNextEvent{Track: t}); err != nil {
+		log.Printf("Failed to send %q event to user %s in room %s: %v", hub.UpNext, u.ID, rm.ID, err)
+	}
+}
+
+// publish sends an event to everyone in the room. Events are best effort, so
+// failures are logged instead of failing whatever caused the event.
+func (s *Srv) publish(rid db.RoomID, typ hub.EventType, payload interface{}) {
+	if err := s.h.Publish(rid, typ, payload); err != nil {
+		log.Printf("Failed to publish %q event to room %s: %v", typ, rid, err)
+	}
+}
+
+// servePrevious replays the track before the one that's currently playing.
+// The replay is added to the history, but doesn't touch the room's rotation,
+// so nobody loses their turn because of it.
+func (s *Srv) servePrevious(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	if rm.OwnerID != u.ID {
+		return errNotOwner
+	}
+	if rm.Ended {
+		return errRoomEnded
+	}
+
+	hist, err := s.historyDB.History(rm.ID)
+	if err != nil {
+		return err
+	}
+
+	prev, err := previousIndex(hist)
+	if err != nil {
+		return err
+	}
+
+	te := &db.TrackEntry{
+		Track:    hist[prev].Track,
+		UserID:   hist[prev].UserID,
+		Replay:   true,
+		ReplayOf: prev,
+		PlayedAt: time.Now(),
+	}
+	idx, err := s.historyDB.AddToHistory(rm.ID, te)
+	if err != nil {
+		return fmt.Errorf("failed to add replay of %d to history for room %s: %v", prev, rm.ID, err)
+	}
+
+	s.publish(rm.ID, hub.TrackChanged, &hub.TrackChangedEvent{
+		Track:        te.Track,
+		UserID:       te.UserID,
+		HistoryIndex: idx,
+		Replay:       true,
+	})
+	s.startPlayback(rm, idx)
+
+	jsonResp(w, te.Track)
+	return nil
+}
+
+// previousIndex returns the index of the history entry before the one that's
+// currently playing. If the current track is itself a replay, we go back from
+// the original, so that going back repeatedly walks back through the history.
+func previousIndex(hist []*db.TrackEntry) (int, error) {
+	if len(hist) == 0 {
+		return 0, errors.New("no tracks in history")
+	}
+
+	cur := len(hist) - 1
+	if hist[cur].Replay {
+		cur = hist[cur].ReplayOf
+	}
+
+	if cur == 0 {
+		return 0, errors.New("no previous track to go back to")
+	}
+	return cur - 1, nil
 }
 
 func (s *Srv) serveCreateRoom(w http.ResponseWriter, r *http.Request) {
+	u, err := s.user(r)
+	if err != nil {
+		jsonErr(w, err)
+		return
+	}
+
 	var req struct {
 		DisplayName  string `json:"roomName"`
 		ShuffleOrder string `json:"shuffleOrder"`
+		// Providers are the names of the providers the room uses, or empty
+		// for all of them.
+		Providers []string `json:"providers"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -249,6 +544,13 @@ func (s *Srv) serveCreateRoom(w http.ResponseWriter, r *http.Request) {
 	room := &db.Room{
 		DisplayName: req.DisplayName,
 		RotatorType: rotatorTypeByName(req.ShuffleOrder),
+		OwnerID:     u.ID,
+		Providers:   req.Providers,
+	}
+	// Make sure the server has the providers before we store them.
+	if _, err := s.songServer(room); err != nil {
+		jsonErr(w, err)
+		return
 	}
 
 	rID, err := s.roomDB.AddRoom(room)
@@ -283,6 +585,10 @@ type roomInfo struct {
 	Room  *db.Room         `json:"room"`
 	Queue []*db.QueueTrack `json:"queue"`
 	Track *radio.Track     `json:"track"`
+	// Members is everyone who has joined the room, and Listeners is the
+	// members that are connected to it right now.
+	Members   []*db.User `json:"members"`
+	Listeners []*db.User `json:"listeners"`
 }
 
 type roomResp struct {
@@ -314,28 +620,15 @@ func (s *Srv) serveRoomSearch(w http.ResponseWriter, r *http.Request) {
 	rm, err := s.roomDB.Room(db.RoomID(strings.ToUpper(q)))
 	switch err {
 	case nil:
-		qts, err := s.queueDB.Tracks(db.QueueID{
-			RoomID: rm.ID,
-			UserID: u.ID,
-		}, &db.QueueOptions{Type: db.AllTracks})
-
-		if err == db.ErrQueueNotFound {
-			if err := s.roomDB.AddUserToRoom(rm.ID, u.ID); err != nil {
-				jsonErr(w, err)
-				return
-			}
-		} else if err != nil {
+		ri, err := s.roomInfo(u, rm)
+		if err != nil {
 			jsonErr(w, err)
 			return
 		}
 
 		jsonResp(w, roomResp{
-			Type: "room",
-			RoomInfo: roomInfo{
-				Room:  rm,
-				Queue: qts,
-				Track: s.nowPlaying(rm.ID),
-			},
+			Type:     "room",
+			RoomInfo: *ri,
 		})
 		return
 	case db.ErrRoomNotFound:
@@ -372,7 +665,23 @@ func (s *Srv) serveRoomSearch(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Srv) serveVeto(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
-	return errors.New("sorry, vetoing not implemented yet")
+	if err := s.veto(u, rm); err != nil {
+		return err
+	}
+
+	jsonResp(w, struct{}{})
+	return nil
+}
+
+// veto vetoes the track that's currently playing in the room, and moves on to
+// the next one.
+func (s *Srv) veto(u *db.User, rm *db.Room) error {
+	if !vetoEnabled {
+		return errors.New("sorry, vetoing not implemented yet")
+	}
+	if err := s.checkMember(rm, u.ID); err != nil {
+		return err
+	}
 
 	users, err := s.userDB.Users(rm.ID)
 	if err != nil {
@@ -396,38 +705,70 @@ func (s *Srv) serveVeto(w http.ResponseWriter, r *http.Request, u *db.User, rm *
 		return err
 	}
 
-	nu, t, err := s.roomDB.NextTrack(rm.ID)
-	if err == db.ErrNoTracksInQueue {
+	cur := hist[len(hist)-1]
+	vetoee, err := s.userDB.User(cur.UserID)
+	if err != nil {
+		return err
+	}
+
+	s.publish(rm.ID, hub.Veto, &hub.VetoEvent{
+		Track:  cur.Track,
+		Vetoer: u,
+		Vetoee: vetoee,
+	})
+
+	// The vetoed track was put on by a player, so the replacement is too.
+	if _, _, err := s.advance(rm, cur.PlayerID); err == db.ErrNoTracksInQueue {
 		return errors.New("No tracks left in queue")
 	} else if err != nil {
 		return err
 	}
 
-	_, err = s.historyDB.AddToHistory(rm.ID, &db.TrackEntry{
-		Track:  t,
-		UserID: nu.ID,
-	})
+	return s.pushVeto(rm, u, vetoee)
+}
+
+func (s *Srv) serveVote(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	votes, err := s.vote(u, rm)
 	if err != nil {
-		log.Printf("failed to add track %v from user %s to history for room %s: %v", t, u.ID, rm.ID, err)
+		return err
 	}
 
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(t); err != nil {
-		return err
+	jsonResp(w, struct {
+		Votes int `json:"votes"`
+	}{votes})
+	return nil
+}
+
+// vote records the user's vote for the track that's currently playing in the
+// room, and returns how many votes it has.
+func (s *Srv) vote(u *db.User, rm *db.Room) (int, error) {
+	if rm.Ended {
+		return 0, errRoomEnded
+	}
+	// Votes are compared to the size of the room, so outsiders could force a
+	// skip.
+	if err := s.checkMember(rm, u.ID); err != nil {
+		return 0, err
 	}
-	s.h.BroadcastRoom(buf.Bytes(), rm)
 
-	vetoee, err := s.userDB.User(hist[len(hist)-1].UserID)
+	hist, err := s.historyDB.History(rm.ID)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if len(hist) == 0 {
+		return 0, errors.New("no tracks in history")
 	}
 
-	if err := s.pushVeto(rm, u, vetoee); err != nil {
-		return err
+	votes, err := s.historyDB.AddVote(rm.ID, u.ID)
+	if err != nil {
+		return 0, err
 	}
 
-	jsonResp(w, struct{}{})
-	return nil
+	s.publish(rm.ID, hub.VoteTally, &hub.VoteTallyEvent{
+		HistoryIndex: len(hist) - 1,
+		Votes:        votes,
+	})
+	return votes, nil
 }
 
 func (s *Srv) pushVeto(rm *db.Room, vetoer, vetoee *db.User) error {
@@ -457,6 +798,187 @@ func lastVeto(history []*db.TrackEntry, uid db.UserID) (songsSince int, veto boo
 }
 
 func (s *Srv) serveRoom(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	ri, err := s.roomInfo(u, rm)
+	if err != nil {
+		return err
+	}
+
+	jsonResp(w, ri)
+	return nil
+}
+
+// roomInfo joins the user to the room, and returns everything they need to
+// display it.
+func (s *Srv) roomInfo(u *db.User, rm *db.Room) (*roomInfo, error) {
+	qts, err := s.joinRoom(u, rm)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.userDB.Users(rm.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &roomInfo{
+		Room:      rm,
+		Queue:     qts,
+		Track:     s.nowPlaying(rm.ID),
+		Members:   members,
+		Listeners: s.h.Presence(rm.ID),
+	}, nil
+}
+
+// servePresence returns the users that are connected to the room right now.
+func (s *Srv) servePresence(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	listeners := s.h.Presence(rm.ID)
+	if listeners == nil {
+		listeners = []*db.User{}
+	}
+
+	jsonResp(w, listeners)
+	return nil
+}
+
+func (s *Srv) serveStats(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	users, hist, queues, err := s.roomData(rm)
+	if err != nil {
+		return err
+	}
+
+	jsonResp(w, stats.Compute(users, hist, queues))
+	return nil
+}
+
+// serveSimilarity compares the members of a room by the tracks they've queued
+// in every room they've been in, not just this one.
+func (s *Srv) serveSimilarity(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	users, err := s.userDB.Users(rm.ID)
+	if err != nil {
+		return err
+	}
+
+	tracks := make(map[db.UserID][]*radio.Track)
+	for _, ru := range users {
+		ts, err := s.queueDB.UserTracks(ru.ID)
+		if err != nil {
+			return err
+		}
+		tracks[ru.ID] = ts
+	}
+
+	jsonResp(w, stats.ComputeSimilarity(users, tracks))
+	return nil
+}
+
+// roomData loads everything that's needed to summarize a room: its members,
+// its history, and the queue of each member.
+func (s *Srv) roomData(rm *db.Room) ([]*db.User, []*db.TrackEntry, map[db.UserID][]*db.QueueTrack, error) {
+	users, err := s.userDB.Users(rm.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	hist, err := s.historyDB.History(rm.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	queues := make(map[db.UserID][]*db.QueueTrack)
+	for _, ru := range users {
+		qts, err := s.queueDB.Tracks(db.QueueID{RoomID: rm.ID, UserID: ru.ID}, &db.QueueOptions{Type: db.AllTracks})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		queues[ru.ID] = qts
+	}
+
+	return users, hist, queues, nil
+}
+
+// serveEndRoom ends the room, and generates and stores its recap. The recap
+// is stored before the room is ended, so if either fails, the owner can try
+// again, and storing the recap again replaces it.
+func (s *Srv) serveEndRoom(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	if rm.OwnerID != u.ID {
+		return errNotOwner
+	}
+	if rm.Ended {
+		return errRoomEnded
+	}
+
+	users, hist, queues, err := s.roomData(rm)
+	if err != nil {
+		return err
+	}
+
+	rc := recap.Build(rm, users, hist, queues)
+	dat, err := json.Marshal(rc)
+	if err != nil {
+		return err
+	}
+
+	if err := s.recapDB.AddRecap(rm.ID, dat); err != nil {
+		return fmt.Errorf("failed to store recap for room %s: %v", rm.ID, err)
+	}
+
+	if err := s.roomDB.EndRoom(rm.ID); err != nil {
+		return err
+	}
+	// Ending the room is the end of everyone's membership.
+	for _, ru := range users {
+		s.publish(rm.ID, hub.UserLeft, &hub.UserEvent{User: ru})
+	}
+	rm.Ended = true
+	s.publish(rm.ID, hub.RoomSettingsChanged, &hub.RoomSettingsChangedEvent{Room: rm})
+
+	jsonResp(w, rc)
+	return nil
+}
+
+func (s *Srv) serveRecap(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	rc, err := s.recap(rm)
+	if err != nil {
+		return err
+	}
+
+	jsonResp(w, rc)
+	return nil
+}
+
+func (s *Srv) serveRecapHTML(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+	rc, err := s.recap(rm)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := recap.HTML(w, rc); err != nil {
+		log.Printf("Failed to render recap for room %s: %v", rm.ID, err)
+	}
+	return nil
+}
+
+func (s *Srv) recap(rm *db.Room) (*recap.Recap, error) {
+	if !rm.Ended {
+		return nil, errors.New("room hasn't ended yet")
+	}
+
+	dat, err := s.recapDB.Recap(rm.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var rc recap.Recap
+	if err := json.Unmarshal(dat, &rc); err != nil {
+		return nil, fmt.Errorf("failed to decode recap for room %s: %v", rm.ID, err)
+	}
+	return &rc, nil
+}
+
+// joinRoom returns the user's queue for the room, adding them to the room
+// first if they aren't already in it.
+func (s *Srv) joinRoom(u *db.User, rm *db.Room) ([]*db.QueueTrack, error) {
 	qts, err := s.queueDB.Tracks(db.QueueID{
 		RoomID: rm.ID,
 		UserID: u.ID,
@@ -464,18 +986,14 @@ func (s *Srv) serveRoom(w http.ResponseWriter, r *http.Request, u *db.User, rm *
 
 	if err == db.ErrQueueNotFound {
 		if err := s.roomDB.AddUserToRoom(rm.ID, u.ID); err != nil {
-			return err
+			return nil, err
 		}
+		s.publish(rm.ID, hub.UserJoined, &hub.UserEvent{User: u})
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 
-	jsonResp(w, roomInfo{
-		Room:  rm,
-		Queue: qts,
-		Track: s.nowPlaying(rm.ID),
-	})
-	return nil
+	return qts, nil
 }
 
 func (s *Srv) addNext(qID db.QueueID, t *radio.Track) error {
@@ -500,14 +1018,58 @@ func (s *Srv) addTrackAfter(qID db.QueueID, t *radio.Track, qot db.QueueType) er
 	return s.queueDB.AddTrack(qID, t, afterID)
 }
 
+// serveSearch searches for the query a page at a time, with the type, limit,
+// offset and market parameters as the SearchOptions. nextOffset in the
+// response is the offset of the next page, or null after the last one. With
+// an artist parameter instead of a query, it returns the artist's top tracks.
 func (s *Srv) serveSearch(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
-	q := r.FormValue("query")
+	q, artist := r.FormValue("query"), r.FormValue("artist")
+	opts, err := searchOptions(r)
+	if err != nil {
+		return err
+	}
 
-	if q == "" {
-		jsonResp(w, []interface{}{})
+	type trackInQueue struct {
+		Track   radio.Track `json:"track"`
+		InQueue bool        `json:"inQueue"`
+	}
+
+	type searchResponse struct {
+		Tracks     []*trackInQueue  `json:"tracks"`
+		Albums     []radio.Album    `json:"albums"`
+		Artists    []radio.Artist   `json:"artists"`
+		Playlists  []radio.Playlist `json:"playlists"`
+		Total      int              `json:"total"`
+		NextOffset *int             `json:"nextOffset"`
+	}
+
+	resp := &searchResponse{
+		Tracks:    []*trackInQueue{},
+		Albums:    []radio.Album{},
+		Artists:   []radio.Artist{},
+		Playlists: []radio.Playlist{},
+	}
+	if q == "" && artist == "" {
+		jsonResp(w, resp)
 		return nil
 	}
 
+	var res *radio.SearchResults
+	if artist != "" {
+		ts, err := s.artistTopTracks(r.Context(), rm, artist, opts.Market)
+		if err != nil {
+			return err
+		}
+		res = &radio.SearchResults{Tracks: ts, Total: len(ts)}
+	} else {
+		if res, err = s.search(r.Context(), rm, q, opts); err != nil {
+			return err
+		}
+		if next := opts.Offset + opts.Limit; next < res.Total {
+			resp.NextOffset = &next
+		}
+	}
+
 	qts, err := s.queueDB.Tracks(db.QueueID{
 		RoomID: rm.ID,
 		UserID: u.ID,
@@ -523,28 +1085,58 @@ func (s *Srv) serveSearch(w http.ResponseWriter, r *http.Request, u *db.User, rm
 		}
 	}
 
-	type trackInQueue struct {
-		Track   radio.Track `json:"track"`
-		InQueue bool        `json:"inQueue"`
-	}
-
-	tracks, err := s.search(q)
-	if err != nil {
-		return err
-	}
-
-	var tracksInQueue []*trackInQueue
-	for _, t := range tracks {
-		tracksInQueue = append(tracksInQueue, &trackInQueue{
+	for _, t := range res.Tracks {
+		resp.Tracks = append(resp.Tracks, &trackInQueue{
 			Track:   t,
 			InQueue: inQueue[t.ID],
 		})
 	}
+	resp.Albums = append(resp.Albums, res.Albums...)
+	resp.Artists = append(resp.Artists, res.Artists...)
+	resp.Playlists = append(resp.Playlists, res.Playlists...)
+	resp.Total = res.Total
 
-	jsonResp(w, tracksInQueue)
+	jsonResp(w, resp)
 	return nil
 }
 
+// searchOptions reads the SearchOptions from a search request, with the
+// defaults filled in.
+func searchOptions(r *http.Request) (radio.SearchOptions, error) {
+	opts := radio.SearchOptions{
+		Type:   radio.SearchType(r.FormValue("type")),
+		Market: strings.ToUpper(r.FormValue("market")),
+	}
+	switch opts.Type {
+	case "", radio.SearchTracks, radio.SearchAlbums, radio.SearchArtists, radio.SearchPlaylists:
+	default:
+		return radio.SearchOptions{}, fmt.Errorf("invalid search type %q", opts.Type)
+	}
+
+	var err error
+	if opts.Limit, err = intParam(r, "limit"); err != nil {
+		return radio.SearchOptions{}, err
+	}
+	if opts.Offset, err = intParam(r, "offset"); err != nil {
+		return radio.SearchOptions{}, err
+	}
+	return opts.WithDefaults(), nil
+}
+
+// intParam returns the value of a parameter that has to be a non-negative
+// number, or zero if it's missing.
+func intParam(r *http.Request, name string) (int, error) {
+	str := r.FormValue(name)
+	if str == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, str)
+	}
+	return n, nil
+}
+
 // serveData handles websocket requests from the peer trying to connect.
 func (s *Srv) serveData(w http.ResponseWriter, r *http.Request) {
 	rm, err := s.room(r)
@@ -553,14 +1145,33 @@ func (s *Srv) serveData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	u, err := s.user(r)
+	if err != nil {
+		jsonErr(w, err)
+		return
+	}
+
+	if err := s.checkMember(rm, u.ID); err != nil {
+		jsonErr(w, err)
+		return
+	}
+
+	// Clients that are reconnecting tell us the last message they saw, so we
+	// can fill them in on what they missed.
+	since, err := lastEventID(r)
+	if err != nil {
+		jsonErr(w, err)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		jsonErr(w, err)
 		return
 	}
 
 	// Register this connection with a room, and start reading from it.
-	s.h.Register(ws, rm)
+	s.h.Register(ws, rm, u, since)
 }
 
 func (s *Srv) nowPlaying(rid db.RoomID) *radio.Track {
@@ -600,16 +1211,23 @@ func serveError(w http.ResponseWriter, err error) {
 
 func jsonErr(w http.ResponseWriter, err error) {
 	log.Printf("Returning error to client: %v", err)
+	if err == errNotMember {
+		w.WriteHeader(http.StatusForbidden)
+	}
 	json.NewEncoder(w).Encode(struct {
 		Error        bool
 		Message      string
 		NotLoggedIn  bool
 		RoomNotFound bool
+		NotMember    bool
+		TrackChanged bool
 	}{
 		Error:        true,
 		Message:      err.Error(),
 		NotLoggedIn:  err == errNotLoggedIn,
 		RoomNotFound: err == db.ErrRoomNotFound,
+		NotMember:    err == errNotMember,
+		TrackChanged: err == db.ErrPlaybackChanged,
 	})
 }
 
@@ -651,12 +1269,40 @@ func loadOrGenKey(name string) ([]byte, error) {
 	return dat, nil
 }
 
-func (s *Srv) search(query string) ([]radio.Track, error) {
-	return s.cfg.SongServer.Search(query)
+// songServer returns the SongServer for the providers the room uses.
+func (s *Srv) songServer(rm *db.Room) (radio.SongServer, error) {
+	if len(rm.Providers) == 0 {
+		return s.cfg.SongServer, nil
+	}
+	m, ok := s.cfg.SongServer.(*radio.Multi)
+	if !ok {
+		return nil, errors.New("this server can't choose which providers a room uses")
+	}
+	return m.Only(rm.Providers...)
 }
 
-func (s *Srv) track(id string) (radio.Track, error) {
-	return s.cfg.SongServer.Track(id)
+func (s *Srv) search(ctx context.Context, rm *db.Room, query string, opts radio.SearchOptions) (*radio.SearchResults, error) {
+	ss, err := s.songServer(rm)
+	if err != nil {
+		return nil, err
+	}
+	return ss.Search(ctx, query, &opts)
+}
+
+func (s *Srv) artistTopTracks(ctx context.Context, rm *db.Room, artistID, market string) ([]radio.Track, error) {
+	ss, err := s.songServer(rm)
+	if err != nil {
+		return nil, err
+	}
+	return ss.ArtistTopTracks(ctx, artistID, market)
+}
+
+func (s *Srv) track(ctx context.Context, rm *db.Room, id string) (radio.Track, error) {
+	ss, err := s.songServer(rm)
+	if err != nil {
+		return radio.Track{}, err
+	}
+	return ss.Track(ctx, id)
 }
 
 type continuationToken struct {
@@ -1,10 +1,33 @@
 package srv
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/hub"
+	"github.com/bcspragu/Radiotation/library"
+	"github.com/bcspragu/Radiotation/memdb"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/bcspragu/Radiotation/radio/radiotest"
 	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/websocket"
 )
 
 func TestContinuationToken(t *testing.T) {
@@ -29,3 +52,1190 @@ func TestContinuationToken(t *testing.T) {
 		t.Fatalf("got unexpected continuation token (-want +got):\n%s", diff)
 	}
 }
+
+func TestPlayerCredential(t *testing.T) {
+	s := &Srv{sc: securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))}
+
+	tkn, err := s.sc.Encode("player", &playerCredential{
+		PlayerID: "player123",
+		RoomID:   db.RoomID("room123"),
+		UserID:   db.UserID("user123"),
+	})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	tests := []struct {
+		desc    string
+		header  string
+		roomID  db.RoomID
+		wantErr bool
+	}{
+		{"valid", "Bearer " + tkn, db.RoomID("room123"), false},
+		{"wrong room", "Bearer " + tkn, db.RoomID("room456"), true},
+		{"no header", "", db.RoomID("room123"), true},
+		{"garbage", "Bearer garbage", db.RoomID("room123"), true},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/room/"+string(tc.roomID)+"/pop", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+
+		p, err := s.player(r, tc.roomID)
+		if tc.wantErr {
+			if err != errPlayerNotAuthorized {
+				t.Errorf("%s: player() = %v, want %v", tc.desc, err, errPlayerNotAuthorized)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: player(): %v", tc.desc, err)
+			continue
+		}
+		if p.PlayerID != "player123" {
+			t.Errorf("%s: PlayerID = %q, want %q", tc.desc, p.PlayerID, "player123")
+		}
+	}
+}
+
+func TestPreviousIndex(t *testing.T) {
+	tests := []struct {
+		desc    string
+		hist    []*db.TrackEntry
+		want    int
+		wantErr bool
+	}{
+		{
+			desc:    "no history",
+			wantErr: true,
+		},
+		{
+			desc:    "only one track",
+			hist:    []*db.TrackEntry{{}},
+			wantErr: true,
+		},
+		{
+			desc: "go back one",
+			hist: []*db.TrackEntry{{}, {}, {}},
+			want: 1,
+		},
+		{
+			desc: "go back from a replay",
+			hist: []*db.TrackEntry{{}, {}, {}, {Replay: true, ReplayOf: 1}},
+			want: 0,
+		},
+		{
+			desc:    "replay of the first track",
+			hist:    []*db.TrackEntry{{}, {}, {Replay: true, ReplayOf: 0}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		got, err := previousIndex(tc.hist)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: previousIndex() = %d, want an error", tc.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: previousIndex(): %v", tc.desc, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: previousIndex() = %d, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+// failingRecapDB fails to store recaps until it's told not to.
+type failingRecapDB struct {
+	*memdb.DB
+	err error
+}
+
+func (f *failingRecapDB) AddRecap(rid db.RoomID, dat []byte) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.DB.AddRecap(rid, dat)
+}
+
+func TestServeEndRoom(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	rdb := &failingRecapDB{DB: mdb, err: errors.New("disk full")}
+	s := &Srv{
+		h:         h,
+		roomDB:    mdb,
+		userDB:    mdb,
+		queueDB:   mdb,
+		historyDB: mdb,
+		recapDB:   rdb,
+	}
+
+	owner, guest := &db.User{ID: db.UserID("owner")}, &db.User{ID: db.UserID("guest")}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin, OwnerID: owner.ID})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	for _, u := range []*db.User{owner, guest} {
+		if err := mdb.AddUser(u); err != nil {
+			t.Fatalf("AddUser: %v", err)
+		}
+		if err := mdb.AddUserToRoom(rid, u.ID); err != nil {
+			t.Fatalf("AddUserToRoom: %v", err)
+		}
+	}
+
+	end := func() error {
+		t.Helper()
+		rm, err := mdb.Room(rid)
+		if err != nil {
+			t.Fatalf("Room: %v", err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/room/"+string(rid)+"/end", nil)
+		return s.serveEndRoom(httptest.NewRecorder(), r, owner, rm)
+	}
+
+	// The room stays open if the recap can't be stored, so the owner can try
+	// again.
+	if err := end(); err == nil {
+		t.Fatal("serveEndRoom succeeded, want an error storing the recap")
+	}
+	if rm, err := mdb.Room(rid); err != nil || rm.Ended {
+		t.Fatalf("Room = %+v, %v, want it to still be open", rm, err)
+	}
+
+	rdb.err = nil
+	sub := h.Subscribe(&db.Room{ID: rid}, guest, 0)
+	defer sub.Close()
+	if err := end(); err != nil {
+		t.Fatalf("serveEndRoom: %v", err)
+	}
+	if rm, err := mdb.Room(rid); err != nil || !rm.Ended {
+		t.Errorf("Room = %+v, %v, want it ended", rm, err)
+	}
+	if _, err := mdb.Recap(rid); err != nil {
+		t.Errorf("Recap: %v", err)
+	}
+
+	// Everyone stops being a member, and then the room ends.
+	var (
+		left  []db.UserID
+		ended bool
+	)
+	for !ended {
+		select {
+		case f := <-sub.Frames():
+			var msg hub.Message
+			if err := json.Unmarshal(f.Data, &msg); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			switch msg.Type {
+			case hub.UserLeft:
+				var ev hub.UserEvent
+				if err := json.Unmarshal(msg.Payload, &ev); err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				left = append(left, ev.User.ID)
+			case hub.RoomSettingsChanged:
+				ended = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the room to end")
+		}
+	}
+	sort.Slice(left, func(i, j int) bool { return left[i] < left[j] })
+	if diff := cmp.Diff([]db.UserID{guest.ID, owner.ID}, left); diff != "" {
+		t.Errorf("users that left (-want +got)\n%s", diff)
+	}
+}
+
+func TestServeUpdatePlayback(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	s := &Srv{
+		h:          h,
+		roomDB:     mdb,
+		historyDB:  mdb,
+		playbackDB: mdb,
+	}
+
+	owner, guest := &db.User{ID: db.UserID("owner")}, &db.User{ID: db.UserID("guest")}
+	rm := &db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin, OwnerID: owner.ID}
+	if rm.ID, err = mdb.AddRoom(rm); err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	track := &radio.Track{ID: "track", Name: "Track", DurationMS: 180000}
+	idx, err := mdb.AddToHistory(rm.ID, &db.TrackEntry{UserID: owner.ID, Track: track})
+	if err != nil {
+		t.Fatalf("AddToHistory: %v", err)
+	}
+	s.startPlayback(rm, idx)
+
+	update := func(u *db.User, body string) error {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/room/"+string(rm.ID)+"/playback", strings.NewReader(body))
+		return s.serveUpdatePlayback(httptest.NewRecorder(), r, u, rm)
+	}
+	playback := func() *playbackResp {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/api/room/"+string(rm.ID)+"/playback", nil)
+		w := httptest.NewRecorder()
+		if err := s.servePlayback(w, r, guest, rm); err != nil {
+			t.Fatalf("servePlayback: %v", err)
+		}
+		var resp playbackResp
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		return &resp
+	}
+
+	if err := update(guest, `{"historyIndex": 0, "action": "pause"}`); err != errNotOwner {
+		t.Errorf("pause by a guest = %v, want %v", err, errNotOwner)
+	}
+	if got := playback(); got.Playback.Paused {
+		t.Error("playback was paused by a guest")
+	}
+
+	if err := update(owner, `{"historyIndex": 0, "action": "pause"}`); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	if got := playback(); !got.Playback.Paused {
+		t.Error("playback isn't paused")
+	}
+
+	// Paused playback stays put, so we know exactly where it should be.
+	if err := update(owner, `{"historyIndex": 0, "action": "seek", "positionMS": 60000}`); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	if got := playback(); got.PositionMS != 60000 {
+		t.Errorf("PositionMS = %d, want 60000", got.PositionMS)
+	}
+
+	for _, body := range []string{
+		`{"historyIndex": 0, "action": "seek", "positionMS": -1}`,
+		`{"historyIndex": 0, "action": "seek", "positionMS": 180001}`,
+		`{"historyIndex": 0, "action": "rewind"}`,
+	} {
+		if err := update(owner, body); err == nil {
+			t.Errorf("update(%s) succeeded, want an error", body)
+		}
+	}
+	if got := playback(); got.PositionMS != 60000 || !got.Playback.Paused {
+		t.Errorf("playback = %+v at %d, want it paused at 60000", got.Playback, got.PositionMS)
+	}
+
+	if err := update(owner, `{"historyIndex": 0, "action": "resume"}`); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if got := playback(); got.Playback.Paused || got.PositionMS < 60000 {
+		t.Errorf("playback = %+v at %d, want it playing from 60000", got.Playback, got.PositionMS)
+	}
+
+	// Once the next track starts, updates meant for the old one are turned
+	// away instead of moving the new one.
+	next, err := mdb.AddToHistory(rm.ID, &db.TrackEntry{UserID: owner.ID, Track: track})
+	if err != nil {
+		t.Fatalf("AddToHistory: %v", err)
+	}
+	s.startPlayback(rm, next)
+	if err := update(owner, `{"historyIndex": 0, "action": "seek", "positionMS": 90000}`); err != db.ErrPlaybackChanged {
+		t.Errorf("seek of the old track = %v, want %v", err, db.ErrPlaybackChanged)
+	}
+	if err := update(owner, `{"action": "pause"}`); err == nil {
+		t.Error("pause without a historyIndex succeeded, want an error")
+	}
+	if got := playback(); got.Playback.HistoryIndex != next || got.Playback.Paused || got.PositionMS > 60000 {
+		t.Errorf("playback = %+v at %d, want entry %d playing from the start", got.Playback, got.PositionMS, next)
+	}
+
+	rm.Ended = true
+	if err := update(owner, `{"historyIndex": 1, "action": "pause"}`); err != errRoomEnded {
+		t.Errorf("pause in an ended room = %v, want %v", err, errRoomEnded)
+	}
+}
+
+func TestChatNotMember(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	s := &Srv{
+		h:         h,
+		sc:        securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
+		cfg:       &Config{},
+		roomDB:    mdb,
+		userDB:    mdb,
+		queueDB:   mdb,
+		historyDB: mdb,
+	}
+
+	alice, mallory := &db.User{ID: db.UserID("alice")}, &db.User{ID: db.UserID("mallory")}
+	for _, u := range []*db.User{alice, mallory} {
+		if err := mdb.AddUser(u); err != nil {
+			t.Fatalf("AddUser: %v", err)
+		}
+	}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	if err := mdb.AddUserToRoom(rid, alice.ID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+	if _, err := mdb.AddToHistory(rid, &db.TrackEntry{UserID: alice.ID, Track: &radio.Track{ID: "track"}}); err != nil {
+		t.Fatalf("AddToHistory: %v", err)
+	}
+
+	post := func(u *db.User, path string, handler roomHandler, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/room/"+string(rid)+path, strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"id": string(rid)})
+		cookie, err := s.sc.Encode("user", u)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		r.AddCookie(&http.Cookie{Name: "user", Value: cookie})
+		w := httptest.NewRecorder()
+		s.withRoomAndUser(handler)(w, r)
+		return w
+	}
+
+	if w := post(alice, "/chat", s.serveChat, `{"text": "hi"}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"Error":true`) {
+		t.Fatalf("chat from a member = %d %s, want it sent", w.Code, w.Body.String())
+	}
+	hist, err := mdb.History(rid)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	msgID := hist[0].Messages[0].ID
+
+	tests := []struct {
+		path    string
+		handler roomHandler
+		body    string
+	}{
+		{"/chat", s.serveChat, `{"text": "spam"}`},
+		{"/react", s.serveReact, `{"emoji": "💩"}`},
+		{"/chat/delete", s.serveDeleteChat, fmt.Sprintf(`{"historyIndex": 0, "messageID": %q}`, msgID)},
+	}
+	for _, tc := range tests {
+		if w := post(mallory, tc.path, tc.handler, tc.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s from a non-member = %d %s, want %d", tc.path, w.Code, w.Body.String(), http.StatusForbidden)
+		}
+	}
+
+	hist, err = mdb.History(rid)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if n := len(hist[0].Messages); n != 1 {
+		t.Errorf("track has %d messages, want just the member's", n)
+	}
+}
+
+func TestVoteNotMember(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	s := &Srv{
+		h:         h,
+		roomDB:    mdb,
+		userDB:    mdb,
+		queueDB:   mdb,
+		historyDB: mdb,
+	}
+
+	alice, mallory := &db.User{ID: db.UserID("alice")}, &db.User{ID: db.UserID("mallory")}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	if err := mdb.AddUserToRoom(rid, alice.ID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+	rm, err := mdb.Room(rid)
+	if err != nil {
+		t.Fatalf("Room: %v", err)
+	}
+	if _, err := mdb.AddToHistory(rid, &db.TrackEntry{UserID: alice.ID, Track: &radio.Track{ID: "track"}}); err != nil {
+		t.Fatalf("AddToHistory: %v", err)
+	}
+
+	if _, err := s.vote(mallory, rm); err != errNotMember {
+		t.Errorf("vote from a non-member = %v, want %v", err, errNotMember)
+	}
+	if votes, err := s.vote(alice, rm); err != nil || votes != 1 {
+		t.Errorf("vote from a member = %d, %v, want 1 vote", votes, err)
+	}
+}
+
+func TestRemoveTrackRoomEnded(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	s := &Srv{queueDB: mdb}
+
+	alice := &db.User{ID: db.UserID("alice")}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	if err := mdb.AddUserToRoom(rid, alice.ID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+	qID := db.QueueID{RoomID: rid, UserID: alice.ID}
+	if err := mdb.AddTrack(qID, &radio.Track{ID: "track"}, ""); err != nil {
+		t.Fatalf("AddTrack: %v", err)
+	}
+	if err := mdb.EndRoom(rid); err != nil {
+		t.Fatalf("EndRoom: %v", err)
+	}
+	rm, err := mdb.Room(rid)
+	if err != nil {
+		t.Fatalf("Room: %v", err)
+	}
+
+	qts, err := mdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+	if err != nil {
+		t.Fatalf("Tracks: %v", err)
+	}
+	if err := s.removeTrack(alice, rm, qts[0].ID); err != errRoomEnded {
+		t.Errorf("removeTrack = %v, want %v", err, errRoomEnded)
+	}
+	if qts, err := mdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks}); err != nil || len(qts) != 1 {
+		t.Errorf("queue = %d tracks, %v, want the track still there", len(qts), err)
+	}
+}
+
+func TestValidChat(t *testing.T) {
+	tests := []struct {
+		text     string
+		reaction bool
+		ok       bool
+	}{
+		{text: "great song", ok: true},
+		{text: "line one\nline two", ok: true},
+		{text: strings.Repeat("a", hub.MaxChatBytes), ok: true},
+		{text: ""},
+		{text: strings.Repeat("a", hub.MaxChatBytes+1)},
+		{text: "bell\a"},
+		{text: "\xff"},
+		{text: "🔥", reaction: true, ok: true},
+		{text: "👨‍👩‍👧‍👦", reaction: true, ok: true},
+		{text: "🇺🇸", reaction: true, ok: true},
+		{text: "", reaction: true},
+		{text: "lol", reaction: true},
+		{text: "🔥 🔥", reaction: true},
+		{text: strings.Repeat("🔥", 9), reaction: true},
+	}
+
+	for _, tc := range tests {
+		valid := validChat
+		if tc.reaction {
+			valid = validReaction
+		}
+		if err := valid(tc.text); (err == nil) != tc.ok {
+			t.Errorf("valid(%q) (reaction %t) = %v, want ok %t", tc.text, tc.reaction, err, tc.ok)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := checkOrigin([]string{"https://radiotation.example.com/"})
+
+	tests := []struct {
+		desc   string
+		origin string
+		want   bool
+	}{
+		{"no origin", "", true},
+		{"same origin", "http://localhost:8000", true},
+		{"allowed origin", "https://Radiotation.example.com", true},
+		{"wrong scheme", "http://radiotation.example.com", false},
+		{"other origin", "https://evil.example.com", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost:8000/api/ws/room/ROOM", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if got := check(r); got != test.want {
+				t.Errorf("checkOrigin(%q) = %t, want %t", test.origin, got, test.want)
+			}
+		})
+	}
+}
+
+func TestServeDataNotLoggedIn(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	var called bool
+	h, err := hub.New(b, func(rm *db.Room, u *db.User, cmd *hub.Command) (interface{}, error) {
+		called = true
+		return nil, nil
+	}, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	s := &Srv{
+		h:        h,
+		sc:       securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
+		roomDB:   mdb,
+		userDB:   mdb,
+		upgrader: &websocket.Upgrader{},
+	}
+
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+
+	m := mux.NewRouter()
+	m.HandleFunc("/api/ws/room/{id}", s.serveData)
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	// Without a login, the upgrade is refused, so there's no socket to send
+	// commands on at all.
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws/room/" + string(rid)
+	ws, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		ws.Close()
+		t.Fatal("Dial succeeded, want the upgrade to be refused")
+	}
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("Dial: %v, want %v", err, websocket.ErrBadHandshake)
+	}
+	defer resp.Body.Close()
+
+	var body struct{ NotLoggedIn bool }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !body.NotLoggedIn {
+		t.Error("response doesn't say NotLoggedIn")
+	}
+	if called {
+		t.Error("command handler was called, want no call")
+	}
+	if p := h.Presence(rid); len(p) != 0 {
+		t.Errorf("Presence = %+v, want nobody", p)
+	}
+}
+
+func TestReadNotMember(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	s := &Srv{
+		h:         h,
+		sc:        securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
+		cfg:       &Config{},
+		roomDB:    mdb,
+		userDB:    mdb,
+		queueDB:   mdb,
+		historyDB: mdb,
+		upgrader:  &websocket.Upgrader{},
+	}
+
+	mallory := &db.User{ID: db.UserID("mallory")}
+	if err := mdb.AddUser(mallory); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	cookie, err := s.sc.Encode("user", mallory)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	ts := httptest.NewServer(s.initMux())
+	defer ts.Close()
+
+	for _, path := range []string{"/presence", "/stats", "/similarity", "/recap", "/recap.html", "/events"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/room/"+string(rid)+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.AddCookie(&http.Cookie{Name: "user", Value: cookie})
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s from a non-member = %d, want %d", path, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	u := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/ws/room/" + string(rid)
+	hdr := http.Header{}
+	hdr.Set("Cookie", (&http.Cookie{Name: "user", Value: cookie}).String())
+	ws, resp, err := websocket.DefaultDialer.Dial(u, hdr)
+	if err == nil {
+		ws.Close()
+		t.Fatal("Dial from a non-member succeeded, want the upgrade to be refused")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Dial from a non-member = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if p := h.Presence(rid); len(p) != 0 {
+		t.Errorf("Presence = %+v, want nobody", p)
+	}
+}
+
+func TestQueueChangeSendsUpNext(t *testing.T) {
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	s := &Srv{
+		h:         h,
+		roomDB:    mdb,
+		userDB:    mdb,
+		queueDB:   mdb,
+		historyDB: mdb,
+	}
+
+	alice := &db.User{ID: db.UserID("alice")}
+	if err := mdb.AddUser(alice); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	if err := mdb.AddUserToRoom(rid, alice.ID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+	rm, err := mdb.Room(rid)
+	if err != nil {
+		t.Fatalf("Room: %v", err)
+	}
+
+	qID := db.QueueID{RoomID: rid, UserID: alice.ID}
+	for _, id := range []string{"first", "second"} {
+		if err := mdb.AddTrack(qID, &radio.Track{ID: id, Name: id}, ""); err != nil {
+			t.Fatalf("AddTrack: %v", err)
+		}
+	}
+	qts, err := mdb.Tracks(qID, &db.QueueOptions{Type: db.AllTracks})
+	if err != nil {
+		t.Fatalf("Tracks: %v", err)
+	}
+
+	sub := h.Subscribe(rm, alice, 0)
+	defer sub.Close()
+
+	// Moving Alice's last track to the front changes what she has up next.
+	last := qts[len(qts)-1]
+	if err := s.moveTrack(alice, rm, last.ID, ""); err != nil {
+		t.Fatalf("moveTrack: %v", err)
+	}
+
+	for {
+		select {
+		case f := <-sub.Frames():
+			var msg struct {
+				Type    hub.EventType
+				Payload hub.UpNextEvent
+			}
+			if err := json.Unmarshal(f.Data, &msg); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if msg.Type != hub.UpNext {
+				continue
+			}
+			if msg.Payload.Track == nil || msg.Payload.Track.ID != last.Track.ID {
+				t.Errorf("UpNext track = %+v, want %q", msg.Payload.Track, last.Track.ID)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for UpNext")
+		}
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	s := &Srv{h: h}
+
+	rm := &db.Room{ID: db.RoomID("ROOM")}
+	u := &db.User{ID: db.UserID("USER")}
+
+	// Get a couple of events into the room's history, so the stream has
+	// something to replay. We watch them go by, so we know the hub has
+	// handled them.
+	watcher := h.Subscribe(rm, &db.User{ID: db.UserID("WATCHER")}, 0)
+	for i := 0; i < 2; i++ {
+		if err := h.Publish(rm.ID, hub.QueueChanged, &hub.QueueChangedEvent{UserID: u.ID}); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	for seen := 0; seen < 2; {
+		select {
+		case f := <-watcher.Frames():
+			if strings.Contains(string(f.Data), string(hub.QueueChanged)) {
+				seen++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+	watcher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/api/room/ROOM/events", nil).WithContext(ctx)
+	r.Header.Set("Last-Event-ID", "1")
+	w := httptest.NewRecorder()
+
+	if err := s.serveEvents(w, r, u, rm); err != nil {
+		t.Fatalf("serveEvents: %v", err)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want %q", ct, "text/event-stream")
+	}
+	body := w.Body.String()
+	// Presence events aren't sequenced, so our two events are the first two.
+	if strings.Contains(body, "id: 1\n") {
+		t.Errorf("stream replayed event 1, which the client already saw:\n%s", body)
+	}
+	if !strings.Contains(body, "id: 2\ndata: {") {
+		t.Errorf("stream didn't replay event 2:\n%s", body)
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	dir := t.TempDir()
+	audio := []byte("not really an mp3, but close enough")
+	for _, name := range []string{"queued.mp3", "other.mp3"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), audio, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	lib, err := library.New(dir, nil)
+	if err != nil {
+		t.Fatalf("library.New: %v", err)
+	}
+	queued, other := trackByName(t, lib, "queued"), trackByName(t, lib, "other")
+
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	s := &Srv{
+		sc:        securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
+		cfg:       &Config{Library: lib},
+		roomDB:    mdb,
+		userDB:    mdb,
+		queueDB:   mdb,
+		historyDB: mdb,
+	}
+
+	alice, mallory := &db.User{ID: db.UserID("alice")}, &db.User{ID: db.UserID("mallory")}
+	for _, u := range []*db.User{alice, mallory} {
+		if err := mdb.AddUser(u); err != nil {
+			t.Fatalf("AddUser: %v", err)
+		}
+	}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	if err := mdb.AddUserToRoom(rid, alice.ID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+	if err := mdb.AddTrack(db.QueueID{RoomID: rid, UserID: alice.ID}, &queued, ""); err != nil {
+		t.Fatalf("AddTrack: %v", err)
+	}
+
+	player, err := s.sc.Encode("player", &playerCredential{PlayerID: "player", RoomID: rid, UserID: alice.ID})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	stream := func(u *db.User, trackID string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/room/"+string(rid)+"/stream/"+trackID, nil)
+		r = mux.SetURLVars(r, map[string]string{"id": string(rid), "trackID": trackID})
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		if u != nil {
+			cookie, err := s.sc.Encode("user", u)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			r.AddCookie(&http.Cookie{Name: "user", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		s.serveStream(w, r)
+		return w
+	}
+
+	w := stream(alice, queued.ID, nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), audio) {
+		t.Fatalf("stream = %d %q, want the whole file", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "audio/mpeg" {
+		t.Errorf("Content-Type = %q, want %q", ct, "audio/mpeg")
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Error("stream didn't set an ETag")
+	}
+
+	tests := []struct {
+		desc     string
+		u        *db.User
+		trackID  string
+		header   http.Header
+		wantCode int
+		wantBody string
+	}{
+		{"range", alice, queued.ID, http.Header{"Range": {"bytes=4-9"}}, http.StatusPartialContent, string(audio[4:10])},
+		{"not modified", alice, queued.ID, http.Header{"If-None-Match": {etag}}, http.StatusNotModified, ""},
+		{"player", nil, queued.ID, http.Header{"Authorization": {"Bearer " + player}}, http.StatusOK, string(audio)},
+		{"bad player", nil, queued.ID, http.Header{"Authorization": {"Bearer garbage"}}, http.StatusUnauthorized, ""},
+		{"not logged in", nil, queued.ID, nil, http.StatusUnauthorized, ""},
+		{"not a member", mallory, queued.ID, nil, http.StatusForbidden, ""},
+		{"not in the room", alice, other.ID, nil, http.StatusForbidden, ""},
+		{"not in the library", alice, "nope", nil, http.StatusForbidden, ""},
+	}
+	for _, tc := range tests {
+		w := stream(tc.u, tc.trackID, tc.header)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: status = %d, want %d", tc.desc, w.Code, tc.wantCode)
+			continue
+		}
+		if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+			t.Errorf("%s: body = %q, want %q", tc.desc, w.Body.String(), tc.wantBody)
+		}
+	}
+}
+
+func trackByName(t *testing.T, lib *library.Library, name string) radio.Track {
+	t.Helper()
+
+	res, err := lib.Search(context.Background(), name, nil)
+	if err != nil || len(res.Tracks) != 1 {
+		t.Fatalf("Search(%q) = %v, %v, want one track", name, res, err)
+	}
+	return res.Tracks[0]
+}
+
+func TestServeSearch(t *testing.T) {
+	ss, err := radiotest.Load("../radio/radiotest/testdata/tracks.yaml")
+	if err != nil {
+		t.Fatalf("radiotest.Load: %v", err)
+	}
+
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	s := &Srv{
+		cfg:     &Config{SongServer: ss},
+		queueDB: mdb,
+	}
+
+	u := &db.User{ID: db.UserID("alice")}
+	rid, err := mdb.AddRoom(&db.Room{DisplayName: "Test Room", RotatorType: db.RoundRobin})
+	if err != nil {
+		t.Fatalf("AddRoom: %v", err)
+	}
+	rm := &db.Room{ID: rid}
+	if err := mdb.AddUserToRoom(rid, u.ID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+	queued, err := ss.Track(context.Background(), "dev-dreams")
+	if err != nil {
+		t.Fatalf("Track: %v", err)
+	}
+	if err := mdb.AddTrack(db.QueueID{RoomID: rid, UserID: u.ID}, &queued, ""); err != nil {
+		t.Fatalf("AddTrack: %v", err)
+	}
+
+	type response struct {
+		Tracks []struct {
+			Track   radio.Track `json:"track"`
+			InQueue bool        `json:"inQueue"`
+		} `json:"tracks"`
+		Artists    []radio.Artist `json:"artists"`
+		Total      int            `json:"total"`
+		NextOffset *int           `json:"nextOffset"`
+	}
+	search := func(params url.Values) (*response, error) {
+		r := httptest.NewRequest(http.MethodGet, "/api/room/"+string(rid)+"/search?"+params.Encode(), nil)
+		w := httptest.NewRecorder()
+		if err := s.serveSearch(w, r, u, rm); err != nil {
+			return nil, err
+		}
+		var resp response
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return &resp, nil
+	}
+	names := func(resp *response) []string {
+		var names []string
+		for _, tq := range resp.Tracks {
+			names = append(names, tq.Track.Name)
+		}
+		return names
+	}
+
+	resp, err := search(url.Values{"query": {"fleetwod mac"}})
+	if err != nil {
+		t.Fatalf("serveSearch: %v", err)
+	}
+	inQueue := make(map[string]bool)
+	for _, tq := range resp.Tracks {
+		inQueue[tq.Track.Name] = tq.InQueue
+	}
+	if diff := cmp.Diff(map[string]bool{"Dreams": true, "Go Your Own Way": false}, inQueue); diff != "" {
+		t.Errorf("search results (-want +got)\n%s", diff)
+	}
+	if resp.NextOffset != nil {
+		t.Errorf("nextOffset = %d, want null on the last page", *resp.NextOffset)
+	}
+
+	// Scrolling through the results a page at a time.
+	var pages []string
+	params := url.Values{"query": {"steely dan"}, "limit": {"2"}}
+	for {
+		resp, err := search(params)
+		if err != nil {
+			t.Fatalf("serveSearch(%v): %v", params, err)
+		}
+		if resp.Total != 3 {
+			t.Errorf("total = %d, want 3", resp.Total)
+		}
+		pages = append(pages, names(resp)...)
+		if resp.NextOffset == nil {
+			break
+		}
+		params.Set("offset", strconv.Itoa(*resp.NextOffset))
+	}
+	if diff := cmp.Diff([]string{"Dirty Work", "Do It Again", "Reelin' in the Years"}, pages); diff != "" {
+		t.Errorf("pages (-want +got)\n%s", diff)
+	}
+
+	// Drilling down from an artist to their top tracks.
+	resp, err = search(url.Values{"query": {"fleetwood"}, "type": {"artist"}})
+	if err != nil {
+		t.Fatalf("serveSearch(artist): %v", err)
+	}
+	if len(resp.Artists) != 1 || len(resp.Tracks) != 0 {
+		t.Fatalf("artists = %+v, want just Fleetwood Mac", resp.Artists)
+	}
+	resp, err = search(url.Values{"artist": {resp.Artists[0].ID}})
+	if err != nil {
+		t.Fatalf("serveSearch(top tracks): %v", err)
+	}
+	if diff := cmp.Diff([]string{"Dreams", "Go Your Own Way"}, names(resp)); diff != "" {
+		t.Errorf("top tracks (-want +got)\n%s", diff)
+	}
+	if !resp.Tracks[0].InQueue {
+		t.Error("Dreams isn't marked as in the queue")
+	}
+
+	for _, params := range []url.Values{
+		{"query": {"dreams"}, "type": {"podcast"}},
+		{"query": {"dreams"}, "limit": {"ten"}},
+		{"query": {"dreams"}, "offset": {"-1"}},
+	} {
+		if _, err := search(params); err == nil {
+			t.Errorf("serveSearch(%v) succeeded, want an error", params)
+		}
+	}
+
+	errDown := errors.New("service unavailable")
+	ss.SetSearchError(errDown)
+	if _, err := search(url.Values{"query": {"dreams"}}); err != errDown {
+		t.Errorf("serveSearch = %v, want %v", err, errDown)
+	}
+
+	// Searches stop when the request is cancelled.
+	ss.SetSearchError(nil)
+	ss.SetLatency(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/api/room/"+string(rid)+"/search?query=dreams", nil).WithContext(ctx)
+	if err := s.serveSearch(httptest.NewRecorder(), r, u, rm); err != context.Canceled {
+		t.Errorf("serveSearch = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRoomProviders(t *testing.T) {
+	lib := radiotest.New([]radio.Track{{ID: "a", Name: "Dreams", Artists: []radio.Artist{{Name: "Fleetwood Mac"}}}})
+	sp := radiotest.New([]radio.Track{{ID: "b", Name: "Dreams", Artists: []radio.Artist{{Name: "The Cranberries"}}}})
+
+	mdb, err := memdb.New(rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("memdb.New: %v", err)
+	}
+	b := hub.NewMemoryBroker()
+	defer b.Close()
+	h, err := hub.New(b, nil, nil)
+	if err != nil {
+		t.Fatalf("hub.New: %v", err)
+	}
+	defer h.Close()
+	s := &Srv{
+		h:  h,
+		sc: securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)),
+		cfg: &Config{SongServer: radio.NewMulti(
+			radio.Provider{Name: "library", SongServer: lib},
+			radio.Provider{Name: "spotify", SongServer: sp},
+		)},
+		roomDB:  mdb,
+		userDB:  mdb,
+		queueDB: mdb,
+	}
+
+	u := &db.User{ID: db.UserID("alice")}
+	if err := mdb.AddUser(u); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	create := func(body string) (db.RoomID, string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/room", strings.NewReader(body))
+		cookie, err := s.sc.Encode("user", u)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		r.AddCookie(&http.Cookie{Name: "user", Value: cookie})
+		w := httptest.NewRecorder()
+		s.serveCreateRoom(w, r)
+		var resp struct {
+			ID      string
+			Message string
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		return db.RoomID(resp.ID), resp.Message
+	}
+
+	if rid, msg := create(`{"roomName": "Test Room", "providers": ["youtube"]}`); rid != "" || msg == "" {
+		t.Errorf("creating a room with an unknown provider = %q %q, want an error", rid, msg)
+	}
+	rid, msg := create(`{"roomName": "Test Room", "providers": ["spotify"]}`)
+	if rid == "" {
+		t.Fatalf("creating a room failed: %s", msg)
+	}
+	rm, err := mdb.Room(rid)
+	if err != nil {
+		t.Fatalf("Room: %v", err)
+	}
+	if diff := cmp.Diff([]string{"spotify"}, rm.Providers); diff != "" {
+		t.Errorf("Providers (-want +got)\n%s", diff)
+	}
+	if err := mdb.AddUserToRoom(rid, u.ID); err != nil {
+		t.Fatalf("AddUserToRoom: %v", err)
+	}
+
+	// Only the room's providers are searched, and IDs are the same as they'd
+	// be with every provider.
+	r := httptest.NewRequest(http.MethodGet, "/api/room/"+string(rid)+"/search?query=dreams", nil)
+	w := httptest.NewRecorder()
+	if err := s.serveSearch(w, r, u, rm); err != nil {
+		t.Fatalf("serveSearch: %v", err)
+	}
+	var resp struct {
+		Tracks []struct {
+			Track radio.Track `json:"track"`
+		} `json:"tracks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	var ids []string
+	for _, tq := range resp.Tracks {
+		ids = append(ids, tq.Track.ID)
+	}
+	if diff := cmp.Diff([]string{"spotify:b"}, ids); diff != "" {
+		t.Errorf("search results (-want +got)\n%s", diff)
+	}
+
+	// Tracks from the other providers can't be added either.
+	if err := s.addTrack(context.Background(), u, rm, "library:a", false); err == nil {
+		t.Error("adding a track from a provider the room doesn't use succeeded, want an error")
+	}
+	if err := s.addTrack(context.Background(), u, rm, "spotify:b", false); err != nil {
+		t.Errorf("addTrack: %v", err)
+	}
+}
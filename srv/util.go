@@ -3,6 +3,8 @@ package srv
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/bcspragu/Radiotation/db"
 	"github.com/gorilla/mux"
@@ -31,6 +33,17 @@ func (s *Srv) withRoomAndUser(rh roomHandler) http.HandlerFunc {
 	}
 }
 
+// withRoomAndMember is like withRoomAndUser, but only lets members of the room
+// through.
+func (s *Srv) withRoomAndMember(rh roomHandler) http.HandlerFunc {
+	return s.withRoomAndUser(func(w http.ResponseWriter, r *http.Request, u *db.User, rm *db.Room) error {
+		if err := s.checkMember(rm, u.ID); err != nil {
+			return err
+		}
+		return rh(w, r, u, rm)
+	})
+}
+
 func (s *Srv) user(r *http.Request) (*db.User, error) {
 	cookie, err := r.Cookie("user")
 
@@ -71,3 +84,44 @@ func (s *Srv) room(r *http.Request) (*db.Room, error) {
 
 	return rm, nil
 }
+
+// checkMember returns errNotMember unless the user is a member of the room.
+// Only members have a queue in it, except for the owner, who counts as a
+// member even before they've joined.
+func (s *Srv) checkMember(rm *db.Room, uid db.UserID) error {
+	if rm.OwnerID != "" && rm.OwnerID == uid {
+		return nil
+	}
+	_, err := s.queueDB.Tracks(db.QueueID{RoomID: rm.ID, UserID: uid}, &db.QueueOptions{Type: db.PlayedOnly})
+	if err == db.ErrQueueNotFound {
+		return errNotMember
+	}
+	return err
+}
+
+// checkOrigin returns a function that allows WebSocket requests from the
+// server's own origin, from any of the allowed origins, and from clients that
+// don't send an Origin header, which browsers always do.
+func checkOrigin(allowed []string) func(*http.Request) bool {
+	ok := make(map[string]bool)
+	for _, o := range allowed {
+		ok[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		return ok[strings.ToLower(u.Scheme+"://"+u.Host)]
+	}
+}
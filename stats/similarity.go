@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"math"
+	"strings"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+)
+
+// Similarity is a matrix of how similar the music taste of each pair of users
+// is. Scores[i][j] is the similarity between Users[i] and Users[j], from 0
+// (no artists in common) to 1 (the same artists, in the same proportions).
+type Similarity struct {
+	Users  []*db.User  `json:"users"`
+	Scores [][]float64 `json:"scores"`
+}
+
+// ComputeSimilarity compares users by the artists of the tracks they've
+// queued, given as a map from user ID to tracks. Each user is treated as a
+// vector of how many times they've queued each artist, and users are
+// compared with the cosine similarity of their vectors.
+func ComputeSimilarity(users []*db.User, tracks map[db.UserID][]*radio.Track) *Similarity {
+	vecs := make([]map[string]float64, len(users))
+	for i, u := range users {
+		vecs[i] = artistVector(tracks[u.ID])
+	}
+
+	sim := &Similarity{
+		Users:  users,
+		Scores: make([][]float64, len(users)),
+	}
+	for i := range users {
+		sim.Scores[i] = make([]float64, len(users))
+	}
+
+	for i := range users {
+		for j := i; j < len(users); j++ {
+			score := cosine(vecs[i], vecs[j])
+			sim.Scores[i][j] = score
+			sim.Scores[j][i] = score
+		}
+	}
+
+	return sim
+}
+
+func artistVector(ts []*radio.Track) map[string]float64 {
+	vec := make(map[string]float64)
+	for _, t := range ts {
+		for _, a := range artists(t) {
+			vec[strings.ToLower(a)]++
+		}
+	}
+	return vec
+}
+
+func cosine(a, b map[string]float64) float64 {
+	var dot, normA, normB float64
+	for k, v := range a {
+		dot += v * b[k]
+		normA += v * v
+	}
+	for _, v := range b {
+		normB += v * v
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,63 @@
+package stats
+
+import (
+	"math"
+	"testing"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+)
+
+func TestComputeSimilarity(t *testing.T) {
+	var (
+		alice = &db.User{ID: db.UserID("alice")}
+		bob   = &db.User{ID: db.UserID("bob")}
+		carol = &db.User{ID: db.UserID("carol")}
+		dave  = &db.User{ID: db.UserID("dave")}
+	)
+
+	track := func(artists ...string) *radio.Track {
+		t := &radio.Track{}
+		for _, a := range artists {
+			t.Artists = append(t.Artists, radio.Artist{Name: a})
+		}
+		return t
+	}
+
+	tracks := map[db.UserID][]*radio.Track{
+		alice.ID: {track("Steely Dan"), track("Russ")},
+		// Same artists as Alice, different case.
+		bob.ID:   {track("steely dan"), track("RUSS")},
+		carol.ID: {track("Tyga", "Pia Mia")},
+		// Dave hasn't queued anything.
+	}
+
+	sim := ComputeSimilarity([]*db.User{alice, bob, carol, dave}, tracks)
+
+	tests := []struct {
+		i, j int
+		want float64
+	}{
+		{0, 0, 1},
+		{0, 1, 1},
+		{1, 0, 1},
+		{0, 2, 0},
+		{2, 2, 1},
+		{0, 3, 0},
+		{3, 3, 0},
+	}
+
+	for _, tc := range tests {
+		if got := sim.Scores[tc.i][tc.j]; math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("Scores[%d][%d] = %f, want %f", tc.i, tc.j, got, tc.want)
+		}
+	}
+
+	// Partial overlap: Alice and Erin share one of two artists.
+	erin := &db.User{ID: db.UserID("erin")}
+	tracks[erin.ID] = []*radio.Track{track("Steely Dan"), track("Tyga")}
+	sim = ComputeSimilarity([]*db.User{alice, erin}, tracks)
+	if got := sim.Scores[0][1]; math.Abs(got-0.5) > 1e-9 {
+		t.Errorf("Scores[0][1] = %f, want 0.5", got)
+	}
+}
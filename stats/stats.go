@@ -0,0 +1,197 @@
+// Package stats computes listening statistics for rooms and their members,
+// from room history and queues.
+package stats
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+)
+
+// maxTopArtists is the number of artists to include in lists of top artists.
+const maxTopArtists = 5
+
+// Room holds the statistics for a room, and for each of its members.
+type Room struct {
+	// TracksPlayed is the number of tracks taken from queues. Replays aren't
+	// included.
+	TracksPlayed int     `json:"tracksPlayed"`
+	TotalMinutes float64 `json:"totalMinutes"`
+	Vetoes       int     `json:"vetoes"`
+
+	TopArtists []*ArtistCount `json:"topArtists"`
+
+	// Fairness compares how often each user's tracks were actually played
+	// against how often the rotation meant to play them. It's 1 when
+	// everyone got exactly their share, and approaches 0 as one user takes
+	// over the room.
+	Fairness float64 `json:"fairness"`
+
+	Users []*User `json:"users"`
+}
+
+// User holds the statistics for a single member of a room.
+type User struct {
+	User *db.User `json:"user"`
+
+	TracksPlayed int     `json:"tracksPlayed"`
+	Minutes      float64 `json:"minutes"`
+	// Queued is the number of tracks the user has waiting in their queue.
+	Queued int `json:"queued"`
+
+	VetoesGiven    int `json:"vetoesGiven"`
+	VetoesReceived int `json:"vetoesReceived"`
+
+	TopArtists []*ArtistCount `json:"topArtists"`
+
+	// PlayShare is the fraction of the room's played tracks that came from
+	// this user, and IntendedShare is the fraction the rotation was aiming for.
+	PlayShare     float64 `json:"playShare"`
+	IntendedShare float64 `json:"intendedShare"`
+}
+
+// ArtistCount is the number of times an artist was played.
+type ArtistCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Compute calculates statistics for a room with the given users, history,
+// and queues, keyed by the user the queue belongs to.
+func Compute(users []*db.User, hist []*db.TrackEntry, queues map[db.UserID][]*db.QueueTrack) *Room {
+	var (
+		rs          = &Room{}
+		byID        = make(map[db.UserID]*User)
+		roomArtists = make(map[string]int)
+		userArtists = make(map[db.UserID]map[string]int)
+	)
+
+	for _, u := range users {
+		us := &User{User: u}
+		byID[u.ID] = us
+		rs.Users = append(rs.Users, us)
+		userArtists[u.ID] = make(map[string]int)
+	}
+
+	for _, te := range hist {
+		us, ok := byID[te.UserID]
+		if !ok {
+			// The track is from someone who isn't in the room anymore.
+			continue
+		}
+
+		mins := minutes(te.Track)
+		rs.TotalMinutes += mins
+		us.Minutes += mins
+
+		if te.Vetoed {
+			rs.Vetoes++
+			us.VetoesReceived++
+			if vu, ok := byID[te.VetoedBy]; ok {
+				vu.VetoesGiven++
+			}
+		}
+
+		// Replays don't come out of anybody's turn, so they don't count as
+		// plays.
+		if te.Replay {
+			continue
+		}
+
+		rs.TracksPlayed++
+		us.TracksPlayed++
+		for _, a := range artists(te.Track) {
+			roomArtists[a]++
+			userArtists[te.UserID][a]++
+		}
+	}
+
+	for _, us := range rs.Users {
+		for _, qt := range queues[us.User.ID] {
+			if !qt.Played {
+				us.Queued++
+			}
+		}
+		us.TopArtists = topArtists(userArtists[us.User.ID])
+	}
+	rs.TopArtists = topArtists(roomArtists)
+
+	intended := intendedShares(rs.Users, queues)
+	var dist float64
+	for _, us := range rs.Users {
+		if rs.TracksPlayed > 0 {
+			us.PlayShare = float64(us.TracksPlayed) / float64(rs.TracksPlayed)
+		}
+		us.IntendedShare = intended[us.User.ID]
+		dist += math.Abs(us.PlayShare - us.IntendedShare)
+	}
+	// The fairness index is one minus the total variation distance between
+	// the actual and intended distributions of plays.
+	rs.Fairness = 1
+	if rs.TracksPlayed > 0 {
+		rs.Fairness = 1 - dist/2
+	}
+
+	return rs
+}
+
+// intendedShares returns the share of plays each user should get. All of our
+// rotators give each user with tracks an equal turn (the random rotator does
+// so on average), and users who never queued anything are skipped over, so
+// they aren't owed anything.
+func intendedShares(users []*User, queues map[db.UserID][]*db.QueueTrack) map[db.UserID]float64 {
+	var active []db.UserID
+	for _, us := range users {
+		if len(queues[us.User.ID]) > 0 || us.TracksPlayed > 0 {
+			active = append(active, us.User.ID)
+		}
+	}
+
+	shares := make(map[db.UserID]float64)
+	for _, id := range active {
+		shares[id] = 1 / float64(len(active))
+	}
+	return shares
+}
+
+func minutes(t *radio.Track) float64 {
+	if t == nil {
+		return 0
+	}
+	return (time.Duration(t.DurationMS) * time.Millisecond).Minutes()
+}
+
+func artists(t *radio.Track) []string {
+	if t == nil {
+		return nil
+	}
+	var names []string
+	for _, a := range t.Artists {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// topArtists returns the most played artists, most played first. Ties are
+// broken by name, so the output is stable.
+func topArtists(counts map[string]int) []*ArtistCount {
+	acs := make([]*ArtistCount, 0, len(counts))
+	for name, n := range counts {
+		acs = append(acs, &ArtistCount{Name: name, Count: n})
+	}
+
+	sort.Slice(acs, func(i, j int) bool {
+		if acs[i].Count != acs[j].Count {
+			return acs[i].Count > acs[j].Count
+		}
+		return acs[i].Name < acs[j].Name
+	})
+
+	if len(acs) > maxTopArtists {
+		acs = acs[:maxTopArtists]
+	}
+	return acs
+}
@@ -0,0 +1,102 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/bcspragu/Radiotation/db"
+	"github.com/bcspragu/Radiotation/radio"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCompute(t *testing.T) {
+	var (
+		alice = &db.User{ID: db.UserID("alice"), First: "Alice"}
+		bob   = &db.User{ID: db.UserID("bob"), First: "Bob"}
+		carol = &db.User{ID: db.UserID("carol"), First: "Carol"}
+	)
+
+	track := func(artist string) *radio.Track {
+		return &radio.Track{
+			Artists:    []radio.Artist{{Name: artist}},
+			DurationMS: 3 * 60 * 1000,
+		}
+	}
+
+	hist := []*db.TrackEntry{
+		{UserID: alice.ID, Track: track("Steely Dan")},
+		{UserID: bob.ID, Track: track("Russ")},
+		{UserID: alice.ID, Track: track("Steely Dan"), Vetoed: true, VetoedBy: bob.ID},
+		{UserID: alice.ID, Track: track("Steely Dan"), Replay: true, ReplayOf: 0},
+		{UserID: bob.ID, Track: track("Pia Mia")},
+		{UserID: alice.ID, Track: track("Tyga")},
+	}
+
+	queues := map[db.UserID][]*db.QueueTrack{
+		alice.ID: {{Played: true}, {Played: true}, {Played: true}, {Played: false}},
+		bob.ID:   {{Played: true}, {Played: true}},
+	}
+
+	got := Compute([]*db.User{alice, bob, carol}, hist, queues)
+
+	want := &Room{
+		TracksPlayed: 5,
+		TotalMinutes: 18,
+		Vetoes:       1,
+		TopArtists: []*ArtistCount{
+			{Name: "Steely Dan", Count: 2},
+			{Name: "Pia Mia", Count: 1},
+			{Name: "Russ", Count: 1},
+			{Name: "Tyga", Count: 1},
+		},
+		Fairness: 0.9,
+		Users: []*User{
+			{
+				User:           alice,
+				TracksPlayed:   3,
+				Minutes:        12,
+				Queued:         1,
+				VetoesReceived: 1,
+				TopArtists: []*ArtistCount{
+					{Name: "Steely Dan", Count: 2},
+					{Name: "Tyga", Count: 1},
+				},
+				PlayShare:     0.6,
+				IntendedShare: 0.5,
+			},
+			{
+				User:         bob,
+				TracksPlayed: 2,
+				Minutes:      6,
+				VetoesGiven:  1,
+				TopArtists: []*ArtistCount{
+					{Name: "Pia Mia", Count: 1},
+					{Name: "Russ", Count: 1},
+				},
+				PlayShare:     0.4,
+				IntendedShare: 0.5,
+			},
+			{
+				User:       carol,
+				TopArtists: []*ArtistCount{},
+			},
+		},
+	}
+
+	approx := cmp.Comparer(func(x, y float64) bool {
+		d := x - y
+		return d < 1e-9 && d > -1e-9
+	})
+	if diff := cmp.Diff(want, got, approx); diff != "" {
+		t.Errorf("Compute() (-want +got)\n%s", diff)
+	}
+}
+
+func TestComputeEmpty(t *testing.T) {
+	got := Compute(nil, nil, nil)
+	if got.Fairness != 1 {
+		t.Errorf("Fairness = %f, want 1", got.Fairness)
+	}
+	if got.TracksPlayed != 0 {
+		t.Errorf("TracksPlayed = %d, want 0", got.TracksPlayed)
+	}
+}